@@ -1,33 +1,97 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"io"
+	"net/http"
+	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
 
 const (
-	// TODO(szpakas): move to config
+	// ingressQueueSize is a default size of the ingress queue.
 	ingressQueueSize = 1024 * 100
+
+	// seriesExpirySweepInterval is a period of checks for series with expired TTL.
+	seriesExpirySweepInterval = time.Second
+
+	// seriesKeyCollisionSeparator separates hash from the full key in storage key of the series with colliding hash.
+	// Such storage key is longer than any hash so it never collides with regular ones.
+	seriesKeyCollisionSeparator = "\x00"
+
+	// setHLLPrecision defines number of registers (2^precision) used by each set.
+	// It's also the memory used by single set in bytes. Standard error of the estimation is ~1.6%.
+	setHLLPrecision = 12
+)
+
+// ingressQueuePolicy defines handling of the samples written to the full ingress queue.
+type ingressQueuePolicy string
+
+const (
+	// ingressQueuePolicyDropNewest drops the sample being written.
+	ingressQueuePolicyDropNewest ingressQueuePolicy = "drop_newest"
+
+	// ingressQueuePolicyBlock waits for space in the queue, up to the timeout. Sample is dropped after the timeout.
+	ingressQueuePolicyBlock ingressQueuePolicy = "block"
+
+	// ingressQueuePolicyDropOldest drops the oldest sample in the queue, making space for the one being written.
+	ingressQueuePolicyDropOldest ingressQueuePolicy = "drop_oldest"
 )
 
 var (
-	// ErrIngressQueueFull is returned when ingress queue for samples is full.
-	// Sample is not queued in such case.
+	// ErrIngressQueueFull is returned when ingress queue for samples is full and a sample is dropped.
+	// With drop oldest policy the sample is queued in place of the oldest one, so the error reports the drop only.
 	// Optional retries should be handled on caller side.
 	ErrIngressQueueFull = errors.New("collector: ingress queue is full")
+
+	// ErrHistogramDefInvalid is returned when histogram definition can not be converted to buckets.
+	ErrHistogramDefInvalid = errors.New("collector: invalid histogram definition")
+
+	// ErrSummaryDefInvalid is returned when summary definition can not be converted to objectives and max age.
+	ErrSummaryDefInvalid = errors.New("collector: invalid summary definition")
 )
 
+// ingressSamplesDropped is returned in place of ErrIngressQueueFull when more than one sample was dropped by single write.
+// It happens with drop oldest policy, when space made by the write is taken by other writer first.
+type ingressSamplesDropped int
+
+func (n ingressSamplesDropped) Error() string {
+	return ErrIngressQueueFull.Error()
+}
+
+// ingressDropped returns number of the samples dropped according to the error returned by Write.
+func ingressDropped(err error) int {
+	switch n := err.(type) {
+	case ingressSamplesDropped:
+		return int(n)
+	}
+	if err == ErrIngressQueueFull {
+		return 1
+	}
+	return 0
+}
+
 type collector struct {
 	startTime time.Time
 
 	// ingress holds incoming samples for processing
 	ingressCh chan *sample
+	// ingressPolicy defines handling of the samples written to the full queue, empty is the same as drop newest
+	ingressPolicy ingressQueuePolicy
+	// ingressTimeout is a max time of waiting for space in the queue with block policy
+	ingressTimeout time.Duration
+
+	// hasher is used to recognize samples belonging to the same series
+	hasher sampleHasherFunc
 
 	// sampleParser parses samples represented in transport (text) format and converts it to samples
 	sampleParser func(r io.Reader) ([]sample, error)
@@ -38,10 +102,104 @@ type collector struct {
 
 	gauges   map[string]prometheus.Gauge
 	gaugesMu sync.RWMutex
+	// gaugeAggs holds state of the gauges aggregated with mode other than last, keyed the same way as gauges.
+	// Accessed only by process so no locking is required.
+	gaugeAggs map[string]*gaugeAggregate
+	// gaugeAggregation is a mode used for gauges not matching any of gaugeAggregationRules
+	gaugeAggregation      gaugeAggregation
+	gaugeAggregationRules []gaugeAggregationRule
+	// gaugeAggregationWindow is a window after which aggregation of all gauges starts from scratch. Zero disables the reset.
+	gaugeAggregationWindow time.Duration
 
-	histograms   map[string]prometheus.Histogram
+	histograms   map[string]*histogram
 	histogramsMu sync.RWMutex
 
+	nativeHistograms   map[string]*nativeHistogram
+	nativeHistogramsMu sync.RWMutex
+
+	summaries   map[string]prometheus.Summary
+	summariesMu sync.RWMutex
+	// summaryDefs holds definition used on creation of the summary, keyed the same way as summaries.
+	// Accessed only by process so no locking is required.
+	summaryDefs map[string]summaryDef
+
+	sets   map[string]prometheus.Gauge
+	setsMu sync.RWMutex
+	// setHLLs holds estimators backing the sets, keyed the same way as sets.
+	// Accessed only by process so no locking is required.
+	setHLLs map[string]*hyperLogLog
+	// setResetInterval is a window after which all sets are cleared. Zero disables the reset.
+	setResetInterval time.Duration
+
+	// deltas holds counters and gauges exposed in delta mode
+	deltas   map[string]*deltaMetric
+	deltasMu sync.RWMutex
+	// deltaMetrics matches names of the metrics exposed in delta mode. Nil disables the mode.
+	deltaMetrics *regexp.Regexp
+	// scrapeMu serializes scrapes so resetOnCollect applies only to the designated one
+	scrapeMu sync.Mutex
+	// resetOnCollect is set (to 1) for the duration of the scrape resetting delta metrics
+	resetOnCollect int32
+
+	// lastUpdates holds time of the last update of every series, keyed the same way as series storage.
+	// Used only if lastUpdateMode is other than none.
+	lastUpdates    map[string]*seriesLastUpdate
+	lastUpdatesMu  sync.RWMutex
+	lastUpdateMode seriesLastUpdateMode
+	// timestampMaxSkew is a max difference between timestamp sent by the client and local clock. Zero disables the check.
+	timestampMaxSkew time.Duration
+
+	// snapshotFile is a path to the file with persisted state of the series. Empty disables snapshots.
+	snapshotFile string
+	// snapshotInterval is a period between snapshots. Snapshot is also written on stop.
+	snapshotInterval time.Duration
+	// snapshotDoneCh receives result of the snapshot written in background. Nil if no snapshot is being written.
+	snapshotDoneCh chan *snapshotResult
+
+	// wal is a log of the samples accepted since the last snapshot. Nil if disabled.
+	wal *wal
+	// walSeq is a sequence number of the last sample appended to the log
+	walSeq uint64
+	// walSyncInterval is a period between syncs of the log, samples appended in the meantime are synced in batch
+	walSyncInterval time.Duration
+	// walMaxSize is a size of the log in bytes at which it's truncated, so it's bounded while snapshots fail. Zero disables the limit.
+	walMaxSize int64
+
+	// metadata holds descriptions used on creation of the metrics
+	metadata *metadataRegistry
+
+	// seriesTTL is a default TTL of the series, used for samples without TTL set by mapping. Zero keeps series forever.
+	seriesTTL time.Duration
+	// maxSeries limits number of the series, samples of new series above the limit are rejected. Zero disables the limit.
+	maxSeries int
+
+	// expiries holds time after which series with TTL are removed, keyed the same way as series storage.
+	// Accessed only by process so no locking is required.
+	expiries map[string]time.Time
+
+	// identities holds identity of every series, keyed the same way as series storage.
+	// Used to detect hash collisions. Accessed only by process so no locking is required.
+	identities map[string]*seriesIdentity
+	// collisions counts series stored under extended key, by the hash they collide on.
+	// Such series are looked up under extended key first, also after the series stored under the hash is removed.
+	collisions map[string]int
+
+	// families describes series grouped by metric name.
+	// Accessed only by process so no locking is required.
+	families map[string]*family
+
+	// conflicts holds details about samples rejected due to conflict with their families
+	conflicts   map[string]*familyConflict
+	conflictsMu sync.Mutex
+
+	// labelNamesPolicy defines handling of the samples with label names different than the rest of the family
+	labelNamesPolicy labelNamesPolicy
+	// labelNamesFillValue is used for missing labels with labelNamesPolicyFill
+	labelNamesFillValue string
+
+	// settingsCh passes new settings to the running process
+	settingsCh chan *collectorSettings
+
 	testHookProcessSampleDone func()
 
 	// quitCh is used to signal shutdown request
@@ -55,14 +213,51 @@ type collector struct {
 	metricAppDuration        prometheus.Gauge
 	metricQueueLength        prometheus.Gauge
 	metricProcessingDuration *prometheus.SummaryVec
+	metricSamplesRejected    *prometheus.CounterVec
+	metricMetadataConflicts  *prometheus.CounterVec
+	metricMetadataDropped    prometheus.Counter
+	metricConflicts          *prometheus.CounterVec
+	metricHashCollisions     prometheus.Counter
+	metricSeriesExpired      prometheus.Counter
+	metricSnapshots          *prometheus.CounterVec
+	metricWALFailures        *prometheus.CounterVec
+	metricWALOverflows       prometheus.Counter
+	metricWALSize            prometheus.Gauge
 }
 
 func newCollector() *collector {
 	return &collector{
 		ingressCh:                 make(chan *sample, ingressQueueSize),
+		ingressPolicy:             ingressQueuePolicyDropNewest,
+		ingressTimeout:            100 * time.Millisecond,
+		hasher:                    hashProm,
 		counters:                  make(map[string]prometheus.Counter),
 		gauges:                    make(map[string]prometheus.Gauge),
-		histograms:                make(map[string]prometheus.Histogram),
+		gaugeAggs:                 make(map[string]*gaugeAggregate),
+		gaugeAggregation:          gaugeAggregationLast,
+		gaugeAggregationWindow:    time.Minute,
+		histograms:                make(map[string]*histogram),
+		nativeHistograms:          make(map[string]*nativeHistogram),
+		summaries:                 make(map[string]prometheus.Summary),
+		summaryDefs:               make(map[string]summaryDef),
+		sets:                      make(map[string]prometheus.Gauge),
+		setHLLs:                   make(map[string]*hyperLogLog),
+		setResetInterval:          time.Minute,
+		deltas:                    make(map[string]*deltaMetric),
+		lastUpdates:               make(map[string]*seriesLastUpdate),
+		lastUpdateMode:            seriesLastUpdateNone,
+		timestampMaxSkew:          time.Minute,
+		snapshotInterval:          time.Minute,
+		walSyncInterval:           time.Second,
+		metadata:                  newMetadataRegistry(),
+		identities:                make(map[string]*seriesIdentity),
+		collisions:                make(map[string]int),
+		expiries:                  make(map[string]time.Time),
+		families:                  make(map[string]*family),
+		conflicts:                 make(map[string]*familyConflict),
+		labelNamesPolicy:          labelNamesPolicyAllow,
+		labelNamesFillValue:       "none",
+		settingsCh:                make(chan *collectorSettings),
 		testHookProcessSampleDone: func() {},
 		quitCh:          make(chan struct{}),
 		shutdownDownCh:  make(chan struct{}),
@@ -95,6 +290,80 @@ func newCollector() *collector {
 			},
 			[]string{"sampleKind"},
 		),
+
+		metricSamplesRejected: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "app_collector_samples_rejected_total",
+				Help: "Number of samples rejected by the collector.",
+			},
+			[]string{"reason"},
+		),
+
+		metricMetadataConflicts: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "app_collector_metadata_conflicts_total",
+				Help: "Number of metadata entries rejected due to conflict with already known ones.",
+			},
+			[]string{"kind"},
+		),
+		metricMetadataDropped: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "app_collector_metadata_dropped_total",
+				Help: "Number of metadata entries of new metrics dropped due to full registry.",
+			},
+		),
+
+		metricConflicts: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "app_collector_conflicts_total",
+				Help: "Number of samples conflicting with other series of the metric.",
+			},
+			[]string{"reason"},
+		),
+
+		metricHashCollisions: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "app_collector_hash_collisions_total",
+				Help: "Number of samples with hash colliding with other series.",
+			},
+		),
+
+		metricSeriesExpired: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "app_collector_series_expired_total",
+				Help: "Number of series removed due to expired TTL.",
+			},
+		),
+
+		metricSnapshots: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "app_collector_snapshots_total",
+				Help: "Number of snapshots of the series written to disk.",
+			},
+			[]string{"result"},
+		),
+
+		metricWALFailures: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "app_collector_wal_failures_total",
+				Help: "Number of failed operations on the write-ahead log.",
+			},
+			[]string{"op"},
+		),
+
+		metricWALOverflows: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "app_collector_wal_overflows_total",
+				Help: "Number of truncations of the write-ahead log forced by the size limit.",
+			},
+		),
+
+		metricWALSize: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "app_collector_wal_size_bytes",
+				Help: "Size of the write-ahead log.",
+			},
+		),
 	}
 }
 
@@ -107,24 +376,61 @@ func (c *collector) Collect(ch chan<- prometheus.Metric) {
 
 	c.metricQueueLength.Collect(ch)
 	c.metricProcessingDuration.Collect(ch)
+	c.metricSamplesRejected.Collect(ch)
+	c.metricMetadataConflicts.Collect(ch)
+	c.metricMetadataDropped.Collect(ch)
+	c.metricConflicts.Collect(ch)
+	c.metricHashCollisions.Collect(ch)
+	c.metricSeriesExpired.Collect(ch)
+	c.metricSnapshots.Collect(ch)
+	c.metricWALFailures.Collect(ch)
+	c.metricWALOverflows.Collect(ch)
+	c.metricWALSize.Collect(ch)
 
 	c.countersMu.RLock()
-	for _, m := range c.counters {
-		m.Collect(ch)
+	for h, m := range c.counters {
+		c.collectSeries(ch, h, m)
 	}
 	c.countersMu.RUnlock()
 
 	c.gaugesMu.RLock()
-	for _, m := range c.gauges {
-		m.Collect(ch)
+	for h, m := range c.gauges {
+		c.collectSeries(ch, h, m)
 	}
 	c.gaugesMu.RUnlock()
 
 	c.histogramsMu.RLock()
-	for _, m := range c.histograms {
-		m.Collect(ch)
+	for h, m := range c.histograms {
+		c.collectSeries(ch, h, m)
 	}
 	c.histogramsMu.RUnlock()
+
+	c.nativeHistogramsMu.RLock()
+	for h, m := range c.nativeHistograms {
+		c.collectSeries(ch, h, m)
+	}
+	c.nativeHistogramsMu.RUnlock()
+
+	c.summariesMu.RLock()
+	for h, m := range c.summaries {
+		c.collectSeries(ch, h, m)
+	}
+	c.summariesMu.RUnlock()
+
+	c.setsMu.RLock()
+	for h, m := range c.sets {
+		c.collectSeries(ch, h, m)
+	}
+	c.setsMu.RUnlock()
+
+	reset := atomic.LoadInt32(&c.resetOnCollect) == 1
+	c.deltasMu.RLock()
+	for _, m := range c.deltas {
+		m.collect(ch, reset)
+	}
+	c.deltasMu.RUnlock()
+
+	c.collectLastUpdates(ch)
 }
 
 // Describe implements prometheus.Collector.
@@ -133,6 +439,16 @@ func (c *collector) Describe(ch chan<- *prometheus.Desc) {
 	c.metricAppDuration.Describe(ch)
 	c.metricQueueLength.Describe(ch)
 	c.metricProcessingDuration.Describe(ch)
+	c.metricSamplesRejected.Describe(ch)
+	c.metricMetadataConflicts.Describe(ch)
+	c.metricMetadataDropped.Describe(ch)
+	c.metricConflicts.Describe(ch)
+	c.metricHashCollisions.Describe(ch)
+	c.metricSeriesExpired.Describe(ch)
+	c.metricSnapshots.Describe(ch)
+	c.metricWALFailures.Describe(ch)
+	c.metricWALOverflows.Describe(ch)
+	c.metricWALSize.Describe(ch)
 }
 
 func (c *collector) start() {
@@ -156,15 +472,97 @@ func (c *collector) stop() error {
 	return nil
 }
 
+// collectorSettings holds settings of the collector which can be changed while it's running.
+type collectorSettings struct {
+	timestampMaxSkew    time.Duration
+	labelNamesPolicy    labelNamesPolicy
+	labelNamesFillValue string
+	seriesTTL           time.Duration
+
+	// applied is closed when settings are in use
+	applied chan struct{}
+}
+
+// applySettings changes settings. Should be called only from process or before start.
+// Series already created are not affected, e.g. new TTL applies from the next sample.
+func (c *collector) applySettings(s *collectorSettings) {
+	c.timestampMaxSkew = s.timestampMaxSkew
+	c.labelNamesPolicy = s.labelNamesPolicy
+	c.labelNamesFillValue = s.labelNamesFillValue
+	c.seriesTTL = s.seriesTTL
+}
+
+// reconfigure changes settings of the running collector. Returns when new settings are in use.
+// Settings of the stopped collector are ignored, it does not process samples anymore.
+func (c *collector) reconfigure(s *collectorSettings) {
+	s.applied = make(chan struct{})
+	select {
+	case c.settingsCh <- s:
+	case <-c.shutdownDownCh:
+		return
+	}
+	<-s.applied
+}
+
 // Write adds samples to internal queue for processing.
-// Will result in ErrIngressQueueFull error if queue is full. The sample is not added to queue in such case.
+// Will result in ErrIngressQueueFull error if queue is full and a sample is dropped according to the ingress policy,
+// or in ingressSamplesDropped error if more samples were dropped. Use ingressDropped to count them.
 func (c *collector) Write(s *sample) error {
 	select {
 	case c.ingressCh <- s:
+		return nil
 	default:
-		return ErrIngressQueueFull
 	}
-	return nil
+
+	switch c.ingressPolicy {
+	case ingressQueuePolicyBlock:
+		timer := time.NewTimer(c.ingressTimeout)
+		defer timer.Stop()
+		select {
+		case c.ingressCh <- s:
+			return nil
+		case <-timer.C:
+		}
+
+	case ingressQueuePolicyDropOldest:
+		// space made here can be taken by other writer first, so it's repeated until the sample is queued
+		var dropped ingressSamplesDropped
+		for {
+			select {
+			case <-c.ingressCh:
+				dropped++
+			default:
+			}
+			select {
+			case c.ingressCh <- s:
+				switch dropped {
+				case 0:
+					return nil
+				case 1:
+					return ErrIngressQueueFull
+				}
+				return dropped
+			default:
+			}
+		}
+	}
+
+	return ErrIngressQueueFull
+}
+
+// WriteMetadata adds metadata to the registry used on creation of metrics.
+// Metrics already created are not affected.
+func (c *collector) WriteMetadata(m *metadata) error {
+	switch err := c.metadata.set(m); err {
+	case nil:
+		return nil
+	case ErrMetadataRegistryFull:
+		c.metricMetadataDropped.Inc()
+		return err
+	default:
+		c.metricMetadataConflicts.WithLabelValues(string(m.kind)).Inc()
+		return err
+	}
 }
 
 // process is responsible from converting samples to metrics and persisting in storage (in-memory)
@@ -172,83 +570,598 @@ func (c *collector) Write(s *sample) error {
 func (c *collector) process() {
 	var (
 		s  *sample
-		h  []byte
 		tS time.Time
+
+		// nil channel blocks forever so reset is disabled
+		setResetCh    <-chan time.Time
+		gaugeWindowCh <-chan time.Time
+		snapshotCh    <-chan time.Time
+		walSyncCh     <-chan time.Time
 	)
+	expiryTicker := time.NewTicker(seriesExpirySweepInterval)
+	defer expiryTicker.Stop()
+	if c.setResetInterval > 0 {
+		setResetTicker := time.NewTicker(c.setResetInterval)
+		defer setResetTicker.Stop()
+		setResetCh = setResetTicker.C
+	}
+	if c.gaugeAggregationWindow > 0 {
+		gaugeWindowTicker := time.NewTicker(c.gaugeAggregationWindow)
+		defer gaugeWindowTicker.Stop()
+		gaugeWindowCh = gaugeWindowTicker.C
+	}
+	if c.snapshotFile != "" && c.snapshotInterval > 0 {
+		snapshotTicker := time.NewTicker(c.snapshotInterval)
+		defer snapshotTicker.Stop()
+		snapshotCh = snapshotTicker.C
+	}
+	if c.wal != nil && c.walSyncInterval > 0 {
+		walSyncTicker := time.NewTicker(c.walSyncInterval)
+		defer walSyncTicker.Stop()
+		walSyncCh = walSyncTicker.C
+	}
+
 	for {
 		select {
 		case s = <-c.ingressCh:
 			tS = time.Now()
 			c.metricQueueLength.Set(float64(len(c.ingressCh)))
 
-			h = s.hash()
-
-			switch s.kind {
-			case sampleCounter:
-				// race avoidance is not needed on existence check as "process" is the only one modifying storage
-				m, found := c.counters[string(h)]
-				if !found {
-					m = prometheus.NewCounter(
-						prometheus.CounterOpts{
-							Name:        s.name,
-							Help:        "auto",
-							ConstLabels: s.labels,
-						},
-					)
-					c.countersMu.Lock()
-					c.counters[string(h)] = m
-					c.countersMu.Unlock()
-				}
+			c.walAppend(s)
+			c.processSample(s)
 
-				m.Add(s.value)
-
-			case sampleGauge:
-				m, found := c.gauges[string(h)]
-				if !found {
-					m = prometheus.NewGauge(
-						prometheus.GaugeOpts{
-							Name:        s.name,
-							Help:        "auto",
-							ConstLabels: s.labels,
-						},
-					)
-					c.gaugesMu.Lock()
-					c.gauges[string(h)] = m
-					c.gaugesMu.Unlock()
-				}
+			c.testHookProcessSampleDone()
 
-				m.Set(s.value)
-
-			case sampleHistogramLinear:
-				m, found := c.histograms[string(h)]
-				if !found {
-					start, _ := strconv.ParseFloat(s.histogramDef[0], 10)
-					width, _ := strconv.ParseFloat(s.histogramDef[1], 10)
-					count, _ := strconv.Atoi(s.histogramDef[2])
-					m = prometheus.NewHistogram(
-						prometheus.HistogramOpts{
-							Name:        s.name,
-							Help:        "auto",
-							ConstLabels: s.labels,
-							Buckets:     prometheus.LinearBuckets(start, width, count),
-						},
-					)
-					c.histogramsMu.Lock()
-					c.histograms[string(h)] = m
-					c.histogramsMu.Unlock()
-				}
+			c.metricProcessingDuration.WithLabelValues(string(s.kind)).
+				Observe(float64(time.Since(tS).Nanoseconds()))
 
-				m.Observe(s.value)
+		case <-setResetCh:
+			for k, hll := range c.setHLLs {
+				hll.reset()
+				c.sets[k].Set(0)
 			}
 
-			c.testHookProcessSampleDone()
+		case <-gaugeWindowCh:
+			for _, g := range c.gaugeAggs {
+				g.reset()
+			}
 
-			c.metricProcessingDuration.WithLabelValues(string(s.kind)).
-				Observe(float64(time.Since(tS).Nanoseconds()))
+		case <-snapshotCh:
+			c.startSnapshot()
+
+		case res := <-c.snapshotDoneCh:
+			c.finishSnapshot(res)
+
+		case <-walSyncCh:
+			c.walSync()
+
+		case now := <-expiryTicker.C:
+			c.expireSeries(now)
+
+		case settings := <-c.settingsCh:
+			c.applySettings(settings)
+			close(settings.applied)
 
 		case <-c.quitCh:
+			if c.snapshotDoneCh != nil {
+				c.finishSnapshot(<-c.snapshotDoneCh)
+			}
+			if c.snapshotFile != "" {
+				c.saveSnapshot()
+			}
+			if c.wal != nil {
+				if err := c.wal.close(); err != nil {
+					c.metricWALFailures.WithLabelValues("close").Inc()
+				}
+			}
 			close(c.shutdownDownCh)
 			return
 		}
 	}
 }
+
+// processSample converts single sample to metric.
+// Should be called only from process.
+func (c *collector) processSample(s *sample) {
+	// flat names have to be mapped before, prometheus does not accept them
+	if !metricNameValid(s.name) {
+		c.metricSamplesRejected.WithLabelValues("invalid_name").Inc()
+		return
+	}
+
+	if c.nameReserved(s.name) {
+		c.metricSamplesRejected.WithLabelValues("reserved_name").Inc()
+		return
+	}
+
+	if c.timestampSkewed(s) {
+		c.metricSamplesRejected.WithLabelValues("timestamp_skew").Inc()
+		return
+	}
+
+	// all series of the metric must be consistent, conflicting samples are rejected
+	fam, famFound := c.families[s.name]
+	if famFound {
+		switch reason := fam.conflict(s); {
+		case reason == "":
+		case reason != familyConflictLabelNames:
+			c.reportConflict(s, fam, reason)
+			return
+		case c.labelNamesPolicy == labelNamesPolicyFill:
+			filled, ok := fam.fill(s, c.labelNamesFillValue)
+			if !ok {
+				c.reportConflict(s, fam, reason)
+				return
+			}
+			s = filled
+		case c.labelNamesPolicy == labelNamesPolicyReject:
+			c.reportConflict(s, fam, reason)
+			return
+		default:
+			// different label names are accepted by Prometheus so the sample is only reported
+			c.reportConflict(s, fam, reason)
+		}
+	}
+
+	help := c.metadata.help(s.name)
+	delta := c.deltaMetrics != nil && c.deltaMetrics.MatchString(s.name)
+	if famFound {
+		help = fam.help
+		delta = fam.delta
+
+		// same layout written differently must end up in the same series
+		if (fam.buckets != nil || fam.native != nil) && !stringsEqual(s.histogramDef, fam.histogramDef) {
+			canonical := *s
+			canonical.histogramDef = fam.histogramDef
+			s = &canonical
+		}
+	}
+
+	h := c.seriesKey(s)
+	if c.maxSeries > 0 && len(c.identities) >= c.maxSeries {
+		if _, found := c.identities[h]; !found {
+			c.metricSamplesRejected.WithLabelValues("series_limit").Inc()
+			return
+		}
+	}
+
+	if !delta && c.sampleOutOfOrder(h, s) {
+		c.metricSamplesRejected.WithLabelValues("out_of_order").Inc()
+		return
+	}
+
+	switch s.kind {
+	case sampleCounter:
+		if delta {
+			c.processDelta(h, s, help)
+			break
+		}
+
+		// race avoidance is not needed on existence check as "process" is the only one modifying storage
+		m, found := c.counters[h]
+		if !found {
+			m = prometheus.NewCounter(
+				prometheus.CounterOpts{
+					Name:        s.name,
+					Help:        help,
+					ConstLabels: s.labels,
+				},
+			)
+			c.countersMu.Lock()
+			c.counters[h] = m
+			c.countersMu.Unlock()
+		}
+
+		m.Add(s.value * s.weight())
+
+	case sampleGauge:
+		if delta {
+			c.processDelta(h, s, help)
+			break
+		}
+
+		m, found := c.gauges[h]
+		if !found {
+			m = prometheus.NewGauge(
+				prometheus.GaugeOpts{
+					Name:        s.name,
+					Help:        help,
+					ConstLabels: s.labels,
+				},
+			)
+			if mode := c.gaugeAggregationFor(s.name); mode != gaugeAggregationLast {
+				c.gaugeAggs[h] = &gaugeAggregate{mode: mode}
+			}
+			c.gaugesMu.Lock()
+			c.gauges[h] = m
+			c.gaugesMu.Unlock()
+		}
+
+		if g, found := c.gaugeAggs[h]; found {
+			m.Set(g.observe(s.value))
+			break
+		}
+		m.Set(s.value)
+
+	case sampleHistogramLinear, sampleHistogramExponential:
+		m, found := c.histograms[h]
+		if !found {
+			buckets, err := histogramBuckets(s)
+			if err != nil {
+				// invalid definition would make prometheus client panic, sample is dropped
+				c.metricSamplesRejected.WithLabelValues("histogram_def_invalid").Inc()
+				return
+			}
+			m = newHistogram(
+				prometheus.HistogramOpts{
+					Name:        s.name,
+					Help:        help,
+					ConstLabels: s.labels,
+					Buckets:     buckets,
+				},
+			)
+			c.histogramsMu.Lock()
+			c.histograms[h] = m
+			c.histogramsMu.Unlock()
+		}
+
+		if s.aggregate == nil {
+			m.observeWeighted(s.value, s.weight())
+			break
+		}
+
+		// pre-aggregated buckets are merged only if layout is exactly the same
+		if buckets, err := histogramBuckets(s); err != nil || !m.sameLayout(buckets) {
+			c.metricSamplesRejected.WithLabelValues("histogram_layout_mismatch").Inc()
+			break
+		}
+		switch err := m.merge(s.aggregate.counts, s.aggregate.sum, s.aggregate.count); err {
+		case nil:
+		case ErrHistogramLayoutMismatch:
+			c.metricSamplesRejected.WithLabelValues("histogram_layout_mismatch").Inc()
+		default:
+			c.metricSamplesRejected.WithLabelValues("histogram_aggregate_invalid").Inc()
+		}
+
+	case sampleHistogramNative:
+		m, found := c.nativeHistograms[h]
+		if !found {
+			def, err := nativeHistogramDefOf(s)
+			if err != nil {
+				c.metricSamplesRejected.WithLabelValues("histogram_def_invalid").Inc()
+				return
+			}
+			m = newNativeHistogram(
+				prometheus.HistogramOpts{
+					Name:        s.name,
+					Help:        help,
+					ConstLabels: s.labels,
+				},
+				def,
+			)
+			c.nativeHistogramsMu.Lock()
+			c.nativeHistograms[h] = m
+			c.nativeHistogramsMu.Unlock()
+		}
+
+		// native buckets are not pre-aggregated by clients, empty aggregate only creates the series (on restore)
+		if s.aggregate == nil {
+			m.observeWeighted(s.value, s.weight())
+		}
+
+	case sampleSummary:
+		// definition is compared parsed, so the same objectives written differently (order, trailing zeros) match
+		objectives, maxAge, err := summaryOpts(s)
+		if err != nil {
+			c.metricSamplesRejected.WithLabelValues("summary_def_invalid").Inc()
+			return
+		}
+		def := summaryDef{objectives: objectives, maxAge: maxAge}
+		m, found := c.summaries[h]
+		if !found {
+			m = prometheus.NewSummary(
+				prometheus.SummaryOpts{
+					Name:        s.name,
+					Help:        help,
+					ConstLabels: s.labels,
+					Objectives:  objectives,
+					MaxAge:      maxAge,
+				},
+			)
+			c.summaryDefs[h] = def
+			c.summariesMu.Lock()
+			c.summaries[h] = m
+			c.summariesMu.Unlock()
+		} else if !c.summaryDefs[h].equal(def) {
+			// quantiles calculated with different objectives can not be merged
+			c.metricSamplesRejected.WithLabelValues("summary_def_mismatch").Inc()
+			return
+		}
+
+		m.Observe(s.value)
+
+	case sampleSet:
+		m, found := c.sets[h]
+		if !found {
+			m = prometheus.NewGauge(
+				prometheus.GaugeOpts{
+					Name:        s.name,
+					Help:        help,
+					ConstLabels: s.labels,
+				},
+			)
+			c.setHLLs[h] = newHyperLogLog(setHLLPrecision)
+			c.setsMu.Lock()
+			c.sets[h] = m
+			c.setsMu.Unlock()
+		}
+
+		// estimation is costly, recalculate only if there is a chance for the change
+		if hll := c.setHLLs[h]; hll.insert(s.member) {
+			m.Set(hll.estimate())
+		}
+
+	default:
+		return
+	}
+
+	_, seriesFound := c.identities[h]
+	if !seriesFound {
+		id := newSeriesIdentity(s)
+		c.identities[h] = id
+		if hash, collided := c.collisionHash(h, id); collided {
+			c.collisions[hash]++
+		}
+	}
+
+	if c.lastUpdateMode != seriesLastUpdateNone {
+		c.updateSeries(h, s)
+	}
+
+	ttl := s.ttl
+	if ttl == 0 {
+		ttl = c.seriesTTL
+	}
+	if ttl > 0 {
+		c.expiries[h] = time.Now().Add(ttl)
+	} else if len(c.expiries) > 0 {
+		delete(c.expiries, h)
+	}
+
+	// first series of the metric defines the family
+	if !famFound {
+		fam = newFamily(s, help)
+		fam.delta = delta
+		c.families[s.name] = fam
+	}
+	if !seriesFound {
+		fam.series++
+	}
+}
+
+// expireSeries removes series with TTL not updated in time.
+// Should be called only from process.
+func (c *collector) expireSeries(now time.Time) {
+	for h, t := range c.expiries {
+		if now.After(t) {
+			c.removeSeries(h)
+			c.metricSeriesExpired.Inc()
+		}
+	}
+}
+
+// removeSeries removes series stored under key h from all storages.
+// Family of the series is kept. Should be called only from process.
+func (c *collector) removeSeries(h string) {
+	c.countersMu.Lock()
+	delete(c.counters, h)
+	c.countersMu.Unlock()
+
+	c.gaugesMu.Lock()
+	delete(c.gauges, h)
+	c.gaugesMu.Unlock()
+
+	c.histogramsMu.Lock()
+	delete(c.histograms, h)
+	c.histogramsMu.Unlock()
+
+	c.nativeHistogramsMu.Lock()
+	delete(c.nativeHistograms, h)
+	c.nativeHistogramsMu.Unlock()
+
+	c.summariesMu.Lock()
+	delete(c.summaries, h)
+	c.summariesMu.Unlock()
+
+	c.setsMu.Lock()
+	delete(c.sets, h)
+	c.setsMu.Unlock()
+
+	c.deltasMu.Lock()
+	delete(c.deltas, h)
+	c.deltasMu.Unlock()
+
+	c.lastUpdatesMu.Lock()
+	delete(c.lastUpdates, h)
+	c.lastUpdatesMu.Unlock()
+
+	// metric without series is forgotten, so it can be created again with different kind or labels
+	if id, found := c.identities[h]; found {
+		if hash, collided := c.collisionHash(h, id); collided {
+			if c.collisions[hash]--; c.collisions[hash] <= 0 {
+				delete(c.collisions, hash)
+			}
+		}
+		if fam, found := c.families[id.name]; found {
+			fam.series--
+			if fam.series <= 0 {
+				delete(c.families, id.name)
+			}
+		}
+	}
+
+	delete(c.gaugeAggs, h)
+	delete(c.summaryDefs, h)
+	delete(c.setHLLs, h)
+	delete(c.identities, h)
+	delete(c.expiries, h)
+}
+
+// seriesKey returns a key under which series for the sample is stored.
+// It's a hash of the sample unless the hash collides with other series.
+func (c *collector) seriesKey(s *sample) string {
+	h := string(c.hasher(s))
+
+	id, found := c.identities[h]
+	if found && id.matches(s) {
+		return h
+	}
+
+	if c.collisions[h] > 0 {
+		if key := h + seriesKeyCollisionSeparator + sampleFullKey(s); c.identities[key] != nil {
+			c.metricHashCollisions.Inc()
+			return key
+		}
+	}
+	if !found {
+		return h
+	}
+
+	c.metricHashCollisions.Inc()
+	return h + seriesKeyCollisionSeparator + sampleFullKey(s)
+}
+
+// collisionHash returns hash of the series stored under key h, if it's stored under extended key due to collision.
+func (c *collector) collisionHash(h string, id *seriesIdentity) (string, bool) {
+	hash := string(c.hasher(id.sample()))
+	return hash, hash != h
+}
+
+// reportConflict accounts sample rejected due to conflict with the family.
+func (c *collector) reportConflict(s *sample, fam *family, reason string) {
+	c.metricConflicts.WithLabelValues(reason).Inc()
+
+	key := s.name + sampleParserSamplePartsSeparator + reason
+
+	c.conflictsMu.Lock()
+	defer c.conflictsMu.Unlock()
+
+	fc, found := c.conflicts[key]
+	if !found {
+		if len(c.conflicts) >= familyConflictsMax {
+			return
+		}
+		fc = &familyConflict{
+			Name:     s.name,
+			Reason:   reason,
+			Expected: fam.describe(reason),
+		}
+		c.conflicts[key] = fc
+	}
+
+	fc.Got = newFamily(s, "").describe(reason)
+	fc.Count++
+	fc.LastSeen = time.Now()
+}
+
+// conflictsHandler lists samples rejected due to conflicts with their families.
+func (c *collector) conflictsHandler(w http.ResponseWriter, r *http.Request) {
+	c.conflictsMu.Lock()
+	out := make([]familyConflict, 0, len(c.conflicts))
+	var sorted familyConflictsByName
+	for _, fc := range c.conflicts {
+		sorted = append(sorted, fc)
+	}
+	sort.Sort(sorted)
+	for _, fc := range sorted {
+		out = append(out, *fc)
+	}
+	c.conflictsMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// histogramBuckets converts histogram definition of the sample to upper bounds of the buckets.
+// Definition is validated so it's safe to pass the result to prometheus client.
+func histogramBuckets(s *sample) ([]float64, error) {
+	if len(s.histogramDef) != 3 {
+		return nil, ErrHistogramDefInvalid
+	}
+	p1, err := strconv.ParseFloat(s.histogramDef[0], 64)
+	if err != nil {
+		return nil, ErrHistogramDefInvalid
+	}
+	p2, err := strconv.ParseFloat(s.histogramDef[1], 64)
+	if err != nil {
+		return nil, ErrHistogramDefInvalid
+	}
+	count, err := strconv.Atoi(s.histogramDef[2])
+	if err != nil || count < 1 {
+		return nil, ErrHistogramDefInvalid
+	}
+
+	switch s.kind {
+	case sampleHistogramLinear:
+		return prometheus.LinearBuckets(p1, p2, count), nil
+	case sampleHistogramExponential:
+		// start must be positive and factor greater than 1
+		if p1 <= 0 || p2 <= 1 {
+			return nil, ErrHistogramDefInvalid
+		}
+		return prometheus.ExponentialBuckets(p1, p2, count), nil
+	}
+
+	return nil, ErrHistogramDefInvalid
+}
+
+// summaryDef is a parsed definition of the summary.
+type summaryDef struct {
+	objectives map[float64]float64
+	maxAge     time.Duration
+}
+
+// equal checks if both definitions have the same max age and objectives.
+func (d summaryDef) equal(o summaryDef) bool {
+	if d.maxAge != o.maxAge || len(d.objectives) != len(o.objectives) {
+		return false
+	}
+	for q, e := range d.objectives {
+		if oe, found := o.objectives[q]; !found || oe != e {
+			return false
+		}
+	}
+	return true
+}
+
+// summaryOpts converts summary definition of the sample to objectives and max age.
+// Definition is validated so it's safe to pass the result to prometheus client.
+func summaryOpts(s *sample) (map[float64]float64, time.Duration, error) {
+	if len(s.summaryDef) < 2 {
+		return nil, 0, ErrSummaryDefInvalid
+	}
+
+	maxAgeSec, err := strconv.ParseFloat(s.summaryDef[0], 64)
+	if err != nil || maxAgeSec <= 0 {
+		return nil, 0, ErrSummaryDefInvalid
+	}
+
+	objectives := make(map[float64]float64, len(s.summaryDef)-1)
+	for _, o := range s.summaryDef[1:] {
+		qe := strings.SplitN(o, sampleParserObjectiveSeparator, 2)
+		if len(qe) != 2 {
+			return nil, 0, ErrSummaryDefInvalid
+		}
+		q, err := strconv.ParseFloat(qe[0], 64)
+		if err != nil || q < 0 || q > 1 {
+			return nil, 0, ErrSummaryDefInvalid
+		}
+		e, err := strconv.ParseFloat(qe[1], 64)
+		if err != nil || e < 0 || e > 1 {
+			return nil, 0, ErrSummaryDefInvalid
+		}
+		objectives[q] = e
+	}
+
+	return objectives, time.Duration(maxAgeSec * float64(time.Second)), nil
+}
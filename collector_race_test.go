@@ -15,9 +15,17 @@ import (
 // Test with:
 //   go test ./ -run Test_Race_Collector_WriteVsProcessVsCollect -race -count 1000 -cpu 1,2,4,8,16
 func Test_Race_Collector_WriteVsProcessVsCollect(t *testing.T) {
-	if testing.Short() {
-		t.Skip("skipping race test")
+	// collectors with different hashers are run in parallel to check against shared state
+	for sym, h := range sampleHashers {
+		h := h
+		t.Run(sym, func(t *testing.T) {
+			t.Parallel()
+			thRaceCollectorWriteVsProcessVsCollect(t, h)
+		})
 	}
+}
+
+func thRaceCollectorWriteVsProcessVsCollect(t *testing.T, h sampleHasherFunc) {
 	samples := []*sample{
 		{
 			name: "name_of_2_metric_total", kind: sampleCounter,
@@ -37,8 +45,8 @@ func Test_Race_Collector_WriteVsProcessVsCollect(t *testing.T) {
 		},
 	}
 
-	defer thInitSampleHasher(hashMD5)()
 	c := newCollector()
+	c.hasher = h
 	c.shutdownTimeout = time.Millisecond * 100
 
 	go c.process()
@@ -80,7 +88,7 @@ inTesting:
 		select {
 		case err := <-errInWrite:
 			t.Fatal(errors.Wrap(err, "error on write"))
-		case <-time.After(time.Millisecond * 10):
+		case <-time.After(time.Second):
 			t.Fatal("timeout on testing")
 		case <-wgDoneCh:
 			break inTesting
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"encoding/json"
+	"net/http/httptest"
 	"runtime"
 	"sort"
 	"testing"
@@ -19,6 +21,8 @@ func Test_Collector_New(t *testing.T) {
 	a.NotNil(t, c.counters)
 	a.NotNil(t, c.gauges)
 	a.NotNil(t, c.histograms)
+	a.NotNil(t, c.summaries)
+	a.NotNil(t, c.sets)
 }
 
 var tfCollectorSamples = []*sample{
@@ -94,12 +98,50 @@ func Test_Collector_Write_ChannelFull(t *testing.T) {
 	}
 }
 
-func thInitSampleHasher(h sampleHasherFunc) func() {
-	sampleHasherOld := sampleHasher
-	sampleHasher = h
-	return func() {
-		sampleHasher = sampleHasherOld
+func Test_Collector_Write_ChannelFull_DropOldest(t *testing.T) {
+	c := &collector{ingressPolicy: ingressQueuePolicyDropOldest}
+	bufLen := 2
+	c.ingressCh = make(chan *sample, bufLen)
+
+	for i, s := range tfCollectorSamples {
+		if i < bufLen {
+			a.Nil(t, c.Write(s))
+		} else {
+			a.Equal(t, ErrIngressQueueFull, c.Write(s))
+		}
 	}
+
+	// the latest samples are kept
+	n := len(tfCollectorSamples)
+	a.Equal(t, tfCollectorSamples[n-2], <-c.ingressCh)
+	a.Equal(t, tfCollectorSamples[n-1], <-c.ingressCh)
+}
+
+func Test_IngressDropped(t *testing.T) {
+	a.Equal(t, 0, ingressDropped(nil))
+	a.Equal(t, 0, ingressDropped(ErrHistogramDefInvalid))
+	a.Equal(t, 1, ingressDropped(ErrIngressQueueFull))
+	a.Equal(t, 3, ingressDropped(ingressSamplesDropped(3)))
+	a.Equal(t, ErrIngressQueueFull.Error(), ingressSamplesDropped(3).Error())
+}
+
+func Test_Collector_Write_ChannelFull_Block(t *testing.T) {
+	c := &collector{ingressPolicy: ingressQueuePolicyBlock, ingressTimeout: 50 * time.Millisecond}
+	c.ingressCh = make(chan *sample, 1)
+	a.Nil(t, c.Write(tfCollectorSamples[0]))
+
+	// timeout elapses
+	tS := time.Now()
+	a.Equal(t, ErrIngressQueueFull, c.Write(tfCollectorSamples[1]))
+	a.True(t, time.Since(tS) >= c.ingressTimeout)
+
+	// space is made while waiting
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		<-c.ingressCh
+	}()
+	a.Nil(t, c.Write(tfCollectorSamples[2]))
+	a.Equal(t, tfCollectorSamples[2], <-c.ingressCh)
 }
 
 func thCollectorProcessPopulate(c *collector, samples []*sample) {
@@ -146,22 +188,9 @@ inProcessing:
 }
 
 func Test_Collector_Process_Success_NewHashes(t *testing.T) {
-	tests := map[string]struct {
-		h sampleHasherFunc
-	}{
-		"md5":  {hashMD5},
-		"prom": {hashProm},
-	}
-
-	sampleHasherOld := sampleHasher
-	defer func() {
-		sampleHasher = sampleHasherOld
-	}()
-
-	for sym, tc := range tests {
-		sampleHasher = tc.h
-
+	for sym, h := range sampleHashers {
 		c := newCollector()
+		c.hasher = h
 		thCollectorProcessPopulate(c, tfCollectorSamples)
 		thCollectorProcessSynchronise(t, c)
 
@@ -177,7 +206,7 @@ func Test_Collector_Process_Success_NewHashes(t *testing.T) {
 
 		var hashesExp []string
 		for _, s := range tfCollectorSamples {
-			hashesExp = append(hashesExp, string(s.hash()))
+			hashesExp = append(hashesExp, string(c.hasher(s)))
 		}
 		sort.Strings(hashesExp)
 
@@ -186,8 +215,8 @@ func Test_Collector_Process_Success_NewHashes(t *testing.T) {
 }
 
 func Test_Collector_Process_Success_Existing(t *testing.T) {
-	defer thInitSampleHasher(hashMD5)()
 	c := newCollector()
+	c.hasher = hashMD5
 	// duplicate to simulate adding existing samples
 	thCollectorProcessPopulate(c, tfCollectorSamples)
 	thCollectorProcessPopulate(c, tfCollectorSamples)
@@ -205,7 +234,7 @@ func Test_Collector_Process_Success_Existing(t *testing.T) {
 
 	var hashesExp []string
 	for _, s := range tfCollectorSamples {
-		hashesExp = append(hashesExp, string(s.hash()))
+		hashesExp = append(hashesExp, string(c.hasher(s)))
 	}
 	sort.Strings(hashesExp)
 
@@ -213,8 +242,8 @@ func Test_Collector_Process_Success_Existing(t *testing.T) {
 }
 
 func Test_Collector_Process_Success_Values(t *testing.T) {
-	defer thInitSampleHasher(hashMD5)()
 	c := newCollector()
+	c.hasher = hashMD5
 	// duplicate to simulate adding existing samples
 	thCollectorProcessPopulate(c, tfCollectorSamples)
 	thCollectorProcessPopulate(c, tfCollectorSamples)
@@ -225,18 +254,51 @@ func Test_Collector_Process_Success_Values(t *testing.T) {
 		var mm dto.Metric
 		switch s.kind {
 		case sampleCounter:
-			m := c.counters[string(s.hash())]
+			m := c.counters[string(c.hasher(s))]
 			m.Write(&mm)
 			// samples were added 3 times
 			a.Equal(t, s.value*3, mm.Counter.GetValue())
 		case sampleGauge:
-			m := c.gauges[string(s.hash())]
+			m := c.gauges[string(c.hasher(s))]
 			m.Write(&mm)
 			a.Equal(t, s.value, mm.Gauge.GetValue())
 		}
 	}
 }
 
+func Test_Collector_Process_Success_SamplingRate(t *testing.T) {
+	sC := sample{
+		name: "name_of_1_metric_total", kind: sampleCounter,
+		labels: map[string]string{},
+		value:  2,
+		rate:   0.1,
+	}
+	sH := sample{
+		name: "name_of_1_metric_seconds", kind: sampleHistogramLinear,
+		labels:       map[string]string{},
+		histogramDef: []string{"1", "1", "2"},
+		value:        1.5,
+		rate:         0.5,
+	}
+
+	c := newCollector()
+	c.hasher = hashMD5
+	c.ingressCh <- &sC
+	c.ingressCh <- &sH
+
+	thCollectorProcessSynchronise(t, c)
+
+	var mC dto.Metric
+	c.counters[string(c.hasher(&sC))].Write(&mC)
+	a.Equal(t, float64(20), mC.Counter.GetValue())
+
+	var mH dto.Metric
+	c.histograms[string(c.hasher(&sH))].Write(&mH)
+	a.Equal(t, uint64(2), mH.Histogram.GetSampleCount())
+	a.Equal(t, float64(3), mH.Histogram.GetSampleSum())
+	a.Equal(t, uint64(2), mH.Histogram.GetBucket()[1].GetCumulativeCount())
+}
+
 func Test_Collector_Process_Success_HistogramLinear(t *testing.T) {
 	s1 := sample{
 		name: "name_of_1_metric_seconds", kind: sampleHistogramLinear,
@@ -248,15 +310,15 @@ func Test_Collector_Process_Success_HistogramLinear(t *testing.T) {
 	s1.value = 10
 	s2.value = 20
 
-	defer thInitSampleHasher(hashMD5)()
 	c := newCollector()
+	c.hasher = hashMD5
 	c.ingressCh <- &s1
 	c.ingressCh <- &s2
 
 	thCollectorProcessSynchronise(t, c)
 
 	var mm dto.Metric
-	m := c.histograms[string(s1.hash())]
+	m := c.histograms[string(c.hasher(&s1))]
 	m.Write(&mm)
 	a.Equal(t, uint64(2), mm.Histogram.GetSampleCount())
 	a.Equal(t, float64(30), mm.Histogram.GetSampleSum())
@@ -270,12 +332,648 @@ func Test_Collector_Process_Success_HistogramLinear(t *testing.T) {
 	a.Equal(t, float64(14), b.GetUpperBound())
 }
 
+func Test_Collector_Process_Success_HistogramExponential(t *testing.T) {
+	s1 := sample{
+		name: "name_of_1_metric_seconds", kind: sampleHistogramExponential,
+		labels:       map[string]string{"labelA": "labelValueA", "label2": "labelValue2"},
+		histogramDef: []string{"0.5", "2", "6"},
+	}
+	s2 := *&s1
+
+	s1.value = 3
+	s2.value = 12
+
+	c := newCollector()
+	c.hasher = hashMD5
+	c.ingressCh <- &s1
+	c.ingressCh <- &s2
+
+	thCollectorProcessSynchronise(t, c)
+
+	var mm dto.Metric
+	m := c.histograms[string(c.hasher(&s1))]
+	m.Write(&mm)
+	a.Equal(t, uint64(2), mm.Histogram.GetSampleCount())
+	a.Equal(t, float64(15), mm.Histogram.GetSampleSum())
+	if !a.Len(t, mm.Histogram.GetBucket(), 6) {
+		t.FailNow()
+	}
+
+	// inspect one of the buckets
+	b := mm.Histogram.GetBucket()[3]
+	a.Equal(t, uint64(1), b.GetCumulativeCount())
+	a.Equal(t, float64(4), b.GetUpperBound())
+}
+
+func Test_Collector_Process_Success_HistogramAggregate(t *testing.T) {
+	s1 := sample{
+		name: "name_of_1_metric_seconds", kind: sampleHistogramLinear,
+		labels:       map[string]string{"labelA": "labelValueA"},
+		histogramDef: []string{"8.0", "2.0", "3"},
+		value:        9,
+	}
+	s2 := s1
+	s2.aggregate = &histogramAggregate{counts: []uint64{1, 2, 0}, sum: 50, count: 5}
+
+	c := newCollector()
+	c.hasher = hashMD5
+	c.ingressCh <- &s1
+	c.ingressCh <- &s2
+
+	thCollectorProcessSynchronise(t, c)
+
+	var mm dto.Metric
+	c.histograms[string(c.hasher(&s1))].Write(&mm)
+	a.Equal(t, uint64(6), mm.Histogram.GetSampleCount())
+	a.Equal(t, float64(59), mm.Histogram.GetSampleSum())
+	if !a.Len(t, mm.Histogram.GetBucket(), 3) {
+		t.FailNow()
+	}
+	a.Equal(t, uint64(1), mm.Histogram.GetBucket()[0].GetCumulativeCount())
+	a.Equal(t, uint64(4), mm.Histogram.GetBucket()[1].GetCumulativeCount())
+	a.Equal(t, uint64(4), mm.Histogram.GetBucket()[2].GetCumulativeCount())
+}
+
+func Test_Collector_Process_Failure_HistogramAggregateLayoutMismatch(t *testing.T) {
+	s1 := sample{
+		name: "name_of_1_metric_seconds", kind: sampleHistogramLinear,
+		labels:       map[string]string{},
+		histogramDef: []string{"8.0", "2.0", "3"},
+		value:        9,
+	}
+	s2 := s1
+	s2.histogramDef = []string{"8.0", "4.0", "3"}
+	s2.aggregate = &histogramAggregate{counts: []uint64{1, 2, 0}, sum: 50, count: 5}
+
+	c := newCollector()
+	c.hasher = hashMD5
+	c.ingressCh <- &s1
+	c.ingressCh <- &s2
+
+	thCollectorProcessSynchronise(t, c)
+
+	var mm dto.Metric
+	c.histograms[string(c.hasher(&s1))].Write(&mm)
+	a.Equal(t, uint64(1), mm.Histogram.GetSampleCount())
+
+	var mr dto.Metric
+	c.metricConflicts.WithLabelValues(familyConflictHistogramLayout).Write(&mr)
+	a.Equal(t, float64(1), mr.Counter.GetValue())
+}
+
+func Test_Collector_Process_Failure_HistogramDefInvalid(t *testing.T) {
+	s := sample{
+		name: "name_of_1_metric_seconds", kind: sampleHistogramExponential,
+		labels:       map[string]string{},
+		histogramDef: []string{"0", "2", "6"},
+		value:        3,
+	}
+
+	c := newCollector()
+	c.hasher = hashMD5
+	c.ingressCh <- &s
+
+	thCollectorProcessSynchronise(t, c)
+
+	a.Len(t, c.histograms, 0)
+}
+
+func Test_Collector_Process_Success_Summary(t *testing.T) {
+	s1 := sample{
+		name: "name_of_1_metric_seconds", kind: sampleSummary,
+		labels:     map[string]string{"labelA": "labelValueA"},
+		summaryDef: []string{"600", "0.5:0.05", "0.9:0.01"},
+	}
+	s2 := *&s1
+
+	s1.value = 10
+	s2.value = 20
+
+	c := newCollector()
+	c.hasher = hashMD5
+	c.ingressCh <- &s1
+	c.ingressCh <- &s2
+
+	thCollectorProcessSynchronise(t, c)
+
+	var mm dto.Metric
+	m := c.summaries[string(c.hasher(&s1))]
+	m.Write(&mm)
+	a.Equal(t, uint64(2), mm.Summary.GetSampleCount())
+	a.Equal(t, float64(30), mm.Summary.GetSampleSum())
+	if !a.Len(t, mm.Summary.GetQuantile(), 2) {
+		t.FailNow()
+	}
+	a.Equal(t, 0.5, mm.Summary.GetQuantile()[0].GetQuantile())
+	a.Equal(t, 0.9, mm.Summary.GetQuantile()[1].GetQuantile())
+}
+
+func Test_Collector_Process_Failure_SummaryDefMismatch(t *testing.T) {
+	s1 := sample{
+		name: "name_of_1_metric_seconds", kind: sampleSummary,
+		labels:     map[string]string{},
+		summaryDef: []string{"600", "0.5:0.05"},
+		value:      10,
+	}
+	s2 := s1
+	s2.summaryDef = []string{"600", "0.99:0.001"}
+	s2.value = 20
+
+	c := newCollector()
+	c.hasher = hashMD5
+	c.ingressCh <- &s1
+	c.ingressCh <- &s2
+
+	thCollectorProcessSynchronise(t, c)
+
+	// second sample is rejected instead of being merged into the first series
+	var mm dto.Metric
+	c.summaries[string(c.hasher(&s1))].Write(&mm)
+	a.Equal(t, uint64(1), mm.Summary.GetSampleCount())
+
+	var mr dto.Metric
+	c.metricSamplesRejected.WithLabelValues("summary_def_mismatch").Write(&mr)
+	a.Equal(t, float64(1), mr.Counter.GetValue())
+}
+
+func Test_Collector_Process_Success_SummaryDefWrittenDifferently(t *testing.T) {
+	s1 := sample{
+		name: "name_of_1_metric_seconds", kind: sampleSummary,
+		labels:     map[string]string{},
+		summaryDef: []string{"600", "0.5:0.05", "0.9:0.01"},
+		value:      10,
+	}
+	s2 := s1
+	s2.summaryDef = []string{"600.0", "0.9:0.010", "0.50:0.05"}
+	s2.value = 20
+
+	c := newCollector()
+	c.hasher = hashMD5
+	c.ingressCh <- &s1
+	c.ingressCh <- &s2
+
+	thCollectorProcessSynchronise(t, c)
+
+	// same objectives in other order and notation end up in the same series
+	var mm dto.Metric
+	c.summaries[string(c.hasher(&s1))].Write(&mm)
+	a.Equal(t, uint64(2), mm.Summary.GetSampleCount())
+
+	var mr dto.Metric
+	c.metricSamplesRejected.WithLabelValues("summary_def_mismatch").Write(&mr)
+	a.Equal(t, float64(0), mr.Counter.GetValue())
+}
+
+func Test_Collector_Process_Success_Set(t *testing.T) {
+	var samples []*sample
+	for _, member := range []string{"user1", "user2", "user3", "user2", "user1"} {
+		samples = append(samples, &sample{
+			name: "name_of_1_metric_users", kind: sampleSet,
+			labels: map[string]string{"labelA": "labelValueA"},
+			member: member,
+		})
+	}
+
+	c := newCollector()
+	c.hasher = hashMD5
+	c.setResetInterval = 0
+	thCollectorProcessPopulate(c, samples)
+	thCollectorProcessSynchronise(t, c)
+
+	var mm dto.Metric
+	c.sets[string(c.hasher(samples[0]))].Write(&mm)
+	a.InDelta(t, 3, mm.Gauge.GetValue(), 0.01)
+}
+
+func Test_Collector_Process_Success_SetReset(t *testing.T) {
+	s := &sample{
+		name: "name_of_1_metric_users", kind: sampleSet,
+		labels: map[string]string{},
+		member: "user1",
+	}
+
+	c := newCollector()
+	c.hasher = hashMD5
+	c.shutdownTimeout = time.Millisecond * 100
+	c.setResetInterval = time.Millisecond * 20
+	doneCh := make(chan struct{}, 1)
+	c.testHookProcessSampleDone = func() { doneCh <- struct{}{} }
+
+	go c.process()
+	c.Write(s)
+	select {
+	case <-doneCh:
+	case <-time.After(time.Millisecond * 10):
+		t.Fatal("timeout in processing")
+	}
+
+	// wait for reset
+	time.Sleep(time.Millisecond * 50)
+
+	var mm dto.Metric
+	c.setsMu.RLock()
+	c.sets[string(c.hasher(s))].Write(&mm)
+	c.setsMu.RUnlock()
+	a.Equal(t, float64(0), mm.Gauge.GetValue())
+
+	if err := c.stop(); err != nil {
+		t.Fatal("timeout in shutdown")
+	}
+}
+
+func Test_SummaryOpts(t *testing.T) {
+	tests := map[string]struct {
+		def       []string
+		expObj    map[float64]float64
+		expMaxAge time.Duration
+		expErr    error
+	}{
+		"valid": {
+			[]string{"600", "0.5:0.05", "0.99:0.001"},
+			map[float64]float64{0.5: 0.05, 0.99: 0.001}, 10 * time.Minute, nil,
+		},
+		"fractional max age": {
+			[]string{"0.5", "0.5:0.05"},
+			map[float64]float64{0.5: 0.05}, 500 * time.Millisecond, nil,
+		},
+		"no objectives": {
+			[]string{"600"},
+			nil, 0, ErrSummaryDefInvalid,
+		},
+		"zero max age": {
+			[]string{"0", "0.5:0.05"},
+			nil, 0, ErrSummaryDefInvalid,
+		},
+		"quantile out of range": {
+			[]string{"600", "1.5:0.05"},
+			nil, 0, ErrSummaryDefInvalid,
+		},
+		"malformed objective": {
+			[]string{"600", "0.5"},
+			nil, 0, ErrSummaryDefInvalid,
+		},
+	}
+
+	for sym, tc := range tests {
+		obj, maxAge, err := summaryOpts(&sample{kind: sampleSummary, summaryDef: tc.def})
+		a.Equal(t, tc.expErr, err, sym)
+		a.Equal(t, tc.expObj, obj, sym)
+		a.Equal(t, tc.expMaxAge, maxAge, sym)
+	}
+}
+
+func Test_HistogramBuckets(t *testing.T) {
+	tests := map[string]struct {
+		kind   sampleKind
+		def    []string
+		exp    []float64
+		expErr error
+	}{
+		"linear": {
+			sampleHistogramLinear, []string{"1", "2", "3"},
+			[]float64{1, 3, 5}, nil,
+		},
+		"exponential": {
+			sampleHistogramExponential, []string{"1", "10", "3"},
+			[]float64{1, 10, 100}, nil,
+		},
+		"exponential, start not positive": {
+			sampleHistogramExponential, []string{"0", "10", "3"},
+			nil, ErrHistogramDefInvalid,
+		},
+		"exponential, factor too small": {
+			sampleHistogramExponential, []string{"1", "1", "3"},
+			nil, ErrHistogramDefInvalid,
+		},
+		"zero count": {
+			sampleHistogramLinear, []string{"1", "2", "0"},
+			nil, ErrHistogramDefInvalid,
+		},
+		"malformed": {
+			sampleHistogramLinear, []string{"1", "2.2.2", "3"},
+			nil, ErrHistogramDefInvalid,
+		},
+	}
+
+	for sym, tc := range tests {
+		got, err := histogramBuckets(&sample{kind: tc.kind, histogramDef: tc.def})
+		a.Equal(t, tc.expErr, err, sym)
+		a.Equal(t, tc.exp, got, sym)
+	}
+}
+
+func Test_Collector_Process_Success_HashCollision(t *testing.T) {
+	samples := []*sample{
+		{
+			name: "name_of_1_metric_total", kind: sampleCounter,
+			labels: map[string]string{"labelA": "labelValueA"},
+			value:  1,
+		},
+		{
+			name: "name_of_1_metric_total", kind: sampleCounter,
+			labels: map[string]string{"labelA": "labelValueB"},
+			value:  10,
+		},
+		{
+			name: "name_of_1_metric_total", kind: sampleCounter,
+			labels: map[string]string{"labelA": "labelValueA"},
+			value:  100,
+		},
+		{
+			name: "name_of_2_metric_total", kind: sampleCounter,
+			labels: map[string]string{"labelA": "labelValueA"},
+			value:  1000,
+		},
+	}
+
+	// every sample collides
+	c := newCollector()
+	c.hasher = func(*sample) []byte { return []byte{1} }
+	thCollectorProcessPopulate(c, samples)
+	thCollectorProcessSynchronise(t, c)
+
+	if !a.Len(t, c.counters, 3) {
+		t.FailNow()
+	}
+
+	valuesGot := make(map[string]float64)
+	for _, m := range c.counters {
+		var mm dto.Metric
+		m.Write(&mm)
+		valuesGot[m.Desc().String()] = mm.Counter.GetValue()
+	}
+	a.Equal(t, float64(101), valuesGot[prometheus.NewDesc("name_of_1_metric_total", "auto", nil, prometheus.Labels{"labelA": "labelValueA"}).String()])
+	a.Equal(t, float64(10), valuesGot[prometheus.NewDesc("name_of_1_metric_total", "auto", nil, prometheus.Labels{"labelA": "labelValueB"}).String()])
+	a.Equal(t, float64(1000), valuesGot[prometheus.NewDesc("name_of_2_metric_total", "auto", nil, prometheus.Labels{"labelA": "labelValueA"}).String()])
+
+	var mm dto.Metric
+	c.metricHashCollisions.Write(&mm)
+	a.Equal(t, float64(2), mm.Counter.GetValue())
+}
+
+func Test_Collector_Process_Success_HashCollision_Expired(t *testing.T) {
+	sA := &sample{name: "name_of_1_metric_total", kind: sampleCounter, labels: map[string]string{"labelA": "labelValueA"}, value: 1, ttl: time.Minute}
+	sB := &sample{name: "name_of_1_metric_total", kind: sampleCounter, labels: map[string]string{"labelA": "labelValueB"}, value: 10, ttl: time.Hour}
+
+	// every sample collides
+	c := newCollector()
+	c.hasher = func(*sample) []byte { return []byte{1} }
+	c.processSample(sA)
+	c.processSample(sB)
+
+	// series stored under the hash expires, colliding one is still found under extended key
+	c.expireSeries(time.Now().Add(2 * time.Minute))
+	c.processSample(sB)
+
+	if !a.Len(t, c.counters, 1) {
+		t.FailNow()
+	}
+	for _, m := range c.counters {
+		var mm dto.Metric
+		m.Write(&mm)
+		a.Equal(t, float64(20), mm.Counter.GetValue())
+	}
+
+	// new series takes the free hash
+	c.processSample(sA)
+	a.Len(t, c.counters, 2)
+	a.Equal(t, map[string]int{"\x01": 1}, c.collisions)
+
+	// index is cleared with the last colliding series
+	c.expireSeries(time.Now().Add(2 * time.Hour))
+	a.Len(t, c.counters, 0)
+	a.Len(t, c.collisions, 0)
+}
+
+func Test_Collector_Process_Success_HistogramDefInHash(t *testing.T) {
+	s1 := sample{
+		name: "name_of_1_metric_seconds", kind: sampleHistogramLinear,
+		labels:       map[string]string{},
+		histogramDef: []string{"1", "1", "3"},
+		value:        1,
+	}
+	// the same layout written differently
+	s2 := s1
+	s2.histogramDef = []string{"1.0", "1.0", "3"}
+
+	c := newCollector()
+	c.hasher = hashProm
+	a.NotEqual(t, c.hasher(&s1), c.hasher(&s2))
+
+	c.ingressCh <- &s1
+	c.ingressCh <- &s2
+	thCollectorProcessSynchronise(t, c)
+
+	if !a.Len(t, c.histograms, 1) {
+		t.FailNow()
+	}
+	var mm dto.Metric
+	c.histograms[string(c.hasher(&s1))].Write(&mm)
+	a.Equal(t, uint64(2), mm.Histogram.GetSampleCount())
+}
+
+func Test_Collector_Process_Failure_FamilyConflict(t *testing.T) {
+	samples := []*sample{
+		{
+			name: "name_of_1_metric", kind: sampleCounter,
+			labels: map[string]string{"labelA": "labelValueA"},
+			value:  1,
+		},
+		// kind conflict
+		{
+			name: "name_of_1_metric", kind: sampleGauge,
+			labels: map[string]string{"labelA": "labelValueA"},
+			value:  1,
+		},
+		{
+			name: "name_of_2_metric_seconds", kind: sampleHistogramLinear,
+			labels:       map[string]string{},
+			histogramDef: []string{"1", "1", "3"},
+			value:        1,
+		},
+		// same layout written differently
+		{
+			name: "name_of_2_metric_seconds", kind: sampleHistogramLinear,
+			labels:       map[string]string{"labelA": "labelValueA"},
+			histogramDef: []string{"1.0", "1.00", "3"},
+			value:        1,
+		},
+		// layout conflict
+		{
+			name: "name_of_2_metric_seconds", kind: sampleHistogramLinear,
+			labels:       map[string]string{"labelA": "labelValueB"},
+			histogramDef: []string{"1", "2", "3"},
+			value:        1,
+		},
+	}
+
+	c := newCollector()
+	c.hasher = hashMD5
+	thCollectorProcessPopulate(c, samples)
+	thCollectorProcessSynchronise(t, c)
+
+	a.Len(t, c.counters, 1)
+	a.Len(t, c.gauges, 0)
+	a.Len(t, c.histograms, 2)
+
+	for reason, exp := range map[string]float64{
+		familyConflictKind:            1,
+		familyConflictHistogramLayout: 1,
+		// reported, but accepted
+		familyConflictLabelNames: 1,
+	} {
+		var mm dto.Metric
+		c.metricConflicts.WithLabelValues(reason).Write(&mm)
+		a.Equal(t, exp, mm.Counter.GetValue(), reason)
+	}
+
+	rec := httptest.NewRecorder()
+	c.conflictsHandler(rec, httptest.NewRequest("GET", "/debug/conflicts", nil))
+	var got []familyConflict
+	if !a.NoError(t, json.Unmarshal(rec.Body.Bytes(), &got)) {
+		t.FailNow()
+	}
+	if !a.Len(t, got, 3) {
+		t.FailNow()
+	}
+	a.Equal(t, "name_of_1_metric", got[0].Name)
+	a.Equal(t, familyConflictKind, got[0].Reason)
+	a.Equal(t, "c", got[0].Expected)
+	a.Equal(t, "g", got[0].Got)
+	a.Equal(t, uint64(1), got[0].Count)
+	a.Equal(t, familyConflictHistogramLayout, got[1].Reason)
+	a.Equal(t, "1;1;3", got[1].Expected)
+	a.Equal(t, "1;2;3", got[1].Got)
+	a.Equal(t, familyConflictLabelNames, got[2].Reason)
+	a.Equal(t, "", got[2].Expected)
+	a.Equal(t, "labelA", got[2].Got)
+}
+
+func Test_Collector_Process_LabelNamesPolicy(t *testing.T) {
+	samples := []*sample{
+		{
+			name: "name_of_1_metric_total", kind: sampleCounter,
+			labels: map[string]string{"labelA": "labelValueA", "labelB": "labelValueB"},
+			value:  1,
+		},
+		// missing label
+		{
+			name: "name_of_1_metric_total", kind: sampleCounter,
+			labels: map[string]string{"labelA": "labelValueA2"},
+			value:  2,
+		},
+		// unknown label
+		{
+			name: "name_of_1_metric_total", kind: sampleCounter,
+			labels: map[string]string{"labelA": "labelValueA3", "labelC": "labelValueC"},
+			value:  3,
+		},
+	}
+
+	tests := map[labelNamesPolicy]struct {
+		expLabels    []map[string]string
+		expConflicts float64
+	}{
+		labelNamesPolicyAllow: {
+			[]map[string]string{samples[0].labels, samples[1].labels, samples[2].labels},
+			2,
+		},
+		labelNamesPolicyReject: {
+			[]map[string]string{samples[0].labels},
+			2,
+		},
+		labelNamesPolicyFill: {
+			[]map[string]string{samples[0].labels, {"labelA": "labelValueA2", "labelB": "fill"}},
+			1,
+		},
+	}
+
+	for policy, tc := range tests {
+		c := newCollector()
+		c.hasher = hashMD5
+		c.labelNamesPolicy = policy
+		c.labelNamesFillValue = "fill"
+		thCollectorProcessPopulate(c, samples)
+		thCollectorProcessSynchronise(t, c)
+
+		var hashesExp []string
+		for _, l := range tc.expLabels {
+			hashesExp = append(hashesExp, string(c.hasher(&sample{name: "name_of_1_metric_total", kind: sampleCounter, labels: l})))
+		}
+		sort.Strings(hashesExp)
+
+		var hashesGot []string
+		for h := range c.counters {
+			hashesGot = append(hashesGot, h)
+		}
+		sort.Strings(hashesGot)
+
+		a.Equal(t, hashesExp, hashesGot, string(policy))
+
+		var mm dto.Metric
+		c.metricConflicts.WithLabelValues(familyConflictLabelNames).Write(&mm)
+		a.Equal(t, tc.expConflicts, mm.Counter.GetValue(), string(policy))
+	}
+
+	// fixtures are not modified
+	a.Len(t, samples[1].labels, 1)
+}
+
+func Test_Collector_Process_Success_FamilyHelp(t *testing.T) {
+	s1 := &sample{
+		name: "name_of_1_metric_total", kind: sampleCounter,
+		labels: map[string]string{"labelA": "labelValueA"},
+		value:  1,
+	}
+	s2 := &sample{
+		name: "name_of_1_metric_total", kind: sampleCounter,
+		labels: map[string]string{"labelA": "labelValueB"},
+		value:  1,
+	}
+
+	c := newCollector()
+	c.hasher = hashMD5
+	c.ingressCh <- s1
+	thCollectorProcessSynchronise(t, c)
+
+	// help arriving after the first series is created must not make the family inconsistent
+	c.WriteMetadata(&metadata{name: s1.name, kind: metadataHelp, value: "Number of requests."})
+	c.quitCh = make(chan struct{})
+	c.shutdownDownCh = make(chan struct{})
+	c.ingressCh <- s2
+	thCollectorProcessSynchronise(t, c)
+
+	a.Contains(t, c.counters[string(c.hasher(s2))].Desc().String(), `help: "auto"`)
+}
+
+func Test_Collector_WriteMetadata(t *testing.T) {
+	s := sample{
+		name: "name_of_1_metric_total", kind: sampleCounter,
+		labels: map[string]string{},
+		value:  1,
+	}
+
+	c := newCollector()
+	c.hasher = hashMD5
+	a.NoError(t, c.WriteMetadata(&metadata{name: s.name, kind: metadataHelp, value: "Number of requests."}))
+	a.Equal(t, ErrMetadataHelpConflict, c.WriteMetadata(&metadata{name: s.name, kind: metadataHelp, value: "Other."}))
+	c.ingressCh <- &s
+
+	thCollectorProcessSynchronise(t, c)
+
+	a.Contains(t, c.counters[string(c.hasher(&s))].Desc().String(), `help: "Number of requests."`)
+
+	var mm dto.Metric
+	c.metricMetadataConflicts.WithLabelValues(string(metadataHelp)).Write(&mm)
+	a.Equal(t, float64(1), mm.Counter.GetValue())
+}
+
 func Test_Collector_Collect_NoMetric(t *testing.T) {
 	c := newCollector()
 	metricCh := make(chan prometheus.Metric, 2048)
 	c.Collect(metricCh)
 
-	if !a.Len(t, metricCh, 3) {
+	if !a.Len(t, metricCh, 8) {
 		t.FailNow()
 	}
 
@@ -294,7 +992,9 @@ func Test_Collector_Collect_MetricFromSamples(t *testing.T) {
 	c.counters["c2"] = prometheus.NewCounter(prometheus.CounterOpts{Name: "counter_B", Help: "auto"})
 	c.gauges["g1"] = prometheus.NewGauge(prometheus.GaugeOpts{Name: "gauge_A", Help: "auto"})
 	c.gauges["g2"] = prometheus.NewGauge(prometheus.GaugeOpts{Name: "gauge_B", Help: "auto"})
-	c.histograms["hl1"] = prometheus.NewHistogram(prometheus.HistogramOpts{Name: "histLinear_A", Help: "auto"})
+	c.histograms["hl1"] = newHistogram(prometheus.HistogramOpts{Name: "histLinear_A", Help: "auto", Buckets: prometheus.DefBuckets})
+	c.summaries["sm1"] = prometheus.NewSummary(prometheus.SummaryOpts{Name: "summary_A", Help: "auto"})
+	c.sets["s1"] = prometheus.NewGauge(prometheus.GaugeOpts{Name: "set_A", Help: "auto"})
 
 	expDescMap := make(map[string]prometheus.Desc)
 	descHash := func(d *prometheus.Desc) []byte {
@@ -309,9 +1009,16 @@ func Test_Collector_Collect_MetricFromSamples(t *testing.T) {
 	addDesc(expDescMap, c.gauges["g1"])
 	addDesc(expDescMap, c.gauges["g2"])
 	addDesc(expDescMap, c.histograms["hl1"])
+	addDesc(expDescMap, c.summaries["sm1"])
+	addDesc(expDescMap, c.sets["s1"])
 	addDesc(expDescMap, c.metricAppStart)
 	addDesc(expDescMap, c.metricAppDuration)
 	addDesc(expDescMap, c.metricQueueLength)
+	addDesc(expDescMap, c.metricHashCollisions)
+	addDesc(expDescMap, c.metricSeriesExpired)
+	addDesc(expDescMap, c.metricMetadataDropped)
+	addDesc(expDescMap, c.metricWALOverflows)
+	addDesc(expDescMap, c.metricWALSize)
 
 	metricCh := make(chan prometheus.Metric, 2048)
 
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/log"
+	"gopkg.in/yaml.v2"
+)
+
+// ErrConfigInvalid is returned when config is not valid.
+var ErrConfigInvalid = errors.New("config: invalid")
+
+// fileConfig is a config which can be read from the YAML file and reloaded while the app is running.
+// Values missing in the file are taken from ENV config. Rules missing in the file are read from files pointed by ENV config.
+type fileConfig struct {
+	// Listeners are applied only on start, changes require restart
+	Listeners listenersConfig `yaml:"listeners"`
+	Limits    limitsConfig    `yaml:"limits"`
+
+	// SeriesTTL is a default TTL of the series, overridden by TTL of the mapping. Zero keeps series forever.
+	SeriesTTL time.Duration `yaml:"series_ttl"`
+
+	RelabelConfigs []*relabelConfig `yaml:"relabel_configs"`
+	Mappings       []*mapping       `yaml:"mappings"`
+	Filter         *filterConfig    `yaml:"filter"`
+
+	SourceLimits sourceLimitsConfig `yaml:"source_limits"`
+
+	// Tenancy is applied only on start, changes require restart
+	Tenancy tenancyConfig `yaml:"tenancy"`
+
+	// checksum is SHA256 of the config file content, empty if file is not used
+	checksum string
+}
+
+type listenersConfig struct {
+	UDPHost     string `yaml:"udp_host"`
+	UDPPort     int    `yaml:"udp_port"`
+	MetricsHost string `yaml:"metrics_host"`
+	MetricsPort int    `yaml:"metrics_port"`
+}
+
+type limitsConfig struct {
+	// UDPBufferSize is applied only on start, changes require restart
+	UDPBufferSize       int              `yaml:"udp_buffer_size"`
+	TimestampMaxSkew    time.Duration    `yaml:"timestamp_max_skew"`
+	LabelNamesPolicy    labelNamesPolicy `yaml:"label_names_policy"`
+	LabelNamesFillValue string           `yaml:"label_names_fill_value"`
+}
+
+// loadFileConfig reads config file pointed by ENV config, on top of values from ENV config.
+// Returned config is validated and its rules are compiled.
+func loadFileConfig(env *config) (*fileConfig, error) {
+	fc := fileConfig{
+		Listeners: listenersConfig{
+			UDPHost:     env.UDPHost,
+			UDPPort:     env.UDPPort,
+			MetricsHost: env.MetricsHost,
+			MetricsPort: env.MetricsPort,
+		},
+		Limits: limitsConfig{
+			UDPBufferSize:       env.UDPBufferSize,
+			TimestampMaxSkew:    env.TimestampMaxSkew,
+			LabelNamesPolicy:    labelNamesPolicy(env.LabelNamesPolicy),
+			LabelNamesFillValue: env.LabelNamesFillValue,
+		},
+		SeriesTTL: env.SeriesTTL,
+	}
+
+	if env.ConfigFile != "" {
+		b, err := ioutil.ReadFile(env.ConfigFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "config: read")
+		}
+		// unknown keys are rejected, so typo does not silently fall back to the default
+		if err := yaml.UnmarshalStrict(b, &fc); err != nil {
+			return nil, errors.Wrap(err, "config: parse")
+		}
+		fc.checksum = fmt.Sprintf("%x", sha256.Sum256(b))
+	}
+
+	if err := fc.loadRuleFiles(env); err != nil {
+		return nil, err
+	}
+
+	if err := fc.validate(); err != nil {
+		return nil, err
+	}
+
+	return &fc, nil
+}
+
+// loadRuleFiles reads rules not present in the config file from files pointed by ENV config.
+func (fc *fileConfig) loadRuleFiles(env *config) error {
+	open := func(path string, load func(f *os.File) error) error {
+		f, err := os.Open(path)
+		if err != nil {
+			return errors.Wrap(err, "config: open")
+		}
+		defer f.Close()
+		return errors.Wrap(load(f), path)
+	}
+
+	if fc.RelabelConfigs == nil && env.RelabelConfigFile != "" {
+		err := open(env.RelabelConfigFile, func(f *os.File) (err error) {
+			fc.RelabelConfigs, err = loadRelabelConfigs(f)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if fc.Mappings == nil && env.MappingConfigFile != "" {
+		err := open(env.MappingConfigFile, func(f *os.File) error {
+			cfg, err := loadMapperConfig(f)
+			if err == nil {
+				fc.Mappings = cfg.Mappings
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if fc.Filter == nil && env.FilterConfigFile != "" {
+		err := open(env.FilterConfigFile, func(f *os.File) (err error) {
+			fc.Filter, err = loadFilterConfig(f)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if fc.Filter == nil {
+		fc.Filter = &filterConfig{}
+	}
+
+	return nil
+}
+
+// validate checks all values and compiles rules. Rules compiled already are compiled again, it's harmless.
+func (fc *fileConfig) validate() error {
+	for _, port := range []int{fc.Listeners.UDPPort, fc.Listeners.MetricsPort} {
+		if port < 0 || port > 65535 {
+			return errors.Wrapf(ErrConfigInvalid, "port out of range: %d", port)
+		}
+	}
+	if fc.Limits.UDPBufferSize <= 0 {
+		return errors.Wrap(ErrConfigInvalid, "udp_buffer_size has to be positive")
+	}
+	if fc.Limits.TimestampMaxSkew < 0 || fc.SeriesTTL < 0 {
+		return errors.Wrap(ErrConfigInvalid, "negative duration")
+	}
+	switch fc.Limits.LabelNamesPolicy {
+	case labelNamesPolicyAllow, labelNamesPolicyReject, labelNamesPolicyFill:
+	default:
+		return errors.Wrapf(ErrConfigInvalid, "unknown label names policy: %s", fc.Limits.LabelNamesPolicy)
+	}
+
+	if err := fc.Tenancy.validate(fc.Listeners.UDPPort); err != nil {
+		return err
+	}
+
+	if err := compileRelabelConfigs(fc.RelabelConfigs); err != nil {
+		return errors.Wrap(err, "relabel_configs")
+	}
+	if err := compileMappings(fc.Mappings); err != nil {
+		return errors.Wrap(err, "mappings")
+	}
+	if err := fc.Filter.compile(); err != nil {
+		return errors.Wrap(err, "filter")
+	}
+	if err := fc.SourceLimits.compile(); err != nil {
+		return errors.Wrap(err, "source_limits")
+	}
+
+	return nil
+}
+
+// collectorSettings returns part of the config applied to the collector.
+func (fc *fileConfig) collectorSettings() *collectorSettings {
+	return &collectorSettings{
+		timestampMaxSkew:    fc.Limits.TimestampMaxSkew,
+		labelNamesPolicy:    fc.Limits.LabelNamesPolicy,
+		labelNamesFillValue: fc.Limits.LabelNamesFillValue,
+		seriesTTL:           fc.SeriesTTL,
+	}
+}
+
+// reloader applies config to all components of the app, on start and on reload requests.
+type reloader struct {
+	env *config
+
+	// collectors are collectors of all tenants
+	collectors []*collector
+	mapper     *mapper
+	relabeler  *relabeler
+	filter     *filter
+	sources    *sourceLimiter
+
+	// mu serializes reloads and guards active
+	mu     sync.Mutex
+	active *fileConfig
+
+	metricReloadSuccessful prometheus.Gauge
+	metricReloadTime       prometheus.Gauge
+	metricReloads          *prometheus.CounterVec
+	metricInfo             *prometheus.GaugeVec
+}
+
+func newReloader(env *config, collectors []*collector, mp *mapper, rl *relabeler, fl *filter, sl *sourceLimiter) *reloader {
+	return &reloader{
+		env:        env,
+		collectors: collectors,
+		mapper:     mp,
+		relabeler:  rl,
+		filter:     fl,
+		sources:    sl,
+		metricReloadSuccessful: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "app_config_last_reload_successful",
+				Help: "Whether the last config reload attempt was successful.",
+			},
+		),
+		metricReloadTime: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "app_config_last_reload_success_timestamp_seconds",
+				Help: "Unix timestamp of the last successful config reload.",
+			},
+		),
+		metricReloads: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "app_config_reloads_total",
+				Help: "Number of config reload attempts.",
+			},
+			[]string{"result"},
+		),
+		metricInfo: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "app_config_info",
+				Help: "Checksum (SHA256) of the active config file.",
+			},
+			[]string{"checksum"},
+		),
+	}
+}
+
+// init applies config before the collector is started.
+func (r *reloader) init(fc *fileConfig) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, c := range r.collectors {
+		c.applySettings(fc.collectorSettings())
+	}
+	r.applyRules(fc)
+	r.activate(fc)
+}
+
+// reload reads config again and applies it to the running app. Invalid config is not applied at all.
+// Config is fully validated before it's applied, applying can not fail, so config is never applied partially.
+// Listeners, buffer size and tenancy can not be changed without restart, changes of them are only logged.
+func (r *reloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	fc, err := loadFileConfig(r.env)
+	if err != nil {
+		r.metricReloadSuccessful.Set(0)
+		r.metricReloads.WithLabelValues("failure").Inc()
+		return err
+	}
+
+	if fc.Listeners != r.active.Listeners || fc.Limits.UDPBufferSize != r.active.Limits.UDPBufferSize {
+		log.Warnf("Config reload: listeners and udp_buffer_size require restart, change ignored")
+		fc.Listeners = r.active.Listeners
+		fc.Limits.UDPBufferSize = r.active.Limits.UDPBufferSize
+	}
+	if !reflect.DeepEqual(fc.Tenancy, r.active.Tenancy) {
+		log.Warnf("Config reload: tenancy requires restart, change ignored")
+		fc.Tenancy = r.active.Tenancy
+	}
+
+	for _, c := range r.collectors {
+		c.reconfigure(fc.collectorSettings())
+	}
+	r.applyRules(fc)
+	r.activate(fc)
+	r.metricReloads.WithLabelValues("success").Inc()
+
+	return nil
+}
+
+func (r *reloader) applyRules(fc *fileConfig) {
+	r.mapper.setMappings(fc.Mappings)
+	r.relabeler.setRules(fc.RelabelConfigs)
+	r.filter.setConfig(fc.Filter)
+	r.sources.setConfig(&fc.SourceLimits)
+}
+
+func (r *reloader) activate(fc *fileConfig) {
+	r.active = fc
+	r.metricReloadSuccessful.Set(1)
+	r.metricReloadTime.Set(float64(time.Now().UnixNano()) / 1e9)
+	r.metricInfo.Reset()
+	if fc.checksum != "" {
+		r.metricInfo.WithLabelValues(fc.checksum).Set(1)
+	}
+}
+
+// reloadHandler reloads config on POST request.
+func (r *reloader) reloadHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" && req.Method != "PUT" {
+		http.Error(w, "only POST or PUT requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.reload(); err != nil {
+		log.Errorf("Config reload failed: %s", err)
+		http.Error(w, fmt.Sprintf("failed to reload config: %s", err), http.StatusInternalServerError)
+		return
+	}
+	log.Infof("Config reloaded")
+}
+
+// Describe implements prometheus.Collector.
+func (r *reloader) Describe(ch chan<- *prometheus.Desc) {
+	r.metricReloadSuccessful.Describe(ch)
+	r.metricReloadTime.Describe(ch)
+	r.metricReloads.Describe(ch)
+	r.metricInfo.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (r *reloader) Collect(ch chan<- prometheus.Metric) {
+	r.metricReloadSuccessful.Collect(ch)
+	r.metricReloadTime.Collect(ch)
+	r.metricReloads.Collect(ch)
+	r.metricInfo.Collect(ch)
+}
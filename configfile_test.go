@@ -0,0 +1,273 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+
+	a "github.com/stretchr/testify/assert"
+)
+
+func tfEnvConfig() *config {
+	return &config{
+		UDPHost:             "0.0.0.0",
+		UDPPort:             8080,
+		UDPBufferSize:       4096,
+		MetricsHost:         "0.0.0.0",
+		MetricsPort:         9090,
+		LabelNamesPolicy:    "allow",
+		LabelNamesFillValue: "none",
+		TimestampMaxSkew:    time.Minute,
+	}
+}
+
+func thConfigFile(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func Test_LoadFileConfig_EnvOnly(t *testing.T) {
+	fc, err := loadFileConfig(tfEnvConfig())
+	if !a.NoError(t, err) {
+		t.FailNow()
+	}
+
+	a.Equal(t, listenersConfig{UDPHost: "0.0.0.0", UDPPort: 8080, MetricsHost: "0.0.0.0", MetricsPort: 9090}, fc.Listeners)
+	a.Equal(t, limitsConfig{UDPBufferSize: 4096, TimestampMaxSkew: time.Minute, LabelNamesPolicy: labelNamesPolicyAllow, LabelNamesFillValue: "none"}, fc.Limits)
+	a.Empty(t, fc.checksum)
+	a.NotNil(t, fc.Filter)
+}
+
+func Test_LoadFileConfig_File(t *testing.T) {
+	dir, cleanup := thSnapshotDir(t)
+	defer cleanup()
+
+	env := tfEnvConfig()
+	env.RelabelConfigFile = thConfigFile(t, dir, "relabel.yml", `
+- action: labeldrop
+  regex: phpVersion`)
+	env.FilterConfigFile = thConfigFile(t, dir, "filter.yml", `
+deny:
+- metric: debug_.*`)
+	env.ConfigFile = thConfigFile(t, dir, "config.yml", `
+listeners:
+  udp_port: 8125
+limits:
+  timestamp_max_skew: 5m
+  label_names_policy: fill
+series_ttl: 1h
+mappings:
+- match: api.*
+  name: api_requests_total
+  labels:
+    service: $1
+filter:
+  allow:
+  - metric: api_.*
+`)
+
+	fc, err := loadFileConfig(env)
+	if !a.NoError(t, err) {
+		t.FailNow()
+	}
+
+	a.Equal(t, listenersConfig{UDPHost: "0.0.0.0", UDPPort: 8125, MetricsHost: "0.0.0.0", MetricsPort: 9090}, fc.Listeners)
+	a.Equal(t, limitsConfig{UDPBufferSize: 4096, TimestampMaxSkew: 5 * time.Minute, LabelNamesPolicy: labelNamesPolicyFill, LabelNamesFillValue: "none"}, fc.Limits)
+	a.Equal(t, time.Hour, fc.SeriesTTL)
+	a.Len(t, fc.checksum, 64)
+
+	// rules from the file are compiled and ready for use
+	if a.Len(t, fc.Mappings, 1) {
+		a.NotNil(t, fc.Mappings[0].regex)
+	}
+	if a.Len(t, fc.Filter.Allow, 1) {
+		a.Equal(t, "allow_0", fc.Filter.Allow[0].ID)
+	}
+	a.Len(t, fc.Filter.Deny, 0, "filter from the config file takes precedence")
+	// rules missing in the config file are read from the rules file
+	a.Len(t, fc.RelabelConfigs, 1)
+}
+
+func Test_LoadFileConfig_Invalid(t *testing.T) {
+	dir, cleanup := thSnapshotDir(t)
+	defer cleanup()
+
+	for _, content := range []string{
+		`listeners: {udp_port: 70000}`,
+		`limits: {udp_buffer_size: 0}`,
+		`limits: {timestamp_max_skew: -1s}`,
+		`limits: {label_names_policy: unknown}`,
+		`series_ttl: -1m`,
+		`relabel_configs: [{action: unknown}]`,
+		`mappings: [{match: "a.*"}]`,
+		`filter: {deny: [{}]}`,
+		`not a map`,
+		// unknown keys are rejected
+		`series_tll: 1m`,
+		`limits: {label_name_policy: reject}`,
+	} {
+		env := tfEnvConfig()
+		env.ConfigFile = thConfigFile(t, dir, "config.yml", content)
+		_, err := loadFileConfig(env)
+		a.Error(t, err, content)
+	}
+
+	env := tfEnvConfig()
+	env.ConfigFile = filepath.Join(dir, "missing.yml")
+	_, err := loadFileConfig(env)
+	a.Error(t, err)
+}
+
+func Test_Reloader_Reload(t *testing.T) {
+	dir, cleanup := thSnapshotDir(t)
+	defer cleanup()
+
+	env := tfEnvConfig()
+	env.ConfigFile = thConfigFile(t, dir, "config.yml", `
+filter:
+  deny:
+  - metric: debug_.*
+`)
+
+	c := newCollector()
+	mp := newMapper(&mapperConfig{}, c.WriteMetadata)
+	rl := newRelabeler(nil)
+	fl := newFilter(&filterConfig{})
+	sl := newSourceLimiter(&sourceLimitsConfig{})
+	r := newReloader(env, []*collector{c}, mp, rl, fl, sl)
+
+	fc, err := loadFileConfig(env)
+	if !a.NoError(t, err) {
+		t.FailNow()
+	}
+	r.init(fc)
+	c.start()
+	defer c.stop()
+
+	s := &sample{name: "debug_requests_total", kind: sampleCounter, labels: map[string]string{}}
+	a.False(t, fl.accept(s))
+
+	// valid config is applied
+	thConfigFile(t, dir, "config.yml", `
+listeners:
+  udp_port: 8125
+limits:
+  label_names_policy: reject
+series_ttl: 1h
+filter:
+  deny:
+  - metric: trace_.*
+source_limits:
+  default:
+    packets_per_second: 1
+`)
+	a.NoError(t, r.reload())
+	a.True(t, fl.accept(s))
+	a.True(t, sl.allowPacket(net.ParseIP("10.0.0.1")))
+	a.False(t, sl.allowPacket(net.ParseIP("10.0.0.1")))
+	a.Equal(t, 8080, r.active.Listeners.UDPPort, "listener change requires restart")
+	a.Equal(t, labelNamesPolicyReject, r.active.Limits.LabelNamesPolicy)
+
+	// settings are applied by process before reload returns
+	a.Equal(t, labelNamesPolicyReject, c.labelNamesPolicy)
+	a.Equal(t, time.Hour, c.seriesTTL)
+
+	var mm dto.Metric
+	r.metricReloadSuccessful.Write(&mm)
+	a.Equal(t, float64(1), mm.Gauge.GetValue())
+	r.metricInfo.WithLabelValues(r.active.checksum).Write(&mm)
+	a.Equal(t, float64(1), mm.Gauge.GetValue())
+
+	// invalid config is not applied at all
+	active := r.active
+	thConfigFile(t, dir, "config.yml", `
+limits:
+  label_names_policy: fill
+filter:
+  deny:
+  - metric: "("
+`)
+	a.Error(t, r.reload())
+	a.True(t, active == r.active)
+	a.True(t, fl.accept(s))
+
+	r.metricReloadSuccessful.Write(&mm)
+	a.Equal(t, float64(0), mm.Gauge.GetValue())
+	r.metricReloads.WithLabelValues("failure").Write(&mm)
+	a.Equal(t, float64(1), mm.Counter.GetValue())
+	r.metricReloads.WithLabelValues("success").Write(&mm)
+	a.Equal(t, float64(1), mm.Counter.GetValue())
+}
+
+func Test_Reloader_Reload_StoppedCollector(t *testing.T) {
+	dir, cleanup := thSnapshotDir(t)
+	defer cleanup()
+
+	env := tfEnvConfig()
+	env.ConfigFile = thConfigFile(t, dir, "config.yml", `series_ttl: 1m`)
+
+	cA, cB := newCollector(), newCollector()
+	mp := newMapper(&mapperConfig{}, cA.WriteMetadata)
+	fl := newFilter(&filterConfig{})
+	r := newReloader(env, []*collector{cA, cB}, mp, newRelabeler(nil), fl, newSourceLimiter(&sourceLimitsConfig{}))
+
+	fc, err := loadFileConfig(env)
+	if !a.NoError(t, err) {
+		t.FailNow()
+	}
+	r.init(fc)
+	cA.start()
+	cB.start()
+	defer cB.stop()
+	if !a.NoError(t, cA.stop()) {
+		t.FailNow()
+	}
+
+	// config is applied to all running collectors and rules, stopped one is skipped
+	thConfigFile(t, dir, "config.yml", `
+series_ttl: 1h
+filter:
+  deny:
+  - metric: debug_.*
+`)
+	a.NoError(t, r.reload())
+	a.Equal(t, time.Hour, cB.seriesTTL)
+	a.False(t, fl.accept(&sample{name: "debug_requests_total", kind: sampleCounter, labels: map[string]string{}}))
+}
+
+func Test_Reloader_ReloadHandler(t *testing.T) {
+	dir, cleanup := thSnapshotDir(t)
+	defer cleanup()
+
+	env := tfEnvConfig()
+	env.ConfigFile = thConfigFile(t, dir, "config.yml", `series_ttl: 1h`)
+
+	c := newCollector()
+	r := newReloader(env, []*collector{c}, newMapper(&mapperConfig{}, nil), newRelabeler(nil), newFilter(&filterConfig{}), newSourceLimiter(&sourceLimitsConfig{}))
+	fc, _ := loadFileConfig(env)
+	r.init(fc)
+	c.start()
+	defer c.stop()
+
+	w := httptest.NewRecorder()
+	r.reloadHandler(w, httptest.NewRequest("GET", "/-/reload", nil))
+	a.Equal(t, http.StatusMethodNotAllowed, w.Code)
+
+	w = httptest.NewRecorder()
+	r.reloadHandler(w, httptest.NewRequest("POST", "/-/reload", nil))
+	a.Equal(t, http.StatusOK, w.Code)
+
+	thConfigFile(t, dir, "config.yml", `series_ttl: -1h`)
+	w = httptest.NewRecorder()
+	r.reloadHandler(w, httptest.NewRequest("POST", "/-/reload", nil))
+	a.Equal(t, http.StatusInternalServerError, w.Code)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// deltaMetric is a counter or a gauge exposing values for the interval between resets.
+// Counter reports sum of the samples and gauge reports the max of them.
+// Both are exposed as gauges, as values go down on every reset.
+//
+// Reset is done in two steps, so interval is not lost by a failed scrape. Collection marks the interval as pending
+// and samples arriving later are accounted also in the next interval. The next interval replaces the current one
+// only when the scrape succeeds.
+type deltaMetric struct {
+	desc *prometheus.Desc
+	// sum is set for counters, gauges keep the max
+	sum bool
+
+	// mu protects scraping from interfering with processing
+	mu      sync.Mutex
+	current deltaInterval
+	// next holds samples since the collection of the pending interval
+	next deltaInterval
+	// pending is set between collection resetting the metric and the end of its scrape
+	pending bool
+}
+
+// deltaInterval is a value of the delta metric in single interval.
+type deltaInterval struct {
+	value float64
+	// observed is false if there were no samples in the interval
+	observed bool
+}
+
+func newDeltaMetric(name, help string, labels map[string]string, sum bool) *deltaMetric {
+	return &deltaMetric{
+		desc: prometheus.NewDesc(name, help, nil, labels),
+		sum:  sum,
+	}
+}
+
+// processDelta accounts counter or gauge sample in delta series stored under key h.
+// Should be called only from process.
+func (c *collector) processDelta(h string, s *sample, help string) {
+	sum, v := false, s.value
+	if s.kind == sampleCounter {
+		sum, v = true, s.value*s.weight()
+	}
+
+	m, found := c.deltas[h]
+	if !found {
+		m = newDeltaMetric(s.name, help, s.labels, sum)
+		c.deltasMu.Lock()
+		c.deltas[h] = m
+		c.deltasMu.Unlock()
+	}
+
+	m.update(v)
+}
+
+// update accounts value of the sample in the current interval, and in the next one if collection is pending.
+func (m *deltaMetric) update(v float64) {
+	m.mu.Lock()
+	m.current.update(v, m.sum)
+	if m.pending {
+		m.next.update(v, m.sum)
+	}
+	m.mu.Unlock()
+}
+
+func (i *deltaInterval) update(v float64, sum bool) {
+	switch {
+	case sum:
+		i.value += v
+	case !i.observed || v > i.value:
+		i.value = v
+	}
+	i.observed = true
+}
+
+// collect sends current value of the metric. With reset the new interval is started and it's pending until finish.
+// Gauges without samples in the interval are not exposed.
+func (m *deltaMetric) collect(ch chan<- prometheus.Metric, reset bool) {
+	m.mu.Lock()
+	cur := m.current
+	if reset {
+		m.next = deltaInterval{}
+		m.pending = true
+	}
+	m.mu.Unlock()
+
+	if !cur.observed && !m.sum {
+		return
+	}
+
+	if cm, err := prometheus.NewConstMetric(m.desc, prometheus.GaugeValue, cur.value); err == nil {
+		ch <- cm
+	}
+}
+
+// finish ends the pending interval. After successful scrape the next interval becomes the current one,
+// otherwise the current one is kept, so samples are not lost.
+func (m *deltaMetric) finish(success bool) {
+	m.mu.Lock()
+	if m.pending && success {
+		m.current = m.next
+	}
+	m.next = deltaInterval{}
+	m.pending = false
+	m.mu.Unlock()
+}
+
+// finishDeltas ends the pending interval of all delta metrics.
+func (c *collector) finishDeltas(success bool) {
+	c.deltasMu.RLock()
+	for _, m := range c.deltas {
+		m.finish(success)
+	}
+	c.deltasMu.RUnlock()
+}
+
+// scrapeResponseWriter records whether the response was written successfully.
+type scrapeResponseWriter struct {
+	http.ResponseWriter
+	status int
+	failed bool
+}
+
+func (w *scrapeResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *scrapeResponseWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	if err != nil {
+		w.failed = true
+	}
+	return n, err
+}
+
+// scrapeHandler wraps metrics handler so all scrapes are serialized.
+// Delta metrics are reset only by the scrapes of the handler created with reset set to true,
+// and only if the response is written without error.
+func (c *collector) scrapeHandler(h http.Handler, reset bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.scrapeMu.Lock()
+		defer c.scrapeMu.Unlock()
+
+		if !reset {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		atomic.StoreInt32(&c.resetOnCollect, 1)
+		sw := &scrapeResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(sw, r)
+		atomic.StoreInt32(&c.resetOnCollect, 0)
+
+		c.finishDeltas(sw.status == http.StatusOK && !sw.failed)
+	})
+}
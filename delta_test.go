@@ -0,0 +1,155 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	a "github.com/stretchr/testify/assert"
+)
+
+var tfDeltaSamples = []*sample{
+	{name: "delta_requests_total", kind: sampleCounter, labels: map[string]string{}, value: 2},
+	{name: "delta_requests_total", kind: sampleCounter, labels: map[string]string{}, value: 3, rate: 0.5},
+	{name: "delta_latency", kind: sampleGauge, labels: map[string]string{}, value: 7},
+	{name: "delta_latency", kind: sampleGauge, labels: map[string]string{}, value: 3},
+	{name: "regular_requests_total", kind: sampleCounter, labels: map[string]string{}, value: 1},
+}
+
+// thDeltaScrape collects metrics through scrape handler and returns values keyed by metric name.
+func thDeltaScrape(t *testing.T, c *collector, reset bool) map[string]float64 {
+	return thDeltaScrapeStatus(t, c, reset, http.StatusOK)
+}
+
+// thDeltaScrapeStatus collects metrics through scrape handler responding with given status.
+func thDeltaScrapeStatus(t *testing.T, c *collector, reset bool, status int) map[string]float64 {
+	values := make(map[string]float64)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ch := make(chan prometheus.Metric, 2048)
+		c.Collect(ch)
+		close(ch)
+		for m := range ch {
+			var mm dto.Metric
+			if err := m.Write(&mm); err != nil {
+				t.Fatal(err)
+			}
+			switch {
+			case mm.Counter != nil:
+				values[m.Desc().String()] = mm.Counter.GetValue()
+			case mm.Gauge != nil:
+				values[m.Desc().String()] = mm.Gauge.GetValue()
+			}
+		}
+		w.WriteHeader(status)
+	})
+
+	c.scrapeHandler(h, reset).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics", nil))
+
+	byName := make(map[string]float64)
+	for _, name := range []string{"delta_requests_total", "delta_latency", "regular_requests_total"} {
+		for d, v := range values {
+			if strings.Contains(d, `fqName: "`+name+`"`) {
+				byName[name] = v
+			}
+		}
+	}
+	return byName
+}
+
+func Test_Collector_Process_Delta(t *testing.T) {
+	c := newCollector()
+	c.hasher = hashMD5
+	c.deltaMetrics = regexp.MustCompile("^delta_")
+	thCollectorProcessPopulate(c, tfDeltaSamples)
+
+	thCollectorProcessSynchronise(t, c)
+
+	a.Len(t, c.deltas, 2)
+	a.Len(t, c.counters, 1)
+	a.Len(t, c.gauges, 0)
+	a.True(t, c.families["delta_requests_total"].delta)
+	a.False(t, c.families["regular_requests_total"].delta)
+}
+
+func Test_Collector_Collect_Delta(t *testing.T) {
+	c := newCollector()
+	c.hasher = hashMD5
+	c.deltaMetrics = regexp.MustCompile("^delta_")
+	thCollectorProcessPopulate(c, tfDeltaSamples)
+
+	thCollectorProcessSynchronise(t, c)
+
+	exp := map[string]float64{"delta_requests_total": 8, "delta_latency": 7, "regular_requests_total": 1}
+
+	// regular scrape never resets
+	a.Equal(t, exp, thDeltaScrape(t, c, false))
+	a.Equal(t, exp, thDeltaScrape(t, c, false))
+
+	// designated scrape reports the interval and starts the new one
+	a.Equal(t, exp, thDeltaScrape(t, c, true))
+	a.Equal(t, map[string]float64{"delta_requests_total": 0, "regular_requests_total": 1}, thDeltaScrape(t, c, true))
+	a.Equal(t, map[string]float64{"delta_requests_total": 0, "regular_requests_total": 1}, thDeltaScrape(t, c, false))
+}
+
+func Test_Collector_Collect_Delta_FailedScrape(t *testing.T) {
+	c := newCollector()
+	c.hasher = hashMD5
+	c.deltaMetrics = regexp.MustCompile("^delta_")
+	thCollectorProcessPopulate(c, tfDeltaSamples)
+
+	thCollectorProcessSynchronise(t, c)
+
+	exp := map[string]float64{"delta_requests_total": 8, "delta_latency": 7, "regular_requests_total": 1}
+
+	// interval is kept until the scrape succeeds
+	a.Equal(t, exp, thDeltaScrapeStatus(t, c, true, http.StatusInternalServerError))
+	a.Equal(t, exp, thDeltaScrape(t, c, true))
+	a.Equal(t, map[string]float64{"delta_requests_total": 0, "regular_requests_total": 1}, thDeltaScrape(t, c, true))
+}
+
+func Test_DeltaMetric_Pending(t *testing.T) {
+	m := newDeltaMetric("delta_requests_total", "auto", nil, true)
+	m.update(2)
+
+	ch := make(chan prometheus.Metric, 1)
+	m.collect(ch, true)
+	var mm dto.Metric
+	(<-ch).Write(&mm)
+	a.Equal(t, float64(2), mm.Gauge.GetValue(), "exposed as gauge")
+
+	// sample received during the scrape belongs to both intervals
+	m.update(3)
+	m.finish(false)
+	a.Equal(t, deltaInterval{value: 5, observed: true}, m.current)
+
+	m.collect(ch, true)
+	<-ch
+	m.update(4)
+	m.finish(true)
+	a.Equal(t, deltaInterval{value: 4, observed: true}, m.current)
+}
+
+func Test_DeltaMetric_Gauge_Max(t *testing.T) {
+	m := newDeltaMetric("delta_gauge", "auto", nil, false)
+	m.update(-5)
+	m.update(-7)
+
+	ch := make(chan prometheus.Metric, 1)
+	m.collect(ch, true)
+	if !a.Len(t, ch, 1) {
+		t.FailNow()
+	}
+	var mm dto.Metric
+	(<-ch).Write(&mm)
+	a.Equal(t, float64(-5), mm.Gauge.GetValue())
+
+	// gauge without samples in the interval is not exposed
+	m.finish(true)
+	m.collect(ch, true)
+	a.Len(t, ch, 0)
+}
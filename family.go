@@ -0,0 +1,202 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// familyConflictsMax limits number of distinct conflicts kept for inspection.
+	// Conflicts above the limit are only counted.
+	familyConflictsMax = 1000
+
+	familyConflictKind            = "kind"
+	familyConflictHistogramLayout = "histogram_layout"
+	familyConflictLabelNames      = "label_names"
+)
+
+// labelNamesPolicy defines how samples with label names different than the rest of the family are handled.
+type labelNamesPolicy string
+
+const (
+	// labelNamesPolicyAllow accepts such samples. Conflict is only reported.
+	labelNamesPolicyAllow labelNamesPolicy = "allow"
+
+	// labelNamesPolicyReject rejects such samples.
+	labelNamesPolicyReject labelNamesPolicy = "reject"
+
+	// labelNamesPolicyFill adds missing labels with default value.
+	// Samples with labels unknown to the family are rejected, as existing series can not be changed.
+	labelNamesPolicyFill labelNamesPolicy = "fill"
+)
+
+// family describes all series sharing the metric name.
+// Prometheus requires all of them to be of the same type and to have the same help.
+type family struct {
+	kind sampleKind
+
+	// labelNames are sorted names of the labels
+	labelNames []string
+
+	// histogramDef and buckets (or native for native histograms) are set only for histogram kinds
+	histogramDef []string
+	buckets      []float64
+	native       *nativeHistogramDef
+
+	help string
+
+	// delta is set if series of the family are exposed in delta mode
+	delta bool
+
+	// series is a number of the series of the family, family is removed with its last series
+	series int
+}
+
+// newFamily creates family based on the first sample of the metric.
+func newFamily(s *sample, help string) *family {
+	f := family{
+		kind:       s.kind,
+		labelNames: sampleLabelNames(s),
+		help:       help,
+	}
+
+	if s.kind == sampleHistogramLinear || s.kind == sampleHistogramExponential {
+		f.histogramDef = s.histogramDef
+		f.buckets, _ = histogramBuckets(s)
+	}
+	if s.kind == sampleHistogramNative {
+		f.histogramDef = s.histogramDef
+		if def, err := nativeHistogramDefOf(s); err == nil {
+			f.native = &def
+		}
+	}
+
+	return &f
+}
+
+// conflict checks if sample is consistent with the family.
+// Returns reason of the conflict or empty string if there is none.
+// Reasons are checked in order of severity, label names are checked last.
+func (f *family) conflict(s *sample) string {
+	if s.kind != f.kind {
+		return familyConflictKind
+	}
+
+	if f.buckets != nil && !stringsEqual(s.histogramDef, f.histogramDef) {
+		// definition written differently can still describe the same layout
+		buckets, err := histogramBuckets(s)
+		if err != nil || !bucketsEqual(buckets, f.buckets) {
+			return familyConflictHistogramLayout
+		}
+	}
+	if f.native != nil && !stringsEqual(s.histogramDef, f.histogramDef) {
+		def, err := nativeHistogramDefOf(s)
+		if err != nil || def != *f.native {
+			return familyConflictHistogramLayout
+		}
+	}
+
+	// same number of names and all known ones present means the same set
+	if len(s.labels) != len(f.labelNames) {
+		return familyConflictLabelNames
+	}
+	for _, n := range f.labelNames {
+		if _, found := s.labels[n]; !found {
+			return familyConflictLabelNames
+		}
+	}
+
+	return ""
+}
+
+// fill returns copy of the sample with labels missing in comparison to the family set to value v.
+// Returns false if sample has labels unknown to the family.
+func (f *family) fill(s *sample, v string) (*sample, bool) {
+	for n := range s.labels {
+		if i := sort.SearchStrings(f.labelNames, n); i == len(f.labelNames) || f.labelNames[i] != n {
+			return nil, false
+		}
+	}
+
+	labels := make(map[string]string, len(f.labelNames))
+	for _, n := range f.labelNames {
+		labels[n] = v
+	}
+	for n, lv := range s.labels {
+		labels[n] = lv
+	}
+
+	filled := *s
+	filled.labels = labels
+	return &filled, true
+}
+
+// describe returns the part of the family (or sample) relevant for the conflict reason.
+func (f *family) describe(reason string) string {
+	switch reason {
+	case familyConflictKind:
+		return string(f.kind)
+	case familyConflictLabelNames:
+		return strings.Join(f.labelNames, sampleParserLabelsSeparator)
+	case familyConflictHistogramLayout:
+		return strings.Join(f.histogramDef, sampleParserHistogramDefSeparator)
+	}
+	return ""
+}
+
+// familyConflict holds details about samples rejected due to conflict with the family.
+type familyConflict struct {
+	Name     string    `json:"name"`
+	Reason   string    `json:"reason"`
+	Expected string    `json:"expected"`
+	Got      string    `json:"got"`
+	Count    uint64    `json:"count"`
+	LastSeen time.Time `json:"lastSeen"`
+}
+
+// familyConflictsByName implements sort.Interface.
+type familyConflictsByName []*familyConflict
+
+func (c familyConflictsByName) Len() int      { return len(c) }
+func (c familyConflictsByName) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+func (c familyConflictsByName) Less(i, j int) bool {
+	if c[i].Name != c[j].Name {
+		return c[i].Name < c[j].Name
+	}
+	return c[i].Reason < c[j].Reason
+}
+
+// sampleLabelNames returns sorted names of the sample labels.
+func sampleLabelNames(s *sample) []string {
+	names := make([]string, 0, len(s.labels))
+	for n := range s.labels {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func stringsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func bucketsEqual(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// filterNotAllowedRule is a rule reported for samples not matching any rule of the allow-list.
+	filterNotAllowedRule = "not_allowed"
+)
+
+// ErrFilterRuleInvalid is returned when filter rule is not valid.
+var ErrFilterRuleInvalid = errors.New("filter: invalid rule")
+
+// filterConfig is a content of the filter file.
+// Sample is dropped if it does not match any rule of the allow-list (when not empty) or matches any rule of the deny-list.
+type filterConfig struct {
+	Allow []*filterRule `yaml:"allow"`
+	Deny  []*filterRule `yaml:"deny"`
+}
+
+// filterRule matches samples by metric name and label values. All given matchers have to match.
+// Patterns are regular expressions matching the whole value. Missing label has empty value.
+type filterRule struct {
+	// ID identifies the rule in metrics, defaults to list name and position (e.g. deny_0)
+	ID     string            `yaml:"id"`
+	Metric string            `yaml:"metric"`
+	Labels map[string]string `yaml:"labels"`
+
+	metric *regexp.Regexp
+	labels map[string]*regexp.Regexp
+}
+
+// compile validates the rule and prepares it for use.
+func (fr *filterRule) compile() error {
+	if fr.Metric == "" && len(fr.Labels) == 0 {
+		return errors.Wrap(ErrFilterRuleInvalid, "metric or labels required")
+	}
+
+	if fr.Metric != "" {
+		re, err := regexp.Compile("^(?:" + fr.Metric + ")$")
+		if err != nil {
+			return errors.Wrapf(ErrFilterRuleInvalid, "metric: %s", err)
+		}
+		fr.metric = re
+	}
+
+	fr.labels = make(map[string]*regexp.Regexp, len(fr.Labels))
+	for ln, pattern := range fr.Labels {
+		if !relabelLabelNameRE.MatchString(ln) {
+			return errors.Wrapf(ErrFilterRuleInvalid, "label name: %s", ln)
+		}
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return errors.Wrapf(ErrFilterRuleInvalid, "label %s: %s", ln, err)
+		}
+		fr.labels[ln] = re
+	}
+
+	return nil
+}
+
+// match checks if the sample matches all matchers of the rule.
+func (fr *filterRule) match(s *sample) bool {
+	if fr.metric != nil && !fr.metric.MatchString(s.name) {
+		return false
+	}
+	for ln, re := range fr.labels {
+		if !re.MatchString(s.labels[ln]) {
+			return false
+		}
+	}
+	return true
+}
+
+// loadFilterConfig reads filter rules in YAML.
+func loadFilterConfig(in io.Reader) (*filterConfig, error) {
+	b, err := ioutil.ReadAll(in)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg filterConfig
+	if err := yaml.Unmarshal(b, &cfg); err != nil {
+		return nil, errors.Wrap(err, "filter: parse")
+	}
+
+	if err := cfg.compile(); err != nil {
+		return nil, err
+	}
+
+	return &cfg, nil
+}
+
+// compile validates all rules and prepares them for use. Missing IDs are set.
+func (cfg *filterConfig) compile() error {
+	ids := make(map[string]struct{})
+	lists := []struct {
+		name  string
+		rules []*filterRule
+	}{{"allow", cfg.Allow}, {"deny", cfg.Deny}}
+	for _, list := range lists {
+		for i, fr := range list.rules {
+			if err := fr.compile(); err != nil {
+				return errors.Wrapf(err, "%s rule %d", list.name, i)
+			}
+			if fr.ID == "" {
+				fr.ID = fmt.Sprintf("%s_%d", list.name, i)
+			}
+			if _, found := ids[fr.ID]; found || fr.ID == filterNotAllowedRule {
+				return errors.Wrapf(ErrFilterRuleInvalid, "duplicated id: %s", fr.ID)
+			}
+			ids[fr.ID] = struct{}{}
+		}
+	}
+
+	return nil
+}
+
+// filter drops samples by allow-list and deny-list before they are handed over to the collector.
+type filter struct {
+	// mu guards lists, which are replaced on reload
+	mu    sync.RWMutex
+	allow []*filterRule
+	deny  []*filterRule
+
+	metricSamplesDropped *prometheus.CounterVec
+}
+
+func newFilter(cfg *filterConfig) *filter {
+	return &filter{
+		allow: cfg.Allow,
+		deny:  cfg.Deny,
+		metricSamplesDropped: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "app_filter_samples_dropped_total",
+				Help: "Number of samples dropped by the filter.",
+			},
+			[]string{"rule"},
+		),
+	}
+}
+
+// setConfig replaces lists applied to the following samples.
+func (f *filter) setConfig(cfg *filterConfig) {
+	f.mu.Lock()
+	f.allow = cfg.Allow
+	f.deny = cfg.Deny
+	f.mu.Unlock()
+}
+
+// accept checks the sample against the lists. Dropped samples are counted under the rule responsible.
+func (f *filter) accept(s *sample) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if len(f.allow) > 0 {
+		allowed := false
+		for _, fr := range f.allow {
+			if fr.match(s) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			f.metricSamplesDropped.WithLabelValues(filterNotAllowedRule).Inc()
+			return false
+		}
+	}
+
+	for _, fr := range f.deny {
+		if fr.match(s) {
+			f.metricSamplesDropped.WithLabelValues(fr.ID).Inc()
+			return false
+		}
+	}
+
+	return true
+}
+
+// handler wraps sample handler so samples are filtered first. Dropped samples are not passed on.
+func (f *filter) handler(next sampleHandler) sampleHandler {
+	return func(s *sample) error {
+		if !f.accept(s) {
+			return nil
+		}
+		return next(s)
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (f *filter) Describe(ch chan<- *prometheus.Desc) {
+	f.metricSamplesDropped.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (f *filter) Collect(ch chan<- prometheus.Metric) {
+	f.metricSamplesDropped.Collect(ch)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+
+	a "github.com/stretchr/testify/assert"
+)
+
+func thFilter(t *testing.T, config string) *filter {
+	cfg, err := loadFilterConfig(strings.NewReader(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newFilter(cfg)
+}
+
+func Test_Filter_Accept(t *testing.T) {
+	tfSample := func(name string, labels map[string]string) *sample {
+		return &sample{name: name, kind: sampleCounter, labels: labels, value: 1}
+	}
+
+	cases := map[string]struct {
+		config  string
+		in      *sample
+		exp     bool
+		expRule string
+	}{
+		"deny by name": {`
+deny:
+- metric: debug_.*`,
+			tfSample("debug_requests_total", map[string]string{}), false, "deny_0",
+		},
+		"deny by label": {`
+deny:
+- metric: debug_.*
+- id: dev
+  labels: {env: dev|test}`,
+			tfSample("requests_total", map[string]string{"env": "dev"}), false, "dev",
+		},
+		"deny requires all matchers": {`
+deny:
+- metric: requests_.*
+  labels: {env: dev}`,
+			tfSample("requests_total", map[string]string{"env": "prod"}), true, "",
+		},
+		"deny by missing label": {`
+deny:
+- labels: {service: ""}`,
+			tfSample("requests_total", map[string]string{}), false, "deny_0",
+		},
+		"not denied": {`
+deny:
+- metric: debug_.*`,
+			tfSample("requests_total", map[string]string{}), true, "",
+		},
+		"allowed": {`
+allow:
+- metric: app_.*
+- metric: requests_.*`,
+			tfSample("requests_total", map[string]string{}), true, "",
+		},
+		"not allowed": {`
+allow:
+- metric: app_.*`,
+			tfSample("requests_total", map[string]string{}), false, "not_allowed",
+		},
+		"allowed and denied": {`
+allow:
+- metric: app_.*
+deny:
+- labels: {env: dev}`,
+			tfSample("app_requests_total", map[string]string{"env": "dev"}), false, "deny_0",
+		},
+	}
+
+	for k, tc := range cases {
+		f := thFilter(t, tc.config)
+		a.Equal(t, tc.exp, f.accept(tc.in), k)
+
+		if tc.expRule != "" {
+			var mm dto.Metric
+			f.metricSamplesDropped.WithLabelValues(tc.expRule).Write(&mm)
+			a.Equal(t, float64(1), mm.Counter.GetValue(), k)
+		}
+	}
+}
+
+func Test_Filter_Handler(t *testing.T) {
+	f := thFilter(t, `
+deny:
+- metric: debug_.*`)
+
+	var got []*sample
+	h := f.handler(func(s *sample) error {
+		got = append(got, s)
+		return nil
+	})
+
+	a.NoError(t, h(&sample{name: "debug_requests_total", kind: sampleCounter, labels: map[string]string{}}))
+	a.NoError(t, h(&sample{name: "requests_total", kind: sampleCounter, labels: map[string]string{}}))
+	if a.Len(t, got, 1) {
+		a.Equal(t, "requests_total", got[0].name)
+	}
+}
+
+func Test_LoadFilterConfig_Invalid(t *testing.T) {
+	for _, config := range []string{
+		`deny: [{}]`,
+		`deny: [{metric: "("}]`,
+		`deny: [{labels: {env: "("}}]`,
+		`deny: [{labels: {invalid-label: dev}}]`,
+		`deny: [{id: a, metric: a}, {id: a, metric: b}]`,
+		`deny: [{id: not_allowed, metric: a}]`,
+		`not a map`,
+	} {
+		_, err := loadFilterConfig(strings.NewReader(config))
+		a.Error(t, err, config)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// gaugeAggregation defines how gauge samples from many clients are combined into single value.
+type gaugeAggregation string
+
+const (
+	// gaugeAggregationLast exposes the value of the last sample.
+	gaugeAggregationLast gaugeAggregation = "last"
+
+	// gaugeAggregationSumOfSamples exposes sum of all samples in the window.
+	// Every sample is added, so a client reporting its current value many times in the window is counted many times.
+	gaugeAggregationSumOfSamples gaugeAggregation = "sum_of_samples"
+
+	// gaugeAggregationMin exposes min of the samples in the window.
+	gaugeAggregationMin gaugeAggregation = "min"
+
+	// gaugeAggregationMax exposes max of the samples in the window.
+	gaugeAggregationMax gaugeAggregation = "max"
+
+	// gaugeAggregationAvg exposes average of the samples in the window.
+	gaugeAggregationAvg gaugeAggregation = "avg"
+
+	// gaugeAggregationRuleSeparator separates mode from the metric name pattern in the rule.
+	gaugeAggregationRuleSeparator = "="
+)
+
+// ErrGaugeAggregationRuleInvalid is returned when gauge aggregation rule can not be parsed.
+var ErrGaugeAggregationRuleInvalid = errors.New("gauge: invalid aggregation rule")
+
+// gaugeAggregationRule assigns aggregation mode to the metrics with names matching the pattern.
+type gaugeAggregationRule struct {
+	mode    gaugeAggregation
+	pattern *regexp.Regexp
+}
+
+// parseGaugeAggregation validates mode of the gauge aggregation.
+func parseGaugeAggregation(v string) (gaugeAggregation, bool) {
+	switch m := gaugeAggregation(v); m {
+	case gaugeAggregationLast, gaugeAggregationSumOfSamples, gaugeAggregationMin, gaugeAggregationMax, gaugeAggregationAvg:
+		return m, true
+	}
+	return "", false
+}
+
+// parseGaugeAggregationRule parses rule in "mode=pattern" format, e.g. "max=^queue_.+_length$".
+func parseGaugeAggregationRule(v string) (gaugeAggregationRule, error) {
+	parts := strings.SplitN(v, gaugeAggregationRuleSeparator, 2)
+	if len(parts) != 2 {
+		return gaugeAggregationRule{}, ErrGaugeAggregationRuleInvalid
+	}
+
+	mode, ok := parseGaugeAggregation(parts[0])
+	if !ok {
+		return gaugeAggregationRule{}, ErrGaugeAggregationRuleInvalid
+	}
+
+	re, err := regexp.Compile(parts[1])
+	if err != nil {
+		return gaugeAggregationRule{}, ErrGaugeAggregationRuleInvalid
+	}
+
+	return gaugeAggregationRule{mode: mode, pattern: re}, nil
+}
+
+// gaugeAggregate holds state of the gauge aggregated over the window.
+type gaugeAggregate struct {
+	mode gaugeAggregation
+
+	// count is a number of samples in the current window, zero if the window has just started
+	count         uint64
+	sum, min, max float64
+}
+
+// observe accounts sample value and returns value of the gauge.
+func (g *gaugeAggregate) observe(v float64) float64 {
+	if g.count == 0 {
+		g.sum, g.min, g.max = 0, v, v
+	}
+	g.count++
+	g.sum += v
+	if v < g.min {
+		g.min = v
+	}
+	if v > g.max {
+		g.max = v
+	}
+
+	switch g.mode {
+	case gaugeAggregationSumOfSamples:
+		return g.sum
+	case gaugeAggregationMin:
+		return g.min
+	case gaugeAggregationMax:
+		return g.max
+	case gaugeAggregationAvg:
+		return g.sum / float64(g.count)
+	}
+	return v
+}
+
+// reset starts new window. Value of the gauge is kept until the first sample of the window.
+func (g *gaugeAggregate) reset() {
+	g.count = 0
+}
+
+// gaugeAggregationFor returns aggregation mode for the metric. First matching rule wins.
+func (c *collector) gaugeAggregationFor(name string) gaugeAggregation {
+	for _, r := range c.gaugeAggregationRules {
+		if r.pattern.MatchString(name) {
+			return r.mode
+		}
+	}
+	return c.gaugeAggregation
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+
+	a "github.com/stretchr/testify/assert"
+)
+
+func Test_GaugeAggregate_Observe(t *testing.T) {
+	tests := map[gaugeAggregation][]float64{
+		gaugeAggregationLast:         {5, 1, 3},
+		gaugeAggregationSumOfSamples: {5, 6, 9},
+		gaugeAggregationMin:          {5, 1, 1},
+		gaugeAggregationMax:          {5, 5, 5},
+		gaugeAggregationAvg:          {5, 3, 3},
+	}
+
+	for mode, exp := range tests {
+		g := &gaugeAggregate{mode: mode}
+		var got []float64
+		for _, v := range []float64{5, 1, 3} {
+			got = append(got, g.observe(v))
+		}
+		a.Equal(t, exp, got, "mode: %s", mode)
+
+		// new window starts from scratch
+		g.reset()
+		a.Equal(t, float64(-2), g.observe(-2), "mode: %s", mode)
+	}
+}
+
+func Test_ParseGaugeAggregationRule(t *testing.T) {
+	r, err := parseGaugeAggregationRule("sum_of_samples=^queue_.+_length$")
+	if !a.NoError(t, err) {
+		t.FailNow()
+	}
+	a.Equal(t, gaugeAggregationSumOfSamples, r.mode)
+	a.True(t, r.pattern.MatchString("queue_jobs_length"))
+
+	for _, v := range []string{"", "sum_of_samples", "sum=^a$", "median=^a$", "max=(", "=^a$"} {
+		_, err := parseGaugeAggregationRule(v)
+		a.Equal(t, ErrGaugeAggregationRuleInvalid, err, "rule: %q", v)
+	}
+}
+
+func Test_Collector_Process_Success_GaugeAggregation(t *testing.T) {
+	samples := []*sample{
+		{name: "workers_busy", kind: sampleGauge, labels: map[string]string{}, value: 3},
+		{name: "workers_busy", kind: sampleGauge, labels: map[string]string{}, value: 4},
+		{name: "memory_peak_bytes", kind: sampleGauge, labels: map[string]string{}, value: 30},
+		{name: "memory_peak_bytes", kind: sampleGauge, labels: map[string]string{}, value: 10},
+		{name: "temperature", kind: sampleGauge, labels: map[string]string{}, value: 30},
+		{name: "temperature", kind: sampleGauge, labels: map[string]string{}, value: 10},
+	}
+
+	c := newCollector()
+	c.hasher = hashMD5
+	c.gaugeAggregationWindow = 0
+	c.gaugeAggregation = gaugeAggregationAvg
+	c.gaugeAggregationRules = []gaugeAggregationRule{
+		{mode: gaugeAggregationSumOfSamples, pattern: regexp.MustCompile("^workers_")},
+		{mode: gaugeAggregationMax, pattern: regexp.MustCompile("_peak_")},
+	}
+	thCollectorProcessPopulate(c, samples)
+	thCollectorProcessSynchronise(t, c)
+
+	for i, exp := range map[int]float64{0: 7, 2: 30, 4: 20} {
+		var mm dto.Metric
+		c.gauges[string(c.hasher(samples[i]))].Write(&mm)
+		a.Equal(t, exp, mm.Gauge.GetValue(), "metric: %s", samples[i].name)
+	}
+}
@@ -4,12 +4,20 @@ import (
 	"crypto/md5"
 	"encoding/binary"
 	"sort"
+	"strings"
 )
 
+// sampleHashers lists hashing functions which can be used with samples.
+var sampleHashers = map[string]sampleHasherFunc{
+	"prom":   hashProm,
+	"md5":    hashMD5,
+	"xxhash": hashXX,
+	"key":    hashKey,
+}
+
 // hashMD5 calculates a hash of the sample so it can be recognized.
 // Should take all elements other than value under consideration.
 func hashMD5(s *sample) []byte {
-	// TODO(szpakas): hash histogramDef
 	hash := md5.New()
 
 	hash.Write([]byte(s.kind))
@@ -39,12 +47,23 @@ func hashMD5(s *sample) []byte {
 		}
 	}
 
+	// histogram definition
+	if len(s.histogramDef) > 0 {
+		hash.Write([]byte("|"))
+
+		for i, v := range s.histogramDef {
+			hash.Write([]byte(v))
+			if i < len(s.histogramDef)-1 {
+				hash.Write([]byte(";"))
+			}
+		}
+	}
+
 	return hash.Sum([]byte{})
 }
 
 // hashProm calculates a hash based on Prometheus hashing algorithm.
 func hashProm(s *sample) []byte {
-	// TODO(szpakas): hash histogramDef
 	h := hashPromNew()
 
 	h = hashPromAdd(h, string(s.kind))
@@ -74,8 +93,164 @@ func hashProm(s *sample) []byte {
 		}
 	}
 
+	// histogram definition
+	if len(s.histogramDef) > 0 {
+		h = hashPromAdd(h, "|")
+
+		for i, v := range s.histogramDef {
+			h = hashPromAdd(h, v)
+			if i < len(s.histogramDef)-1 {
+				h = hashPromAdd(h, ";")
+			}
+		}
+	}
+
 	bs := make([]byte, 8) // 64bit
 	binary.LittleEndian.PutUint64(bs, h)
 
 	return bs
 }
+
+// seriesIdentity holds all elements of the sample taken under consideration by hashing.
+// It's used to detect hash collisions.
+type seriesIdentity struct {
+	kind         sampleKind
+	name         string
+	labels       map[string]string
+	histogramDef []string
+}
+
+func newSeriesIdentity(s *sample) *seriesIdentity {
+	return &seriesIdentity{
+		kind:         s.kind,
+		name:         s.name,
+		labels:       s.labels,
+		histogramDef: s.histogramDef,
+	}
+}
+
+// sample returns sample with all elements of the identity, e.g. for hashing.
+func (id *seriesIdentity) sample() *sample {
+	return &sample{kind: id.kind, name: id.name, labels: id.labels, histogramDef: id.histogramDef}
+}
+
+// matches checks if the sample belongs to the series.
+func (id *seriesIdentity) matches(s *sample) bool {
+	if id.kind != s.kind || id.name != s.name || len(id.labels) != len(s.labels) {
+		return false
+	}
+	for k, v := range id.labels {
+		if sv, found := s.labels[k]; !found || sv != v {
+			return false
+		}
+	}
+	return stringsEqual(id.histogramDef, s.histogramDef)
+}
+
+// sampleFullKey returns collision free representation of all elements taken under consideration by hashing.
+// It's slow in comparison to hashing and should be used only when collision is detected.
+func sampleFullKey(s *sample) string {
+	return string(appendSampleKey(nil, s))
+}
+
+// hashXX calculates xxHash64 of the canonical key of the sample.
+// Key is built on stack for typical samples so hashing is allocation free except for the result.
+func hashXX(s *sample) []byte {
+	var buf [hashKeyBufSize]byte
+	h := hashXXSum64(appendSampleKey(buf[:0], s))
+
+	bs := make([]byte, 8) // 64bit
+	binary.LittleEndian.PutUint64(bs, h)
+
+	return bs
+}
+
+// hashKey returns the canonical key of the sample.
+// Key is collision free, as separators are escaped, and hashing is left to the map using it.
+func hashKey(s *sample) []byte {
+	return appendSampleKey(make([]byte, 0, sampleKeySize(s)), s)
+}
+
+const (
+	// hashKeyBufSize is a size of the buffer sufficient for the canonical key of typical sample
+	hashKeyBufSize = 1024
+
+	// hashKeyLabelsBufSize is a number of labels for which sorting is done without allocation
+	hashKeyLabelsBufSize = 16
+)
+
+// appendSampleKey appends canonical key of the sample to buf.
+// Key takes under consideration all elements of the sample other than value:
+//
+//	kind|name|label1=value1;label2=value2|histogramDef1;histogramDef2
+//
+// Separators in the labels and histogram definition (e.g. set by relabeling) are escaped with backslash,
+// so different samples never have the same key.
+func appendSampleKey(buf []byte, s *sample) []byte {
+	buf = append(buf, s.kind...)
+	buf = append(buf, '|')
+	buf = appendKeyEscaped(buf, s.name)
+	buf = append(buf, '|')
+
+	var keysBuf [hashKeyLabelsBufSize]string
+	for i, k := range sortedLabelNames(s, keysBuf[:0]) {
+		if i > 0 {
+			buf = append(buf, ';')
+		}
+		buf = appendKeyEscaped(buf, k)
+		buf = append(buf, '=')
+		buf = appendKeyEscaped(buf, s.labels[k])
+	}
+
+	buf = append(buf, '|')
+	for i, v := range s.histogramDef {
+		if i > 0 {
+			buf = append(buf, ';')
+		}
+		buf = appendKeyEscaped(buf, v)
+	}
+
+	return buf
+}
+
+// hashKeySpecialChars are separators of the canonical key and the escape character.
+const hashKeySpecialChars = `|;=\`
+
+// appendKeyEscaped appends v to buf, escaping separators of the canonical key.
+func appendKeyEscaped(buf []byte, v string) []byte {
+	if !strings.ContainsAny(v, hashKeySpecialChars) {
+		return append(buf, v...)
+	}
+	for i := 0; i < len(v); i++ {
+		if strings.IndexByte(hashKeySpecialChars, v[i]) >= 0 {
+			buf = append(buf, '\\')
+		}
+		buf = append(buf, v[i])
+	}
+	return buf
+}
+
+// sampleKeySize returns length of the canonical key of the sample, without escaping.
+func sampleKeySize(s *sample) int {
+	n := len(s.kind) + len(s.name) + 3
+	for k, v := range s.labels {
+		n += len(k) + len(v) + 2
+	}
+	for _, v := range s.histogramDef {
+		n += len(v) + 1
+	}
+	return n
+}
+
+// sortedLabelNames appends sorted names of the sample labels to buf.
+// Insertion sort is used as label sets are small and it does not require the slice to escape to heap.
+func sortedLabelNames(s *sample, buf []string) []string {
+	keys := buf
+	for k := range s.labels {
+		keys = append(keys, k)
+		for i := len(keys) - 1; i > 0 && keys[i] < keys[i-1]; i-- {
+			keys[i], keys[i-1] = keys[i-1], keys[i]
+		}
+	}
+	return keys
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	a "github.com/stretchr/testify/assert"
+)
+
+var tfHashSamples = []sample{
+	{name: "name_of_1_metric_total", kind: sampleCounter, labels: map[string]string{}},
+	{name: "name_of_1_metric_total", kind: sampleGauge, labels: map[string]string{}},
+	{name: "name_of_2_metric_total", kind: sampleCounter, labels: map[string]string{}},
+	{name: "name_of_1_metric_total", kind: sampleCounter, labels: map[string]string{"labelA": "labelValueA"}},
+	{name: "name_of_1_metric_total", kind: sampleCounter, labels: map[string]string{"labelA": "labelValueB"}},
+	{name: "name_of_1_metric_total", kind: sampleCounter, labels: map[string]string{"labelB": "labelValueA"}},
+	{name: "name_of_1_metric_total", kind: sampleCounter, labels: map[string]string{"labelA": "labelValueA", "labelB": "labelValueB"}},
+	{name: "name_of_1_metric_seconds", kind: sampleHistogramLinear, labels: map[string]string{}, histogramDef: []string{"1", "2", "3"}},
+	{name: "name_of_1_metric_seconds", kind: sampleHistogramLinear, labels: map[string]string{}, histogramDef: []string{"1", "2", "4"}},
+	{name: "name_of_1_metric_seconds", kind: sampleHistogramExponential, labels: map[string]string{}, histogramDef: []string{"1", "2", "3"}},
+}
+
+// Test_Sample_Hashers is a suite run against every registered hasher.
+func Test_Sample_Hashers(t *testing.T) {
+	for sym, h := range sampleHashers {
+		// deterministic and independent of value
+		for i := range tfHashSamples {
+			s1 := tfHashSamples[i]
+			s2 := tfHashSamples[i]
+			s2.value = 12.345
+			a.Equal(t, h(&s1), h(&s2), "[%s] sample %d", sym, i)
+		}
+
+		// independent of the order of labels
+		labels1 := make(map[string]string)
+		labels2 := make(map[string]string)
+		for i := 0; i < 20; i++ {
+			labels1[fmt.Sprintf("label%d", i)] = fmt.Sprintf("value%d", i)
+		}
+		for i := 19; i >= 0; i-- {
+			labels2[fmt.Sprintf("label%d", i)] = fmt.Sprintf("value%d", i)
+		}
+		for i := 0; i < 100; i++ {
+			a.Equal(t,
+				h(&sample{name: "m", kind: sampleCounter, labels: labels1}),
+				h(&sample{name: "m", kind: sampleCounter, labels: labels2}),
+				"[%s] label order", sym,
+			)
+		}
+
+		// distinct for different samples
+		seen := make(map[string]int)
+		for i := range tfHashSamples {
+			hash := string(h(&tfHashSamples[i]))
+			if j, found := seen[hash]; found {
+				t.Errorf("[%s] samples %d and %d have the same hash", sym, j, i)
+			}
+			seen[hash] = i
+		}
+	}
+}
+
+func Test_Sample_Hash_Key(t *testing.T) {
+	s := sample{
+		name: "name_of_1_metric_seconds", kind: sampleHistogramLinear,
+		labels:       map[string]string{"service": "srvA1", "host": "hostA", "labelA": "labelValueA"},
+		histogramDef: []string{"3.3", "2.0", "5"},
+	}
+	a.Equal(t, []byte("hl|name_of_1_metric_seconds|host=hostA;labelA=labelValueA;service=srvA1|3.3;2.0;5"), hashKey(&s))
+}
+
+func Test_Sample_Hash_Key_Escaped(t *testing.T) {
+	sA := sample{name: "name_of_1_metric_total", kind: sampleCounter, labels: map[string]string{"labelA": "a;labelB=b"}}
+	sB := sample{name: "name_of_1_metric_total", kind: sampleCounter, labels: map[string]string{"labelA": "a", "labelB": "b"}}
+	sC := sample{name: "name_of_1_metric_total", kind: sampleCounter, labels: map[string]string{"labelA": `a\`, "labelB": "b"}}
+
+	a.Equal(t, []byte(`c|name_of_1_metric_total|labelA=a\;labelB\=b|`), hashKey(&sA))
+	a.NotEqual(t, hashKey(&sA), hashKey(&sB))
+	a.NotEqual(t, hashKey(&sB), hashKey(&sC))
+	a.NotEqual(t, sampleFullKey(&sA), sampleFullKey(&sB))
+}
+
+func benchmarkSampleHasher(b *testing.B, h sampleHasherFunc, labelsCount int) {
+	s := sample{
+		name: "name_of_1_metric_seconds", kind: sampleHistogramLinear,
+		labels:       make(map[string]string),
+		histogramDef: []string{"3.3", "2.0", "5"},
+	}
+	for i := 0; i < labelsCount; i++ {
+		s.labels[fmt.Sprintf("labelName%d", i)] = fmt.Sprintf("labelValue%d", i)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h(&s)
+	}
+}
+
+func Benchmark_Sample_Hash(b *testing.B) {
+	for _, sym := range []string{"prom", "md5", "xxhash", "key"} {
+		for _, labelsCount := range []int{0, 1, 5, 10, 20} {
+			h := sampleHashers[sym]
+			n := labelsCount
+			b.Run(fmt.Sprintf("%s/labels=%d", sym, n), func(b *testing.B) {
+				benchmarkSampleHasher(b, h, n)
+			})
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import "encoding/binary"
+
+// Inline, one-shot variant of xxHash64 (seed 0).
+// Based on github.com/cespare/xxhash, licence MIT
+
+const (
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+)
+
+// xxPrime1v is a variable copy of xxPrime1 so overflowing arithmetic on it is not rejected by the compiler.
+var xxPrime1v = xxPrime1
+
+// hashXXSum64 returns xxHash64 of b.
+func hashXXSum64(b []byte) uint64 {
+	n := len(b)
+	var h uint64
+
+	if n >= 32 {
+		v1 := xxPrime1v + xxPrime2
+		v2 := xxPrime2
+		v3 := uint64(0)
+		v4 := -xxPrime1v
+		for len(b) >= 32 {
+			v1 = hashXXRound(v1, binary.LittleEndian.Uint64(b[0:8]))
+			v2 = hashXXRound(v2, binary.LittleEndian.Uint64(b[8:16]))
+			v3 = hashXXRound(v3, binary.LittleEndian.Uint64(b[16:24]))
+			v4 = hashXXRound(v4, binary.LittleEndian.Uint64(b[24:32]))
+			b = b[32:]
+		}
+		h = hashXXRotl(v1, 1) + hashXXRotl(v2, 7) + hashXXRotl(v3, 12) + hashXXRotl(v4, 18)
+		h = hashXXMergeRound(h, v1)
+		h = hashXXMergeRound(h, v2)
+		h = hashXXMergeRound(h, v3)
+		h = hashXXMergeRound(h, v4)
+	} else {
+		h = xxPrime5
+	}
+
+	h += uint64(n)
+
+	for ; len(b) >= 8; b = b[8:] {
+		h ^= hashXXRound(0, binary.LittleEndian.Uint64(b[:8]))
+		h = hashXXRotl(h, 27)*xxPrime1 + xxPrime4
+	}
+	if len(b) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(b[:4])) * xxPrime1
+		h = hashXXRotl(h, 23)*xxPrime2 + xxPrime3
+		b = b[4:]
+	}
+	for ; len(b) > 0; b = b[1:] {
+		h ^= uint64(b[0]) * xxPrime5
+		h = hashXXRotl(h, 11) * xxPrime1
+	}
+
+	h ^= h >> 33
+	h *= xxPrime2
+	h ^= h >> 29
+	h *= xxPrime3
+	h ^= h >> 32
+
+	return h
+}
+
+func hashXXRound(acc, input uint64) uint64 {
+	acc += input * xxPrime2
+	acc = hashXXRotl(acc, 31)
+	acc *= xxPrime1
+	return acc
+}
+
+func hashXXMergeRound(acc, val uint64) uint64 {
+	val = hashXXRound(0, val)
+	acc ^= val
+	acc = acc*xxPrime1 + xxPrime4
+	return acc
+}
+
+func hashXXRotl(x uint64, r uint) uint64 {
+	return (x << r) | (x >> (64 - r))
+}
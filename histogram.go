@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var (
+	// ErrHistogramLayoutMismatch is returned when pre-aggregated buckets do not match buckets of the histogram.
+	ErrHistogramLayoutMismatch = errors.New("histogram: bucket layout mismatch")
+
+	// ErrHistogramAggregateInvalid is returned when pre-aggregated buckets hold more observations than total count.
+	ErrHistogramAggregateInvalid = errors.New("histogram: bucket counts exceed total count")
+)
+
+// histogram is a prometheus.Histogram which, apart from single observations,
+// accepts buckets pre-aggregated on the client side.
+type histogram struct {
+	desc        *prometheus.Desc
+	upperBounds []float64
+
+	// mu protects scraping from interfering with observations
+	mu sync.Mutex
+	// counts are non-cumulative. Last element is the +Inf bucket.
+	// Weighted observations make counts fractional, they are rounded on exposition.
+	counts []float64
+	sum    float64
+	count  float64
+}
+
+// newHistogram creates histogram described by opts.
+// Buckets must be sorted in increasing order and must not contain +Inf.
+func newHistogram(opts prometheus.HistogramOpts) *histogram {
+	return &histogram{
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, opts.Subsystem, opts.Name),
+			opts.Help,
+			nil,
+			opts.ConstLabels,
+		),
+		upperBounds: opts.Buckets,
+		counts:      make([]float64, len(opts.Buckets)+1),
+	}
+}
+
+// Desc implements prometheus.Metric.
+func (h *histogram) Desc() *prometheus.Desc {
+	return h.desc
+}
+
+// Write implements prometheus.Metric.
+func (h *histogram) Write(out *dto.Metric) error {
+	m, err := h.snapshot()
+	if err != nil {
+		return err
+	}
+	return m.Write(out)
+}
+
+// Describe implements prometheus.Collector.
+func (h *histogram) Describe(ch chan<- *prometheus.Desc) {
+	ch <- h.desc
+}
+
+// Collect implements prometheus.Collector.
+func (h *histogram) Collect(ch chan<- prometheus.Metric) {
+	if m, err := h.snapshot(); err == nil {
+		ch <- m
+	}
+}
+
+// Observe implements prometheus.Histogram.
+func (h *histogram) Observe(v float64) {
+	h.observeWeighted(v, 1)
+}
+
+// observeWeighted accounts single observation as w observations of the same value.
+// Used for sampled observations where weight is the inverse of the sampling rate.
+func (h *histogram) observeWeighted(v, w float64) {
+	// first bucket with upper bound >= v, +Inf if none
+	i := sort.SearchFloat64s(h.upperBounds, v)
+
+	h.mu.Lock()
+	h.counts[i] += w
+	h.sum += v * w
+	h.count += w
+	h.mu.Unlock()
+}
+
+// merge adds pre-aggregated histogram.
+// counts are non-cumulative and cover only buckets with finite upper bounds,
+// observations above the last bound are accounted as a difference between count and sum of counts.
+func (h *histogram) merge(counts []uint64, sum float64, count uint64) error {
+	if len(counts) != len(h.upperBounds) {
+		return ErrHistogramLayoutMismatch
+	}
+
+	var finite uint64
+	for _, c := range counts {
+		finite += c
+	}
+	if finite > count {
+		return ErrHistogramAggregateInvalid
+	}
+
+	h.mu.Lock()
+	for i, c := range counts {
+		h.counts[i] += float64(c)
+	}
+	h.counts[len(counts)] += float64(count - finite)
+	h.sum += sum
+	h.count += float64(count)
+	h.mu.Unlock()
+
+	return nil
+}
+
+// sameLayout checks if histogram uses given upper bounds for buckets.
+func (h *histogram) sameLayout(upperBounds []float64) bool {
+	return bucketsEqual(upperBounds, h.upperBounds)
+}
+
+// snapshot creates consistent, read-only copy of the histogram.
+func (h *histogram) snapshot() (prometheus.Metric, error) {
+	buckets := make(map[float64]uint64, len(h.upperBounds))
+
+	h.mu.Lock()
+	var cumulative float64
+	for i, ub := range h.upperBounds {
+		cumulative += h.counts[i]
+		buckets[ub] = roundCount(cumulative)
+	}
+	count, sum := roundCount(h.count), h.sum
+	h.mu.Unlock()
+
+	return prometheus.NewConstHistogram(h.desc, count, sum, buckets)
+}
+
+// roundCount converts possibly fractional count to the nearest integer.
+func roundCount(c float64) uint64 {
+	return uint64(math.Floor(c + 0.5))
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	a "github.com/stretchr/testify/assert"
+)
+
+func Test_Histogram_Observe_SameAsPrometheus(t *testing.T) {
+	opts := prometheus.HistogramOpts{
+		Name:        "name_of_1_metric_seconds",
+		Help:        "auto",
+		ConstLabels: prometheus.Labels{"labelA": "labelValueA"},
+		Buckets:     prometheus.LinearBuckets(1, 2, 4),
+	}
+	hGot := newHistogram(opts)
+	hExp := prometheus.NewHistogram(opts)
+
+	for _, v := range []float64{0, 1, 1.5, 3, 6.9, 7, 7.1, 100} {
+		hGot.Observe(v)
+		hExp.Observe(v)
+	}
+
+	var mGot, mExp dto.Metric
+	if !a.NoError(t, hGot.Write(&mGot)) {
+		t.FailNow()
+	}
+	hExp.Write(&mExp)
+
+	a.Equal(t, mExp.String(), mGot.String())
+	a.Equal(t, hExp.Desc().String(), hGot.Desc().String())
+}
+
+func Test_Histogram_Merge_Success(t *testing.T) {
+	h := newHistogram(prometheus.HistogramOpts{Name: "h", Help: "auto", Buckets: []float64{1, 2, 3}})
+	h.Observe(2.5)
+
+	err := h.merge([]uint64{1, 0, 4}, 15.5, 7)
+	if !a.NoError(t, err) {
+		t.FailNow()
+	}
+
+	var mm dto.Metric
+	h.Write(&mm)
+	a.Equal(t, uint64(8), mm.Histogram.GetSampleCount())
+	a.Equal(t, 18.0, mm.Histogram.GetSampleSum())
+	if !a.Len(t, mm.Histogram.GetBucket(), 3) {
+		t.FailNow()
+	}
+	a.Equal(t, uint64(1), mm.Histogram.GetBucket()[0].GetCumulativeCount())
+	a.Equal(t, uint64(1), mm.Histogram.GetBucket()[1].GetCumulativeCount())
+	a.Equal(t, uint64(6), mm.Histogram.GetBucket()[2].GetCumulativeCount())
+}
+
+func Test_Histogram_Merge_Failure(t *testing.T) {
+	tests := map[string]struct {
+		counts []uint64
+		count  uint64
+		expErr error
+	}{
+		"too few buckets":           {[]uint64{1, 2}, 3, ErrHistogramLayoutMismatch},
+		"too many buckets":          {[]uint64{1, 2, 3, 4}, 10, ErrHistogramLayoutMismatch},
+		"counts exceed total count": {[]uint64{1, 2, 3}, 5, ErrHistogramAggregateInvalid},
+	}
+
+	for sym, tc := range tests {
+		h := newHistogram(prometheus.HistogramOpts{Name: "h", Help: "auto", Buckets: []float64{1, 2, 3}})
+		a.Equal(t, tc.expErr, h.merge(tc.counts, 1, tc.count), sym)
+
+		// histogram is left untouched
+		var mm dto.Metric
+		h.Write(&mm)
+		a.Equal(t, uint64(0), mm.Histogram.GetSampleCount(), sym)
+	}
+}
+
+func Test_Histogram_ObserveWeighted(t *testing.T) {
+	h := newHistogram(prometheus.HistogramOpts{Name: "h", Help: "auto", Buckets: []float64{1, 2, 3}})
+	// three samples collected with 0.3 sampling rate
+	h.observeWeighted(0.5, 1/0.3)
+	h.observeWeighted(0.5, 1/0.3)
+	h.observeWeighted(2.5, 1/0.3)
+	h.Observe(5)
+
+	var mm dto.Metric
+	h.Write(&mm)
+	a.Equal(t, uint64(11), mm.Histogram.GetSampleCount())
+	a.InDelta(t, 3.5/0.3+5, mm.Histogram.GetSampleSum(), 1e-9)
+	if !a.Len(t, mm.Histogram.GetBucket(), 3) {
+		t.FailNow()
+	}
+	a.Equal(t, uint64(7), mm.Histogram.GetBucket()[0].GetCumulativeCount())
+	a.Equal(t, uint64(7), mm.Histogram.GetBucket()[1].GetCumulativeCount())
+	a.Equal(t, uint64(10), mm.Histogram.GetBucket()[2].GetCumulativeCount())
+}
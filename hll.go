@@ -0,0 +1,87 @@
+package main
+
+import "math"
+
+// hyperLogLog is an approximate distinct counter.
+// Memory usage is fixed to 2^precision bytes regardless of the number of inserted members.
+//
+// See "HyperLogLog: the analysis of a near-optimal cardinality estimation algorithm" by Flajolet et al.
+type hyperLogLog struct {
+	precision uint8
+	registers []uint8
+}
+
+// newHyperLogLog creates estimator with 2^precision registers.
+// Standard error of the estimation is about 1.04/sqrt(2^precision).
+func newHyperLogLog(precision uint8) *hyperLogLog {
+	return &hyperLogLog{
+		precision: precision,
+		registers: make([]uint8, 1<<precision),
+	}
+}
+
+// insert adds member to the set.
+// Returns true if the internal state was changed and estimation should be recalculated.
+func (h *hyperLogLog) insert(member string) bool {
+	x := hashMix64(hashPromAdd(hashPromNew(), member))
+
+	idx := x >> (64 - h.precision)
+	// guard bit ensures rank is bounded even if remaining bits are all zeros
+	w := x<<h.precision | 1<<(h.precision-1)
+
+	var rank uint8 = 1
+	for w&(1<<63) == 0 {
+		rank++
+		w <<= 1
+	}
+
+	if rank > h.registers[idx] {
+		h.registers[idx] = rank
+		return true
+	}
+	return false
+}
+
+// estimate returns approximate number of distinct members inserted since creation or last reset.
+func (h *hyperLogLog) estimate() float64 {
+	m := float64(len(h.registers))
+
+	var (
+		sum   float64
+		zeros int
+	)
+	for _, r := range h.registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+
+	alpha := 0.7213 / (1 + 1.079/m)
+	e := alpha * m * m / sum
+
+	// small range correction
+	if e <= 2.5*m && zeros > 0 {
+		return m * math.Log(m/float64(zeros))
+	}
+
+	return e
+}
+
+// reset clears the set without releasing memory.
+func (h *hyperLogLog) reset() {
+	for i := range h.registers {
+		h.registers[i] = 0
+	}
+}
+
+// hashMix64 is a finalizer from MurmurHash3.
+// FNV output for short strings is not uniform enough in high bits to be used directly for register selection.
+func hashMix64(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
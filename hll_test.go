@@ -0,0 +1,53 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"testing"
+
+	a "github.com/stretchr/testify/assert"
+)
+
+func Test_HyperLogLog_Estimate(t *testing.T) {
+	tests := map[string]struct {
+		n int
+	}{
+		"empty":  {0},
+		"small":  {10},
+		"medium": {1000},
+		"large":  {100000},
+	}
+
+	for sym, tc := range tests {
+		h := newHyperLogLog(setHLLPrecision)
+		for i := 0; i < tc.n; i++ {
+			h.insert("user" + strconv.Itoa(i))
+		}
+
+		// allow for 5 standard errors
+		tolerance := 5 * 1.04 / math.Sqrt(float64(len(h.registers))) * float64(tc.n)
+		a.InDelta(t, float64(tc.n), h.estimate(), math.Max(tolerance, 1), sym)
+	}
+}
+
+func Test_HyperLogLog_Duplicates(t *testing.T) {
+	h := newHyperLogLog(setHLLPrecision)
+	for i := 0; i < 1000; i++ {
+		h.insert("user1")
+		h.insert("user2")
+	}
+	a.InDelta(t, 2, h.estimate(), 0.01)
+
+	a.False(t, h.insert("user1"), "re-inserting existing member should not change state")
+}
+
+func Test_HyperLogLog_Reset(t *testing.T) {
+	h := newHyperLogLog(setHLLPrecision)
+	for i := 0; i < 100; i++ {
+		h.insert("user" + strconv.Itoa(i))
+	}
+	h.reset()
+
+	a.Equal(t, float64(0), h.estimate())
+	a.Len(t, h.registers, 1<<setHLLPrecision)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// seriesLastUpdateMode defines how time of the last update of the series is exposed.
+type seriesLastUpdateMode string
+
+const (
+	// seriesLastUpdateNone does not expose the time.
+	seriesLastUpdateNone seriesLastUpdateMode = "none"
+
+	// seriesLastUpdateGauge exposes the time as companion gauge named <name>_last_update_timestamp_seconds.
+	seriesLastUpdateGauge seriesLastUpdateMode = "gauge"
+
+	// seriesLastUpdateTimestamp exposes the time as an explicit timestamp of the metric.
+	seriesLastUpdateTimestamp seriesLastUpdateMode = "timestamp"
+
+	seriesLastUpdateSuffix = "_last_update_timestamp_seconds"
+	seriesLastUpdateHelp   = "Unix timestamp of the last update of the series."
+)
+
+// seriesLastUpdate holds time of the last update of the series.
+type seriesLastUpdate struct {
+	// desc of the companion gauge, set only with seriesLastUpdateGauge
+	desc *prometheus.Desc
+	t    time.Time
+}
+
+// timestampedMetric is a metric exposed with explicit timestamp.
+type timestampedMetric struct {
+	prometheus.Metric
+	timestampMs int64
+}
+
+// Write implements prometheus.Metric.
+func (m timestampedMetric) Write(out *dto.Metric) error {
+	if err := m.Metric.Write(out); err != nil {
+		return err
+	}
+	ts := m.timestampMs
+	out.TimestampMs = &ts
+	return nil
+}
+
+// nameReserved checks if name of the metric is reserved for companion gauges.
+// Names with the suffix are reserved as a whole, so neither companion of the client metric
+// nor the client metric with such name can clash with other one.
+func (c *collector) nameReserved(name string) bool {
+	return c.lastUpdateMode == seriesLastUpdateGauge && strings.HasSuffix(name, seriesLastUpdateSuffix)
+}
+
+// timestampSkewed checks if timestamp sent by the client is too far from the local clock.
+func (c *collector) timestampSkewed(s *sample) bool {
+	if s.timestamp.IsZero() || c.timestampMaxSkew == 0 {
+		return false
+	}
+	skew := time.Since(s.timestamp)
+	return skew > c.timestampMaxSkew || skew < -c.timestampMaxSkew
+}
+
+// sampleOutOfOrder checks if sample is older than the last update of the series stored under key h.
+// Checked only with seriesLastUpdateTimestamp, as such sample would change value exposed with a newer timestamp.
+func (c *collector) sampleOutOfOrder(h string, s *sample) bool {
+	if c.lastUpdateMode != seriesLastUpdateTimestamp || s.timestamp.IsZero() {
+		return false
+	}
+
+	c.lastUpdatesMu.RLock()
+	defer c.lastUpdatesMu.RUnlock()
+
+	lu, found := c.lastUpdates[h]
+	return found && s.timestamp.Before(lu.t)
+}
+
+// updateSeries records time of the sample as the last update of the series stored under key h.
+// Time sent by the client is used if present. Updates older than already known one are ignored.
+// Should be called only from process.
+func (c *collector) updateSeries(h string, s *sample) {
+	t := s.timestamp
+	if t.IsZero() {
+		t = time.Now()
+	}
+
+	c.lastUpdatesMu.Lock()
+	defer c.lastUpdatesMu.Unlock()
+
+	lu, found := c.lastUpdates[h]
+	if !found {
+		lu = &seriesLastUpdate{}
+		if c.lastUpdateMode == seriesLastUpdateGauge {
+			lu.desc = prometheus.NewDesc(s.name+seriesLastUpdateSuffix, seriesLastUpdateHelp, nil, s.labels)
+		}
+		c.lastUpdates[h] = lu
+	}
+	if t.After(lu.t) {
+		lu.t = t
+	}
+}
+
+// collectSeries sends metric of the series stored under key h, with explicit timestamp if enabled.
+func (c *collector) collectSeries(ch chan<- prometheus.Metric, h string, m prometheus.Metric) {
+	if c.lastUpdateMode == seriesLastUpdateTimestamp {
+		c.lastUpdatesMu.RLock()
+		lu, found := c.lastUpdates[h]
+		var t time.Time
+		if found {
+			t = lu.t
+		}
+		c.lastUpdatesMu.RUnlock()
+
+		if found {
+			m = timestampedMetric{Metric: m, timestampMs: t.UnixNano() / int64(time.Millisecond)}
+		}
+	}
+
+	ch <- m
+}
+
+// collectLastUpdates sends companion gauges with time of the last update of every series.
+func (c *collector) collectLastUpdates(ch chan<- prometheus.Metric) {
+	if c.lastUpdateMode != seriesLastUpdateGauge {
+		return
+	}
+
+	c.lastUpdatesMu.RLock()
+	defer c.lastUpdatesMu.RUnlock()
+
+	for _, lu := range c.lastUpdates {
+		v := float64(lu.t.UnixNano()) / 1e9
+		if m, err := prometheus.NewConstMetric(lu.desc, prometheus.GaugeValue, v); err == nil {
+			ch <- m
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	a "github.com/stretchr/testify/assert"
+)
+
+func Test_Collector_Process_Failure_TimestampSkew(t *testing.T) {
+	samples := []*sample{
+		{name: "name_of_1_metric_total", kind: sampleCounter, labels: map[string]string{}, value: 1, timestamp: time.Now().Add(-time.Hour)},
+		{name: "name_of_1_metric_total", kind: sampleCounter, labels: map[string]string{}, value: 2, timestamp: time.Now().Add(time.Hour)},
+		{name: "name_of_1_metric_total", kind: sampleCounter, labels: map[string]string{}, value: 4, timestamp: time.Now()},
+	}
+
+	c := newCollector()
+	c.hasher = hashMD5
+	thCollectorProcessPopulate(c, samples)
+	thCollectorProcessSynchronise(t, c)
+
+	var mm dto.Metric
+	c.counters[string(c.hasher(samples[0]))].Write(&mm)
+	a.Equal(t, float64(4), mm.Counter.GetValue())
+
+	c.metricSamplesRejected.WithLabelValues("timestamp_skew").Write(&mm)
+	a.Equal(t, float64(2), mm.Counter.GetValue())
+}
+
+func Test_Collector_Collect_LastUpdate(t *testing.T) {
+	ts := time.Now().Add(-time.Second).Truncate(time.Millisecond)
+	samples := []*sample{
+		{name: "name_of_1_metric_total", kind: sampleCounter, labels: map[string]string{"labelA": "labelValueA"}, value: 1, timestamp: ts},
+		// out of order sample does not move the time back
+		{name: "name_of_1_metric_total", kind: sampleCounter, labels: map[string]string{"labelA": "labelValueA"}, value: 1, timestamp: ts.Add(-time.Second)},
+	}
+
+	collect := func(c *collector) []prometheus.Metric {
+		ch := make(chan prometheus.Metric, 2048)
+		c.Collect(ch)
+		close(ch)
+
+		var out []prometheus.Metric
+		for m := range ch {
+			if strings.Contains(m.Desc().String(), "name_of_1_metric") {
+				out = append(out, m)
+			}
+		}
+		return out
+	}
+
+	t.Run("gauge", func(t *testing.T) {
+		c := newCollector()
+		c.hasher = hashMD5
+		c.lastUpdateMode = seriesLastUpdateGauge
+		thCollectorProcessPopulate(c, samples)
+		thCollectorProcessSynchronise(t, c)
+
+		got := collect(c)
+		if !a.Len(t, got, 2) {
+			t.FailNow()
+		}
+		for _, m := range got {
+			var mm dto.Metric
+			m.Write(&mm)
+			a.Nil(t, mm.TimestampMs)
+			if mm.Gauge != nil {
+				a.Contains(t, m.Desc().String(), `"name_of_1_metric_total_last_update_timestamp_seconds"`)
+				a.Contains(t, m.Desc().String(), `labelA="labelValueA"`)
+				a.Equal(t, float64(ts.UnixNano())/1e9, mm.Gauge.GetValue())
+			}
+		}
+	})
+
+	t.Run("timestamp", func(t *testing.T) {
+		c := newCollector()
+		c.hasher = hashMD5
+		c.lastUpdateMode = seriesLastUpdateTimestamp
+		thCollectorProcessPopulate(c, samples)
+		thCollectorProcessSynchronise(t, c)
+
+		got := collect(c)
+		if !a.Len(t, got, 1) {
+			t.FailNow()
+		}
+		var mm dto.Metric
+		got[0].Write(&mm)
+		// out of order sample is rejected, it would change value exposed with the newer timestamp
+		a.Equal(t, float64(1), mm.Counter.GetValue())
+		a.Equal(t, ts.UnixNano()/int64(time.Millisecond), mm.GetTimestampMs())
+
+		c.metricSamplesRejected.WithLabelValues("out_of_order").Write(&mm)
+		a.Equal(t, float64(1), mm.Counter.GetValue())
+	})
+}
+
+func Test_Collector_Process_Failure_LastUpdateReservedName(t *testing.T) {
+	samples := []*sample{
+		{name: "name_of_1_metric_total", kind: sampleCounter, labels: map[string]string{}, value: 1},
+		// clashes with the companion gauge of the metric above
+		{name: "name_of_1_metric_total_last_update_timestamp_seconds", kind: sampleGauge, labels: map[string]string{}, value: 1},
+		{name: "name_of_2_metric_last_update_timestamp_seconds", kind: sampleGauge, labels: map[string]string{}, value: 1},
+	}
+
+	c := newCollector()
+	c.hasher = hashMD5
+	c.lastUpdateMode = seriesLastUpdateGauge
+	thCollectorProcessPopulate(c, samples)
+	thCollectorProcessSynchronise(t, c)
+
+	a.Len(t, c.counters, 1)
+	a.Len(t, c.gauges, 0)
+	var mm dto.Metric
+	c.metricSamplesRejected.WithLabelValues("reserved_name").Write(&mm)
+	a.Equal(t, float64(2), mm.Counter.GetValue())
+
+	// all metrics can be gathered together
+	reg := prometheus.NewRegistry()
+	if !a.NoError(t, reg.Register(c)) {
+		t.FailNow()
+	}
+	_, err := reg.Gather()
+	a.NoError(t, err)
+
+	// names are not reserved without companion gauges
+	c = newCollector()
+	c.hasher = hashMD5
+	thCollectorProcessPopulate(c, samples)
+	thCollectorProcessSynchronise(t, c)
+	a.Len(t, c.gauges, 2)
+}
@@ -4,11 +4,18 @@ import (
 	"flag"
 	"fmt"
 	"net/http"
+	"os"
+	"os/signal"
+	"regexp"
 	"runtime"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/prometheus/log"
 	"github.com/vrischmann/envconfig"
 )
@@ -47,7 +54,131 @@ type config struct {
 	// Valid values:
 	// - prom: hasher based on prometheus implementation of FNV-1a hash
 	// - md5: naive MD5 implementation
+	// - xxhash: xxHash64 of the canonical key, built without allocation for typical samples
+	// - key: canonical key used directly, collision free
 	SampleHasher string `envconfig:"default=prom"`
+
+	// SetResetInterval is a window after which all sets are cleared.
+	// Zero disables the reset.
+	SetResetInterval time.Duration `envconfig:"default=1m"`
+
+	// MetadataFile is a path to the file with static metadata (HELP and UNIT lines in ingress format).
+	// Static metadata takes precedence over metadata sent by clients.
+	MetadataFile string `envconfig:"optional"`
+
+	// LabelNamesPolicy defines handling of the samples with label names different than the rest of the metric.
+	// Valid values:
+	// - allow: samples are accepted, conflict is only reported
+	// - reject: samples are rejected
+	// - fill: missing labels are added with LabelNamesFillValue, samples with unknown labels are rejected
+	LabelNamesPolicy string `envconfig:"default=allow"`
+
+	// LabelNamesFillValue is a value of the labels added with fill policy.
+	LabelNamesFillValue string `envconfig:"default=none"`
+
+	// DeltaMetrics is a regular expression matching names of the counters and gauges exposed in delta mode.
+	// Such counters report sum since the previous delta scrape and gauges report max value in that window.
+	// Empty value disables the mode.
+	DeltaMetrics string `envconfig:"optional"`
+
+	// DeltaScrapePath is a path of the metrics endpoint resetting delta metrics after collection.
+	// Scrapes of the regular endpoint never reset them, so only one scraper should use this path.
+	DeltaScrapePath string `envconfig:"default=/metrics/delta"`
+
+	// GaugeAggregation defines how gauge samples from many clients are combined into single value.
+	// Valid values:
+	// - last: value of the last sample
+	// - sum_of_samples: sum of all samples in the window, client sending many samples is counted many times
+	// - min: min of the samples in the window
+	// - max: max of the samples in the window
+	// - avg: average of the samples in the window
+	GaugeAggregation string `envconfig:"default=last"`
+
+	// GaugeAggregationRules overrides GaugeAggregation for metrics with matching names.
+	// Rules are in "mode=pattern" format, e.g. "max=^queue_.+_length$". First matching rule wins.
+	GaugeAggregationRules []string `envconfig:"optional"`
+
+	// GaugeAggregationWindow is a window after which aggregation of all gauges starts from scratch.
+	// Value from the previous window is exposed until the first sample of the new one. Zero disables the reset.
+	GaugeAggregationWindow time.Duration `envconfig:"default=1m"`
+
+	// SeriesLastUpdate defines how time of the last update of every series is exposed.
+	// Valid values:
+	// - none: time is not exposed
+	// - gauge: companion gauge named <name>_last_update_timestamp_seconds with the same labels
+	// - timestamp: explicit timestamp of the exposed metric
+	SeriesLastUpdate string `envconfig:"default=none"`
+
+	// IngressQueueSize is a number of samples waiting for processing in the queue of the collector (of every tenant).
+	IngressQueueSize int `envconfig:"default=102400"`
+
+	// IngressQueuePolicy defines handling of the samples received when the queue is full.
+	// Dropped samples are counted in app_ingress_samples_dropped_total{reason="queue_full"}.
+	// Valid values:
+	// - drop_newest: received sample is dropped
+	// - block: server waits for space in the queue up to IngressQueueTimeout, packets are not read in the meantime
+	// - drop_oldest: the oldest sample in the queue is dropped
+	IngressQueuePolicy string `envconfig:"default=drop_newest"`
+
+	// IngressQueueTimeout is a max time of waiting for space in the queue with block policy.
+	IngressQueueTimeout time.Duration `envconfig:"default=100ms"`
+
+	// TimestampMaxSkew is a max difference between timestamp sent by the client and the local clock.
+	// Samples with timestamp further away are rejected. Zero disables the check.
+	TimestampMaxSkew time.Duration `envconfig:"default=1m"`
+
+	// SnapshotFile is a path to the file with persisted state of counters, gauges and histograms.
+	// State is restored on start, before samples are accepted. Empty value disables snapshots.
+	SnapshotFile string `envconfig:"optional"`
+
+	// SnapshotInterval is a period between snapshots.
+	SnapshotInterval time.Duration `envconfig:"default=1m"`
+
+	// WALFile is a path to the write-ahead log of the samples accepted since the last snapshot.
+	// Log is replayed on start, on top of the snapshot. Requires SnapshotFile. Empty value disables the log.
+	WALFile string `envconfig:"optional"`
+
+	// WALSyncInterval is a period between syncs of the log to disk. Samples appended in the meantime are synced in batch.
+	WALSyncInterval time.Duration `envconfig:"default=1s"`
+
+	// WALMaxSize is a size of the log in bytes at which it's truncated, so it does not grow forever while snapshots fail.
+	// Samples dropped from the log are persisted only by the next snapshot. Zero disables the limit.
+	WALMaxSize int64 `envconfig:"default=268435456"`
+
+	// ShutdownTimeout is a max time of the graceful shutdown of every collector, final snapshot included.
+	ShutdownTimeout time.Duration `envconfig:"default=10s"`
+
+	// RelabelConfigFile is a path to the YAML file with relabel rules (Prometheus relabel_config format)
+	// applied to every incoming sample. Empty value disables relabeling.
+	RelabelConfigFile string `envconfig:"optional"`
+
+	// MappingConfigFile is a path to the YAML file with mappings of flat metric names (statsd_exporter format).
+	// Mapping is applied before relabeling. Empty value disables mapping.
+	MappingConfigFile string `envconfig:"optional"`
+
+	// FilterConfigFile is a path to the YAML file with allow-list and deny-list of the samples.
+	// Filter is applied after mapping and relabeling. Empty value disables filtering.
+	FilterConfigFile string `envconfig:"optional"`
+
+	// SourceLabel is a name of the label with name of the source (sender of the packet) added to every sample.
+	// Label sent by the client is overwritten. Empty value disables the label.
+	SourceLabel string `envconfig:"optional"`
+
+	// SourceNamesFile is a path to the YAML file mapping networks of the sources to static names.
+	// Sources not matched by any network are named by reverse DNS, if enabled, or by IP address.
+	SourceNamesFile string `envconfig:"optional"`
+
+	// SourceDNSCacheTTL is a time for which name of the source resolved by reverse DNS is cached.
+	// Zero disables reverse DNS.
+	SourceDNSCacheTTL time.Duration `envconfig:"optional"`
+
+	// SeriesTTL is a default time after which series not updated is removed. TTL set by mapping takes precedence.
+	// Zero keeps series forever.
+	SeriesTTL time.Duration `envconfig:"optional"`
+
+	// ConfigFile is a path to the YAML file with listeners, limits, TTL and rules of mapping, relabeling and filtering.
+	// Values in the file take precedence over ENV ones. Config is reloaded on SIGHUP and POST to /-/reload.
+	ConfigFile string `envconfig:"optional"`
 }
 
 func main() {
@@ -68,38 +199,270 @@ func main() {
 		log.Debugf("Processor limiting, Req: %d, MaxAvailable: %d, NumCPU: %d", cfg.MaxProcs, nGot, runtime.NumCPU())
 	}
 
-	switch cfg.SampleHasher {
-	case "prom":
-		sampleHasher = hashProm
-	case "md5":
-		sampleHasher = hashMD5
-	default:
+	hasher, found := sampleHashers[cfg.SampleHasher]
+	if !found {
 		exitOnFatal(errors.New("unknown hashing implementation"), "sampleHasher selection")
 	}
 	log.Debugf("Sample hasher used: %s", cfg.SampleHasher)
 
-	// TODO(szpakas): attach to signals for graceful shutdown and call c.stop()
-	c := newCollector()
+	// -> config file, on top of env
+	fc, err := loadFileConfig(cfg)
+	if err != nil {
+		exitOnFatal(err, "config load")
+	}
+	if cfg.ConfigFile != "" {
+		log.Debugf("Config loaded from: %s, checksum: %s", cfg.ConfigFile, fc.checksum)
+	}
+
+	c := newConfiguredCollector(cfg, hasher)
+
+	// every tenant has its own collector, so series and processing of the tenants are isolated
+	tr := newTenantRouter(&fc.Tenancy, c)
+	for _, tc := range fc.Tenancy.Tenants {
+		if tenantScrapePathPrefix+tc.Name == cfg.DeltaScrapePath {
+			exitOnFatal(errors.Errorf("tenant %s conflicts with DeltaScrapePath", tc.Name), "tenancy init")
+		}
+		tr.add(tc, newConfiguredCollector(cfg, hasher))
+	}
+
+	// mapping, relabeling and filtering are always set-up, so rules can be added on reload
+	mp := newMapper(&mapperConfig{}, tr.writeMetadata)
+	rl := newRelabeler(nil)
+	fl := newFilter(&filterConfig{})
+	sl := newSourceLimiter(&sourceLimitsConfig{})
+	rld := newReloader(cfg, tr.collectors(), mp, rl, fl, sl)
+	// settings are in use before samples from snapshot and log are restored
+	rld.init(fc)
+	log.Debugf("Rules loaded, mappings: %d, relabel: %d, filter allow: %d, deny: %d, tenants: %d",
+		len(fc.Mappings), len(fc.RelabelConfigs), len(fc.Filter.Allow), len(fc.Filter.Deny), len(fc.Tenancy.Tenants))
+
+	restoreCollector(cfg, c, "")
+	for _, t := range tr.tenants {
+		restoreCollector(cfg, t.collector, "."+t.name)
+	}
 	prometheus.MustRegister(c)
-	c.start()
+	prometheus.MustRegister(mp)
+	prometheus.MustRegister(rl)
+	prometheus.MustRegister(fl)
+	prometheus.MustRegister(sl)
+	prometheus.MustRegister(rld)
+	prometheus.MustRegister(tr)
+	for _, tc := range tr.collectors() {
+		tc.start()
+	}
+
+	handler := sampleHandler(tr.write)
+	handler = fl.handler(handler)
+	handler = rl.handler(handler)
+	handler = mp.handler(handler)
+
+	// -> graceful shutdown on SIGTERM and SIGINT, so the final snapshot is written and the log is flushed
+	termCh := make(chan os.Signal, 1)
+	signal.Notify(termCh, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-termCh
+		log.Infof("Received %s, stopping collectors", sig)
+		os.Exit(stopCollectors(tr.collectors()))
+	}()
 
-	s := newServer(c.Write, cfg.UDPBufferSize)
-	log.Infof("Starting ingrees samples server => %s:%d", cfg.UDPHost, cfg.UDPPort)
-	if err := s.Listen(cfg.UDPHost, cfg.UDPPort); err != nil {
+	// -> reload on SIGHUP
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
+	go func() {
+		for range hupCh {
+			if err := rld.reload(); err != nil {
+				log.Errorf("Config reload failed: %s", err)
+				continue
+			}
+			log.Infof("Config reloaded")
+		}
+	}()
+
+	s := newServer(tr.handler(nil, handler), tr.metadataHandler(nil), fc.Limits.UDPBufferSize)
+	s.sourceLimiter = sl
+	if cfg.SourceLabel != "" {
+		s.sourceNamer = newSourceNamerFromConfig(cfg)
+		prometheus.MustRegister(s.sourceNamer)
+	}
+	log.Infof("Starting ingrees samples server => %s:%d", fc.Listeners.UDPHost, fc.Listeners.UDPPort)
+	if err := s.Listen(fc.Listeners.UDPHost, fc.Listeners.UDPPort); err != nil {
 		exitOnFatal(err, "UDP server init")
 	}
+	for _, tc := range fc.Tenancy.Tenants {
+		if tc.UDPPort == 0 {
+			continue
+		}
+		log.Infof("Starting ingrees samples server for tenant %s => %s:%d", tc.Name, fc.Listeners.UDPHost, tc.UDPPort)
+		if err := s.listen(fc.Listeners.UDPHost, tc.UDPPort, tr.handler(tr.byName[tc.Name], handler), tr.metadataHandler(tr.byName[tc.Name])); err != nil {
+			exitOnFatal(err, "UDP server init")
+		}
+	}
 
-	http.Handle("/metrics", prometheus.Handler())
+	metricsHandler := prometheus.Handler()
+	http.Handle("/metrics", c.scrapeHandler(metricsHandler, false))
+	if c.deltaMetrics != nil {
+		http.Handle(cfg.DeltaScrapePath, c.scrapeHandler(metricsHandler, true))
+	}
+	// tenants are scraped from own registries, so they do not see each other
+	for _, t := range tr.tenants {
+		reg := prometheus.NewRegistry()
+		reg.MustRegister(t.collector)
+		tHandler := promhttp.HandlerFor(reg, promhttp.HandlerOpts{})
+		http.Handle(tenantScrapePathPrefix+t.name, t.collector.scrapeHandler(tHandler, false))
+		if t.collector.deltaMetrics != nil {
+			http.Handle(tenantScrapePathPrefix+t.name+"/delta", t.collector.scrapeHandler(tHandler, true))
+		}
+		http.HandleFunc("/debug/conflicts/"+t.name, t.collector.conflictsHandler)
+	}
+	http.HandleFunc("/debug/conflicts", c.conflictsHandler)
+	http.HandleFunc("/-/reload", rld.reloadHandler)
 
 	//prometheus.EnableCollectChecks(true)
 
-	metricsListenOn := fmt.Sprintf("%s:%d", cfg.MetricsHost, cfg.MetricsPort)
+	metricsListenOn := fmt.Sprintf("%s:%d", fc.Listeners.MetricsHost, fc.Listeners.MetricsPort)
 	log.Infof("Starting metrics server => %s", metricsListenOn)
 	if err := http.ListenAndServe(metricsListenOn, nil); err != nil {
 		exitOnFatal(err, "metric server")
 	}
 }
 
+// stopCollectors stops all collectors in parallel. Returns exit code, non-zero if any stop failed.
+func stopCollectors(collectors []*collector) int {
+	var (
+		wg   sync.WaitGroup
+		code int32
+	)
+	for _, c := range collectors {
+		wg.Add(1)
+		go func(c *collector) {
+			defer wg.Done()
+			if err := c.stop(); err != nil {
+				log.Errorf("Collector stop failed: %s", err)
+				atomic.StoreInt32(&code, 1)
+			}
+		}(c)
+	}
+	wg.Wait()
+	return int(code)
+}
+
+// newConfiguredCollector creates collector with settings from ENV config.
+// Settings from the config file are applied later, by reloader.
+func newConfiguredCollector(cfg *config, hasher sampleHasherFunc) *collector {
+	c := newCollector()
+	c.hasher = hasher
+	c.shutdownTimeout = cfg.ShutdownTimeout
+	if cfg.IngressQueueSize <= 0 {
+		exitOnFatal(errors.New("ingress queue size has to be positive"), "ingressQueueSize check")
+	}
+	c.ingressCh = make(chan *sample, cfg.IngressQueueSize)
+	switch p := ingressQueuePolicy(cfg.IngressQueuePolicy); p {
+	case ingressQueuePolicyDropNewest, ingressQueuePolicyDropOldest:
+		c.ingressPolicy = p
+	case ingressQueuePolicyBlock:
+		if cfg.IngressQueueTimeout <= 0 {
+			exitOnFatal(errors.New("ingress queue timeout has to be positive"), "ingressQueueTimeout check")
+		}
+		c.ingressPolicy = p
+	default:
+		exitOnFatal(errors.New("unknown ingress queue policy"), "ingressQueuePolicy selection")
+	}
+	c.ingressTimeout = cfg.IngressQueueTimeout
+	c.setResetInterval = cfg.SetResetInterval
+	gaugeAggregation, ok := parseGaugeAggregation(cfg.GaugeAggregation)
+	if !ok {
+		exitOnFatal(errors.New("unknown gauge aggregation mode"), "gaugeAggregation selection")
+	}
+	c.gaugeAggregation = gaugeAggregation
+	for _, v := range cfg.GaugeAggregationRules {
+		r, err := parseGaugeAggregationRule(v)
+		if err != nil {
+			exitOnFatal(errors.Wrapf(err, "rule %q", v), "gaugeAggregationRules parse")
+		}
+		c.gaugeAggregationRules = append(c.gaugeAggregationRules, r)
+	}
+	c.gaugeAggregationWindow = cfg.GaugeAggregationWindow
+	switch m := seriesLastUpdateMode(cfg.SeriesLastUpdate); m {
+	case seriesLastUpdateNone, seriesLastUpdateGauge, seriesLastUpdateTimestamp:
+		c.lastUpdateMode = m
+	default:
+		exitOnFatal(errors.New("unknown series last update mode"), "seriesLastUpdate selection")
+	}
+	if cfg.DeltaMetrics != "" {
+		re, err := regexp.Compile(cfg.DeltaMetrics)
+		if err != nil {
+			exitOnFatal(err, "deltaMetrics compile")
+		}
+		c.deltaMetrics = re
+	}
+	if cfg.MetadataFile != "" {
+		f, err := os.Open(cfg.MetadataFile)
+		if err != nil {
+			exitOnFatal(err, "metadata file open")
+		}
+		if err := c.metadata.load(f); err != nil {
+			exitOnFatal(err, "metadata file load")
+		}
+		f.Close()
+		log.Debugf("Metadata loaded from: %s", cfg.MetadataFile)
+	}
+	return c
+}
+
+// newSourceNamerFromConfig creates source namer with static names loaded from the file.
+func newSourceNamerFromConfig(cfg *config) *sourceNamer {
+	if !relabelLabelNameRE.MatchString(cfg.SourceLabel) {
+		exitOnFatal(errors.Errorf("invalid label name: %s", cfg.SourceLabel), "sourceLabel check")
+	}
+	names := &sourceNamesConfig{}
+	if cfg.SourceNamesFile != "" {
+		f, err := os.Open(cfg.SourceNamesFile)
+		if err != nil {
+			exitOnFatal(err, "source names file open")
+		}
+		if names, err = loadSourceNamesConfig(f); err != nil {
+			exitOnFatal(err, "source names file load")
+		}
+		f.Close()
+		log.Debugf("Source names loaded from: %s, networks: %d", cfg.SourceNamesFile, len(names.Sources))
+	}
+	return newSourceNamer(cfg.SourceLabel, names, cfg.SourceDNSCacheTTL)
+}
+
+// restoreCollector restores state of the collector from the snapshot and the log, if enabled.
+// Paths of the files are suffixed, so every tenant has its own ones.
+func restoreCollector(cfg *config, c *collector, suffix string) {
+	if cfg.SnapshotFile != "" {
+		c.snapshotFile = cfg.SnapshotFile + suffix
+	}
+	c.snapshotInterval = cfg.SnapshotInterval
+	if c.snapshotFile != "" {
+		switch snap, err := readSnapshot(c.snapshotFile); {
+		case os.IsNotExist(err):
+			log.Infof("Snapshot not found, starting from scratch: %s", c.snapshotFile)
+		case err != nil:
+			exitOnFatal(err, "snapshot load")
+		default:
+			c.restore(snap)
+			log.Infof("Snapshot restored: %s, series: %d, created: %s", c.snapshotFile, len(snap.Series), snap.Created)
+		}
+	}
+	if cfg.WALFile != "" {
+		// log is truncated only after the snapshot, without it the log would grow forever
+		if cfg.SnapshotFile == "" {
+			exitOnFatal(errors.New("WALFile requires SnapshotFile"), "wal init")
+		}
+		c.walSyncInterval = cfg.WALSyncInterval
+		c.walMaxSize = cfg.WALMaxSize
+		walFile := cfg.WALFile + suffix
+		n, err := c.openWAL(walFile)
+		if err != nil {
+			exitOnFatal(err, "wal replay")
+		}
+		log.Infof("WAL replayed: %s, samples: %d", walFile, n)
+	}
+}
+
 func exitOnFatal(err error, loc string) {
 	log.Fatalf("EXIT on %s: err=%s\n", loc, err)
 	syscall.Exit(1)
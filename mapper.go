@@ -0,0 +1,345 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v2"
+)
+
+// mappingMatchType defines how the match of the mapping is interpreted.
+type mappingMatchType string
+
+const (
+	// mappingMatchGlob matches dot separated segments of the name, * matches single segment.
+	mappingMatchGlob mappingMatchType = "glob"
+
+	// mappingMatchRegex matches whole name with regular expression.
+	mappingMatchRegex mappingMatchType = "regex"
+
+	// mappingActionMap replaces name and adds labels.
+	mappingActionMap = "map"
+
+	// mappingActionDrop drops the sample.
+	mappingActionDrop = "drop"
+
+	// mapperHelpSentSize bounds number of the metric names remembered as having help sent.
+	mapperHelpSentSize = 10000
+)
+
+// ErrMappingInvalid is returned when mapping is not valid.
+var ErrMappingInvalid = errors.New("mapper: invalid mapping")
+
+// mapperConfig is a content of the mapping file. Format follows statsd_exporter mapping config.
+type mapperConfig struct {
+	Mappings []*mapping `yaml:"mappings"`
+}
+
+// mapping converts flat metric name to the name with labels.
+// Name, label values and help can refer to groups captured by match ($1, ${1}).
+type mapping struct {
+	Match     string            `yaml:"match"`
+	MatchType mappingMatchType  `yaml:"match_type"`
+	Action    string            `yaml:"action"`
+	Name      string            `yaml:"name"`
+	Labels    map[string]string `yaml:"labels"`
+
+	// Kind overrides kind of the sample, uses symbols of the ingress format
+	Kind sampleKind `yaml:"kind"`
+	// Histogram overrides histogram definition (type config of the ingress format)
+	Histogram string `yaml:"histogram"`
+	// Summary overrides summary definition (type config of the ingress format)
+	Summary string `yaml:"summary"`
+	// Help is sent as HELP metadata of the metric
+	Help string `yaml:"help"`
+	// TTL is a time after which series not updated is removed. Zero keeps series forever.
+	TTL time.Duration `yaml:"ttl"`
+
+	regex        *regexp.Regexp
+	histogramDef []string
+	summaryDef   []string
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler. Sets defaults of the missing fields.
+func (m *mapping) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain mapping
+	*m = mapping{
+		MatchType: mappingMatchGlob,
+		Action:    mappingActionMap,
+	}
+	return unmarshal((*plain)(m))
+}
+
+// compile validates the mapping and prepares it for use.
+func (m *mapping) compile() error {
+	var expr string
+	switch m.MatchType {
+	case mappingMatchGlob:
+		segments := strings.Split(m.Match, "*")
+		for i := range segments {
+			segments[i] = regexp.QuoteMeta(segments[i])
+		}
+		expr = strings.Join(segments, `([^.]*)`)
+	case mappingMatchRegex:
+		expr = m.Match
+	default:
+		return errors.Wrapf(ErrMappingInvalid, "unknown match type: %s", m.MatchType)
+	}
+
+	re, err := regexp.Compile("^(?:" + expr + ")$")
+	if err != nil {
+		return errors.Wrapf(ErrMappingInvalid, "match: %s", err)
+	}
+	m.regex = re
+
+	if m.Action == mappingActionDrop {
+		return nil
+	}
+	if m.Action != mappingActionMap {
+		return errors.Wrapf(ErrMappingInvalid, "unknown action: %s", m.Action)
+	}
+
+	if m.Name == "" {
+		return errors.Wrap(ErrMappingInvalid, "name required")
+	}
+	for ln := range m.Labels {
+		if !relabelLabelNameRE.MatchString(ln) {
+			return errors.Wrapf(ErrMappingInvalid, "label name: %s", ln)
+		}
+	}
+
+	// definitions are checked the same way as ones sent by clients
+	if m.Histogram != "" {
+		m.histogramDef = strings.Split(m.Histogram, sampleParserHistogramDefSeparator)
+		var err error
+		switch m.Kind {
+		case sampleHistogramNative:
+			_, err = nativeHistogramDefOf(&sample{kind: m.Kind, histogramDef: m.histogramDef})
+		case sampleHistogramExponential:
+			_, err = histogramBuckets(&sample{kind: m.Kind, histogramDef: m.histogramDef})
+		default:
+			_, err = histogramBuckets(&sample{kind: sampleHistogramLinear, histogramDef: m.histogramDef})
+		}
+		if err != nil {
+			return errors.Wrap(ErrMappingInvalid, "histogram")
+		}
+	}
+	if m.Summary != "" {
+		m.summaryDef = strings.Split(m.Summary, sampleParserSummaryDefSeparator)
+		if _, _, err := summaryOpts(&sample{summaryDef: m.summaryDef}); err != nil {
+			return errors.Wrap(ErrMappingInvalid, "summary")
+		}
+	}
+
+	switch m.Kind {
+	case sampleUnknown, sampleCounter, sampleGauge:
+	case sampleHistogramLinear, sampleHistogramExponential, sampleHistogramNative:
+		if m.histogramDef == nil {
+			return errors.Wrap(ErrMappingInvalid, "histogram required for histogram kind")
+		}
+	case sampleSummary:
+		if m.summaryDef == nil {
+			return errors.Wrap(ErrMappingInvalid, "summary required for summary kind")
+		}
+	default:
+		// sets have members instead of values, they can not be converted
+		return errors.Wrapf(ErrMappingInvalid, "unsupported kind: %s", m.Kind)
+	}
+
+	return nil
+}
+
+// loadMapperConfig reads mapping file in YAML.
+func loadMapperConfig(in io.Reader) (*mapperConfig, error) {
+	b, err := ioutil.ReadAll(in)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg mapperConfig
+	if err := yaml.UnmarshalStrict(b, &cfg); err != nil {
+		return nil, errors.Wrap(err, "mapper: parse")
+	}
+
+	if err := compileMappings(cfg.Mappings); err != nil {
+		return nil, err
+	}
+
+	return &cfg, nil
+}
+
+// compileMappings validates all mappings and prepares them for use.
+func compileMappings(mappings []*mapping) error {
+	for i, m := range mappings {
+		if err := m.compile(); err != nil {
+			return errors.Wrapf(err, "mapping %d (%s)", i, m.Match)
+		}
+	}
+	return nil
+}
+
+// mapper converts flat metric names (e.g. sent by legacy statsd clients) to names with labels.
+// First matching mapping wins. Names not matched by any mapping have invalid characters replaced with underscore.
+type mapper struct {
+	// mu guards mappings and helpSent, which are replaced on reload
+	mu       sync.Mutex
+	mappings []*mapping
+
+	// metadataHandler receives help of the mapped metrics
+	metadataHandler metadataHandler
+	// helpSent holds names of the metrics with help already sent
+	helpSent map[string]struct{}
+
+	metricSamplesMapped  prometheus.Counter
+	metricSamplesDropped prometheus.Counter
+}
+
+func newMapper(cfg *mapperConfig, mHandler metadataHandler) *mapper {
+	return &mapper{
+		mappings:        cfg.Mappings,
+		metadataHandler: mHandler,
+		helpSent:        make(map[string]struct{}),
+		metricSamplesMapped: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "app_mapper_samples_mapped_total",
+				Help: "Number of samples matched by the mapping.",
+			},
+		),
+		metricSamplesDropped: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "app_mapper_samples_dropped_total",
+				Help: "Number of samples dropped by the mapping.",
+			},
+		),
+	}
+}
+
+// setMappings replaces mappings applied to the following samples. Help of the metrics is sent again.
+func (mp *mapper) setMappings(mappings []*mapping) {
+	mp.mu.Lock()
+	mp.mappings = mappings
+	mp.helpSent = make(map[string]struct{})
+	mp.mu.Unlock()
+}
+
+// mapSample applies first matching mapping to the sample.
+// Name is escaped also if there are no mappings.
+// Returns nil if the sample is dropped.
+func (mp *mapper) mapSample(s *sample) *sample {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	for _, m := range mp.mappings {
+		indexes := m.regex.FindStringSubmatchIndex(s.name)
+		if indexes == nil {
+			continue
+		}
+
+		if m.Action == mappingActionDrop {
+			mp.metricSamplesDropped.Inc()
+			return nil
+		}
+		mp.metricSamplesMapped.Inc()
+
+		out := *s
+		out.name = escapeMetricName(string(m.regex.ExpandString(nil, m.Name, s.name, indexes)))
+		out.labels = make(map[string]string, len(s.labels)+len(m.Labels))
+		for ln, lv := range s.labels {
+			out.labels[ln] = lv
+		}
+		for ln, tmpl := range m.Labels {
+			out.labels[ln] = string(m.regex.ExpandString(nil, tmpl, s.name, indexes))
+		}
+
+		// sets and pre-aggregated histograms have no single value to be converted
+		if m.Kind != sampleUnknown && s.kind != sampleSet && s.aggregate == nil {
+			out.kind = m.Kind
+		}
+		switch out.kind {
+		case sampleHistogramLinear, sampleHistogramExponential, sampleHistogramNative:
+			if m.histogramDef != nil {
+				out.histogramDef = m.histogramDef
+			}
+		case sampleSummary:
+			if m.summaryDef != nil {
+				out.summaryDef = m.summaryDef
+			}
+		}
+		if m.TTL > 0 {
+			out.ttl = m.TTL
+		}
+
+		if m.Help != "" {
+			mp.sendHelp(out.name, string(m.regex.ExpandString(nil, m.Help, s.name, indexes)))
+		}
+
+		return &out
+	}
+
+	if name := escapeMetricName(s.name); name != s.name {
+		out := *s
+		out.name = name
+		return &out
+	}
+	return s
+}
+
+// sendHelp passes help of the metric to the metadata handler, once per metric.
+// Names are forgotten when there are too many of them (names can be built from parts of the flat name),
+// help is sent again then, which is harmless as the same help is not a conflict.
+func (mp *mapper) sendHelp(name, help string) {
+	if _, found := mp.helpSent[name]; found || mp.metadataHandler == nil {
+		return
+	}
+	if len(mp.helpSent) >= mapperHelpSentSize {
+		mp.helpSent = make(map[string]struct{})
+	}
+	mp.helpSent[name] = struct{}{}
+	mp.metadataHandler(&metadata{name: name, kind: metadataHelp, value: help})
+}
+
+// handler wraps sample handler so samples are mapped first. Dropped samples are not passed on.
+func (mp *mapper) handler(next sampleHandler) sampleHandler {
+	return func(s *sample) error {
+		if s = mp.mapSample(s); s == nil {
+			return nil
+		}
+		return next(s)
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (mp *mapper) Describe(ch chan<- *prometheus.Desc) {
+	mp.metricSamplesMapped.Describe(ch)
+	mp.metricSamplesDropped.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (mp *mapper) Collect(ch chan<- prometheus.Metric) {
+	mp.metricSamplesMapped.Collect(ch)
+	mp.metricSamplesDropped.Collect(ch)
+}
+
+// escapeMetricName replaces characters not allowed in metric names with underscore.
+// Name starting with a digit is prefixed with underscore. Empty name stays empty, it's rejected by the collector.
+func escapeMetricName(name string) string {
+	if name == "" || metricNameValid(name) {
+		return name
+	}
+	b := []byte(name)
+	for i, c := range b {
+		if !metricNameChar(c) {
+			b[i] = '_'
+		}
+	}
+	if metricNameDigit(b[0]) {
+		b = append([]byte{'_'}, b...)
+	}
+	return string(b)
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+
+	a "github.com/stretchr/testify/assert"
+)
+
+func thMapper(t *testing.T, config string, mHandler metadataHandler) *mapper {
+	cfg, err := loadMapperConfig(strings.NewReader(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newMapper(cfg, mHandler)
+}
+
+func Test_Mapper_MapSample(t *testing.T) {
+	config := `
+mappings:
+- match: api.*.requests.*
+  name: api_requests_total
+  labels:
+    service: $1
+    method: $2
+- match: api\.(.+)\.duration
+  match_type: regex
+  name: api_${1}_duration_seconds
+  kind: hl
+  histogram: 0.1;0.1;10
+  ttl: 5m
+- match: debug.*
+  action: drop
+- match: num.*
+  name: ${1}_total
+`
+	cases := map[string]struct {
+		in  *sample
+		exp *sample
+	}{
+		"glob": {
+			&sample{name: "api.users.requests.GET", kind: sampleCounter, labels: map[string]string{"host": "hostA"}, value: 1},
+			&sample{name: "api_requests_total", kind: sampleCounter, labels: map[string]string{"host": "hostA", "service": "users", "method": "GET"}, value: 1},
+		},
+		"glob does not match across segments": {
+			&sample{name: "api.users.v2.requests.GET", kind: sampleCounter, labels: map[string]string{}, value: 1},
+			&sample{name: "api_users_v2_requests_GET", kind: sampleCounter, labels: map[string]string{}, value: 1},
+		},
+		"regex with kind override": {
+			&sample{name: "api.users.duration", kind: sampleGauge, labels: map[string]string{}, value: 0.25},
+			&sample{
+				name: "api_users_duration_seconds", kind: sampleHistogramLinear, labels: map[string]string{}, value: 0.25,
+				histogramDef: []string{"0.1", "0.1", "10"}, ttl: 5 * time.Minute,
+			},
+		},
+		"set is not converted": {
+			&sample{name: "api.users.duration", kind: sampleSet, labels: map[string]string{}, member: "user1"},
+			&sample{name: "api_users_duration_seconds", kind: sampleSet, labels: map[string]string{}, member: "user1", ttl: 5 * time.Minute},
+		},
+		"not matching is escaped": {
+			&sample{name: "web.GET-users", kind: sampleCounter, labels: map[string]string{}, value: 1},
+			&sample{name: "web_GET_users", kind: sampleCounter, labels: map[string]string{}, value: 1},
+		},
+		"valid name is passed as is": {
+			&sample{name: "name_of_1_metric_total", kind: sampleCounter, labels: map[string]string{}, value: 1},
+			&sample{name: "name_of_1_metric_total", kind: sampleCounter, labels: map[string]string{}, value: 1},
+		},
+		"drop": {
+			&sample{name: "debug.requests", kind: sampleCounter, labels: map[string]string{}, value: 1},
+			nil,
+		},
+		"leading digit is escaped": {
+			&sample{name: "num.9requests", kind: sampleCounter, labels: map[string]string{}, value: 1},
+			&sample{name: "_9requests_total", kind: sampleCounter, labels: map[string]string{}, value: 1},
+		},
+	}
+
+	for k, tc := range cases {
+		mp := thMapper(t, config, nil)
+		a.Equal(t, tc.exp, mp.mapSample(tc.in), k)
+	}
+
+	// names are escaped also without mappings
+	mp := thMapper(t, `mappings: []`, nil)
+	a.Equal(t, &sample{name: "web_GET_users", kind: sampleCounter, labels: map[string]string{}, value: 1},
+		mp.mapSample(&sample{name: "web.GET-users", kind: sampleCounter, labels: map[string]string{}, value: 1}))
+}
+
+func Test_Mapper_Metrics(t *testing.T) {
+	mp := thMapper(t, `
+mappings:
+- match: api.*
+  name: api_$1_total
+- match: debug.*
+  action: drop
+`, nil)
+
+	mp.mapSample(&sample{name: "api.requests", kind: sampleCounter, labels: map[string]string{}})
+	mp.mapSample(&sample{name: "debug.requests", kind: sampleCounter, labels: map[string]string{}})
+	mp.mapSample(&sample{name: "web.requests", kind: sampleCounter, labels: map[string]string{}})
+
+	var mm dto.Metric
+	mp.metricSamplesMapped.Write(&mm)
+	a.Equal(t, float64(1), mm.Counter.GetValue())
+	mp.metricSamplesDropped.Write(&mm)
+	a.Equal(t, float64(1), mm.Counter.GetValue())
+}
+
+func Test_Mapper_Help(t *testing.T) {
+	var got []*metadata
+	mp := thMapper(t, `
+mappings:
+- match: api.*
+  name: api_requests_total
+  help: Number of requests to $1.
+`, func(m *metadata) error {
+		got = append(got, m)
+		return nil
+	})
+
+	h := mp.handler(func(s *sample) error { return nil })
+	h(&sample{name: "api.users", kind: sampleCounter, labels: map[string]string{}})
+	h(&sample{name: "api.users", kind: sampleCounter, labels: map[string]string{}})
+	h(&sample{name: "api.orders", kind: sampleCounter, labels: map[string]string{}})
+
+	a.Equal(t, []*metadata{{name: "api_requests_total", kind: metadataHelp, value: "Number of requests to users."}}, got)
+}
+
+func Test_Mapper_Help_Bounded(t *testing.T) {
+	sent := 0
+	mp := thMapper(t, `
+mappings:
+- match: api.*
+  name: api_${1}_total
+  help: Number of requests to $1.
+`, func(m *metadata) error {
+		sent++
+		return nil
+	})
+
+	for i := 0; i < mapperHelpSentSize+10; i++ {
+		mp.mapSample(&sample{name: fmt.Sprintf("api.service%d", i), kind: sampleCounter, labels: map[string]string{}})
+	}
+	a.Equal(t, mapperHelpSentSize+10, sent)
+	a.Len(t, mp.helpSent, 10)
+}
+
+func Test_LoadMapperConfig_Invalid(t *testing.T) {
+	for _, config := range []string{
+		`mappings: [{match: "a.*", match_type: unknown, name: a}]`,
+		`mappings: [{match: "(", match_type: regex, name: a}]`,
+		`mappings: [{match: "a.*", action: unknown, name: a}]`,
+		`mappings: [{match: "a.*"}]`,
+		`mappings: [{match: "a.*", name: a, labels: {invalid-label: v}}]`,
+		`mappings: [{match: "a.*", name: a, kind: hl}]`,
+		`mappings: [{match: "a.*", name: a, kind: hl, histogram: "1;a;1"}]`,
+		`mappings: [{match: "a.*", name: a, kind: sm, summary: "a"}]`,
+		`mappings: [{match: "a.*", name: a, kind: hn}]`,
+		`mappings: [{match: "a.*", name: a, kind: hn, histogram: "9;0"}]`,
+		`mappings: [{match: "a.*", name: a, kind: s}]`,
+		`mappings: [{match: "a.*", name: a, lables: {b: c}}]`,
+		`not a map`,
+	} {
+		_, err := loadMapperConfig(strings.NewReader(config))
+		a.Error(t, err, config)
+	}
+}
+
+func Test_Collector_ProcessSample_InvalidName(t *testing.T) {
+	c := newCollector()
+	c.hasher = hashMD5
+
+	c.processSample(&sample{name: "api.requests", kind: sampleCounter, labels: map[string]string{}, value: 1})
+	c.processSample(&sample{name: "9requests_total", kind: sampleCounter, labels: map[string]string{}, value: 1})
+	c.processSample(&sample{name: "", kind: sampleCounter, labels: map[string]string{}, value: 1})
+	c.processSample(&sample{name: "job:requests:rate5m", kind: sampleGauge, labels: map[string]string{}, value: 1})
+
+	a.Len(t, c.counters, 0)
+	a.Len(t, c.gauges, 1)
+	var mm dto.Metric
+	c.metricSamplesRejected.WithLabelValues("invalid_name").Write(&mm)
+	a.Equal(t, float64(3), mm.Counter.GetValue())
+}
+
+func Test_Collector_ExpireSeries(t *testing.T) {
+	c := newCollector()
+	c.hasher = hashMD5
+
+	sA := &sample{name: "name_of_1_metric_total", kind: sampleCounter, labels: map[string]string{"labelA": "valueA"}, value: 1, ttl: time.Minute}
+	sB := &sample{name: "name_of_1_metric_total", kind: sampleCounter, labels: map[string]string{"labelA": "valueB"}, value: 1}
+	c.processSample(sA)
+	c.processSample(sB)
+
+	c.expireSeries(time.Now())
+	a.Len(t, c.counters, 2)
+
+	c.expireSeries(time.Now().Add(2 * time.Minute))
+	a.Len(t, c.counters, 1)
+	a.Contains(t, c.counters, string(c.hasher(sB)))
+	a.Len(t, c.identities, 1)
+	a.Len(t, c.expiries, 0)
+
+	var mm dto.Metric
+	c.metricSeriesExpired.Write(&mm)
+	a.Equal(t, float64(1), mm.Counter.GetValue())
+
+	// series is created again from scratch
+	c.processSample(sA)
+	c.counters[string(c.hasher(sA))].Write(&mm)
+	a.Equal(t, float64(1), mm.Counter.GetValue())
+	a.Equal(t, 2, c.families["name_of_1_metric_total"].series)
+}
+
+func Test_Collector_ExpireSeries_Family(t *testing.T) {
+	c := newCollector()
+	c.hasher = hashMD5
+
+	sA := &sample{name: "name_of_1_metric", kind: sampleCounter, labels: map[string]string{"labelA": "valueA"}, value: 1, ttl: time.Minute}
+	c.processSample(sA)
+	c.expireSeries(time.Now().Add(2 * time.Minute))
+	a.Len(t, c.families, 0, "family is removed with its last series")
+
+	// metric is created again with different kind and labels
+	sB := &sample{name: "name_of_1_metric", kind: sampleGauge, labels: map[string]string{"labelB": "valueB"}, value: 3}
+	c.processSample(sB)
+
+	a.Len(t, c.counters, 0)
+	if !a.Contains(t, c.gauges, string(c.hasher(sB))) {
+		t.FailNow()
+	}
+	var mm dto.Metric
+	c.gauges[string(c.hasher(sB))].Write(&mm)
+	a.Equal(t, float64(3), mm.Gauge.GetValue())
+	a.Equal(t, sampleGauge, c.families["name_of_1_metric"].kind)
+
+	c.metricConflicts.WithLabelValues(familyConflictKind).Write(&mm)
+	a.Equal(t, float64(0), mm.Counter.GetValue())
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// metadataHelpDefault is used as help for metrics without metadata.
+	metadataHelpDefault = "auto"
+
+	// metadataRegistrySize bounds number of the metrics described in the registry.
+	metadataRegistrySize = 10000
+)
+
+var (
+	// ErrMetadataHelpConflict is returned when metric already has different help assigned.
+	ErrMetadataHelpConflict = errors.New("metadata: help conflict")
+
+	// ErrMetadataUnitConflict is returned when metric already has different unit assigned.
+	ErrMetadataUnitConflict = errors.New("metadata: unit conflict")
+
+	// ErrMetadataRegistryFull is returned when metric is not described yet and the registry is full.
+	ErrMetadataRegistryFull = errors.New("metadata: registry is full")
+)
+
+type metadataKind string
+
+const (
+	// metadataHelp represents description of the metric
+	metadataHelp metadataKind = "HELP"
+
+	// metadataUnit represents unit of the metric
+	metadataUnit metadataKind = "UNIT"
+)
+
+// metadata represents single piece of information describing metric.
+type metadata struct {
+	// name of the metric described
+	name string
+
+	kind metadataKind
+
+	value string
+
+	// labels are shared labels of the packet, used only to assign metadata to the tenant
+	labels map[string]string
+}
+
+type metadataEntry struct {
+	help string
+	unit string
+}
+
+// metadataRegistry holds descriptions of metrics keyed by metric name.
+// First value set for the metric wins, later different values are reported as conflicts.
+// Number of the metrics is bounded, metadata of new metrics is rejected when the registry is full.
+type metadataRegistry struct {
+	mu      sync.RWMutex
+	entries map[string]metadataEntry
+}
+
+func newMetadataRegistry() *metadataRegistry {
+	return &metadataRegistry{
+		entries: make(map[string]metadataEntry),
+	}
+}
+
+// set adds metadata to the registry.
+// Will result in ErrMetadataHelpConflict or ErrMetadataUnitConflict error if metric is already described differently.
+// Will result in ErrMetadataRegistryFull error if metric is not described yet and the registry is full.
+// The registry is not modified in such cases.
+func (r *metadataRegistry) set(m *metadata) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	e, found := r.entries[m.name]
+	if !found && len(r.entries) >= metadataRegistrySize {
+		return ErrMetadataRegistryFull
+	}
+
+	switch m.kind {
+	case metadataHelp:
+		if e.help != "" && e.help != m.value {
+			return ErrMetadataHelpConflict
+		}
+		e.help = m.value
+	case metadataUnit:
+		if e.unit != "" && e.unit != m.value {
+			return ErrMetadataUnitConflict
+		}
+		e.unit = m.value
+	}
+
+	r.entries[m.name] = e
+	return nil
+}
+
+// help returns help for the metric. Unit, if known, is appended as text exposition format has no place for it.
+func (r *metadataRegistry) help(name string) string {
+	r.mu.RLock()
+	e, found := r.entries[name]
+	r.mu.RUnlock()
+
+	if !found {
+		return metadataHelpDefault
+	}
+
+	help := e.help
+	if help == "" {
+		help = metadataHelpDefault
+	}
+	if e.unit != "" {
+		help += " (unit: " + e.unit + ")"
+	}
+	return help
+}
+
+// load reads metadata in ingress format. Lines other than metadata are ignored.
+func (r *metadataRegistry) load(in io.Reader) error {
+	_, entries, err := parseSample(in)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range entries {
+		if err := r.set(m); err != nil {
+			return errors.Wrapf(err, "metric %s", m.name)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	a "github.com/stretchr/testify/assert"
+)
+
+func Test_MetadataRegistry_Help(t *testing.T) {
+	r := newMetadataRegistry()
+	a.NoError(t, r.set(&metadata{name: "m_seconds", kind: metadataHelp, value: "Time spent."}))
+	a.NoError(t, r.set(&metadata{name: "m_seconds", kind: metadataUnit, value: "seconds"}))
+	a.NoError(t, r.set(&metadata{name: "m_total", kind: metadataHelp, value: "Number of requests."}))
+	a.NoError(t, r.set(&metadata{name: "m_bytes", kind: metadataUnit, value: "bytes"}))
+
+	a.Equal(t, "Time spent. (unit: seconds)", r.help("m_seconds"))
+	a.Equal(t, "Number of requests.", r.help("m_total"))
+	a.Equal(t, "auto (unit: bytes)", r.help("m_bytes"))
+	a.Equal(t, "auto", r.help("m_unknown"))
+}
+
+func Test_MetadataRegistry_Set_Conflict(t *testing.T) {
+	r := newMetadataRegistry()
+	a.NoError(t, r.set(&metadata{name: "m_total", kind: metadataHelp, value: "Number of requests."}))
+	a.NoError(t, r.set(&metadata{name: "m_total", kind: metadataUnit, value: "requests"}))
+
+	// same values are not conflicts
+	a.NoError(t, r.set(&metadata{name: "m_total", kind: metadataHelp, value: "Number of requests."}))
+	a.NoError(t, r.set(&metadata{name: "m_total", kind: metadataUnit, value: "requests"}))
+
+	a.Equal(t, ErrMetadataHelpConflict, r.set(&metadata{name: "m_total", kind: metadataHelp, value: "Other."}))
+	a.Equal(t, ErrMetadataUnitConflict, r.set(&metadata{name: "m_total", kind: metadataUnit, value: "calls"}))
+
+	// first values are kept
+	a.Equal(t, "Number of requests. (unit: requests)", r.help("m_total"))
+}
+
+func Test_MetadataRegistry_Set_Full(t *testing.T) {
+	r := newMetadataRegistry()
+	for i := 0; i < metadataRegistrySize; i++ {
+		r.entries[fmt.Sprintf("m_%d_total", i)] = metadataEntry{help: "Number of requests."}
+	}
+
+	a.Equal(t, ErrMetadataRegistryFull, r.set(&metadata{name: "m_new_total", kind: metadataHelp, value: "Number of requests."}))
+	a.Equal(t, "auto", r.help("m_new_total"))
+	// metrics already known can be still described
+	a.NoError(t, r.set(&metadata{name: "m_0_total", kind: metadataUnit, value: "requests"}))
+	a.Len(t, r.entries, metadataRegistrySize)
+}
+
+func Test_MetadataRegistry_Load(t *testing.T) {
+	r := newMetadataRegistry()
+	err := r.load(strings.NewReader(`#HELP m_seconds Time spent on handling the request.
+#UNIT m_seconds seconds
+name_of_1_metric_total|c|1
+#HELP m_total Number of requests.`))
+	if !a.NoError(t, err) {
+		t.FailNow()
+	}
+
+	a.Equal(t, "Time spent on handling the request. (unit: seconds)", r.help("m_seconds"))
+	a.Equal(t, "Number of requests.", r.help("m_total"))
+
+	err = r.load(strings.NewReader(`#HELP m_total Other.`))
+	a.Error(t, err)
+}
@@ -1,9 +1,10 @@
 package main
 
-type sampleHasherFunc func(*sample) []byte
+import "time"
 
-// sampleHasher is a hashing function used on samples.
-var sampleHasher sampleHasherFunc
+// sampleHasherFunc is a hashing function used on samples.
+// Should take all elements other than value under consideration.
+type sampleHasherFunc func(*sample) []byte
 
 type sampleKind string
 
@@ -19,6 +20,22 @@ const (
 	// sampleHistogramLinear represents histogram with linearly spaced buckets.
 	// See Prometheus Go client LinearBuckets for details.
 	sampleHistogramLinear sampleKind = "hl"
+
+	// sampleHistogramExponential represents histogram with exponentially spaced buckets.
+	// See Prometheus Go client ExponentialBuckets for details.
+	sampleHistogramExponential sampleKind = "he"
+
+	// sampleHistogramNative represents Prometheus native histogram with sparse, exponentially growing buckets.
+	// Definition holds schema (resolution) and zero threshold.
+	sampleHistogramNative sampleKind = "hn"
+
+	// sampleSummary represents summary with quantiles calculated over sliding time window.
+	// See Prometheus Go client SummaryOpts for details.
+	sampleSummary sampleKind = "sm"
+
+	// sampleSet represents number of unique members seen in the current window.
+	// Members are counted approximately (HyperLogLog) and exposed as a gauge.
+	sampleSet sampleKind = "s"
 )
 
 // sample represents single measurement submitted to the system.
@@ -36,12 +53,71 @@ type sample struct {
 	// value of the sample
 	value float64
 
+	// member of the set. Used instead of value for the set type.
+	member string
+
+	// aggregate is a histogram pre-aggregated by the client. Used instead of value for histogram types.
+	aggregate *histogramAggregate
+
+	// rate is a sampling rate used by the client, in (0, 1] range.
+	// Zero means the sample was not sampled. Used only with counters and histograms.
+	rate float64
+
+	// timestamp is a time of the measurement sent by the client. Zero if not sent.
+	timestamp time.Time
+
+	// ttl is a time after which the series is removed if not updated. Zero keeps the series forever.
+	ttl time.Duration
+	// tenant is a name of the tenant owning the sample. Empty for the default one.
+	tenant string
+
 	// histogramDef is a set of values used in mapping for the histogram types
 	histogramDef []string
+
+	// summaryDef is a set of values used in mapping for the summary type.
+	// First element is a max age in seconds, rest are objectives in quantile:error form.
+	summaryDef []string
 }
 
-// hash calculates a hash of the sample so it can be recognized.
-// Should take all elements other than value under consideration.
-func (s *sample) hash() []byte {
-	return sampleHasher(s)
+// histogramAggregate represents histogram pre-aggregated on the client side.
+type histogramAggregate struct {
+	// counts are non-cumulative numbers of observations in buckets with finite upper bounds
+	counts []uint64
+
+	// sum of all observations
+	sum float64
+
+	// count of all observations, including ones above the last finite bucket
+	count uint64
+}
+
+// weight returns number of observations represented by the sample, taking sampling rate into account.
+func (s *sample) weight() float64 {
+	if s.rate == 0 {
+		return 1
+	}
+	return 1 / s.rate
+}
+
+// metricNameValid checks if name can be used as Prometheus metric name: ^[a-zA-Z_:][a-zA-Z0-9_:]*$
+// Flat (e.g. dot separated) names are accepted by the parser but have to be mapped to valid ones.
+func metricNameValid(name string) bool {
+	if name == "" || metricNameDigit(name[0]) {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if !metricNameChar(name[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func metricNameChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || metricNameDigit(c) || c == '_' || c == ':'
+}
+
+// metricNameDigit checks for digits, which are not allowed as the first character of the name.
+func metricNameDigit(c byte) bool {
+	return c >= '0' && c <= '9'
 }
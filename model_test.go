@@ -8,7 +8,7 @@ import (
 )
 
 func Test_Sample_Hash_MD5(t *testing.T) {
-	// TODO(szpakas): add gauges and histograms
+	// TODO(szpakas): add gauges
 	testCases := map[string]struct {
 		s  sample
 		hD []byte
@@ -37,6 +37,24 @@ func Test_Sample_Hash_MD5(t *testing.T) {
 			},
 			[]byte("c|name_of_1_metric_total"),
 		},
+		"histogram": {
+			sample{
+				name: "name_of_1_metric_seconds", kind: sampleHistogramLinear,
+				labels:       map[string]string{"service": "srvA1"},
+				histogramDef: []string{"3.3", "2.0", "5"},
+				value:        12.345,
+			},
+			[]byte("hl|name_of_1_metric_seconds|service=srvA1|3.3;2.0;5"),
+		},
+		"histogram, no labels": {
+			sample{
+				name: "name_of_1_metric_seconds", kind: sampleHistogramLinear,
+				labels:       map[string]string{},
+				histogramDef: []string{"3.3", "2.0", "5"},
+				value:        12.345,
+			},
+			[]byte("hl|name_of_1_metric_seconds|3.3;2.0;5"),
+		},
 	}
 
 	for k, tC := range testCases {
@@ -45,3 +63,42 @@ func Test_Sample_Hash_MD5(t *testing.T) {
 		a.Equal(t, h.Sum([]byte{}), hashMD5(&tC.s), "[%s] hash creation mismatch", k)
 	}
 }
+
+func Test_Sample_Hash_Prom_HistogramDef(t *testing.T) {
+	s1 := sample{
+		name: "name_of_1_metric_seconds", kind: sampleHistogramLinear,
+		labels:       map[string]string{"service": "srvA1"},
+		histogramDef: []string{"3.3", "2.0", "5"},
+	}
+	s2 := s1
+	s2.histogramDef = []string{"3.3", "2.0", "6"}
+
+	a.NotEqual(t, hashProm(&s1), hashProm(&s2))
+}
+
+func Test_SeriesIdentity_Matches(t *testing.T) {
+	s := sample{
+		name: "name_of_1_metric_seconds", kind: sampleHistogramLinear,
+		labels:       map[string]string{"service": "srvA1"},
+		histogramDef: []string{"3.3", "2.0", "5"},
+	}
+	id := newSeriesIdentity(&s)
+
+	sValue := s
+	sValue.value = 2
+	sKind := s
+	sKind.kind = sampleHistogramExponential
+	sName := s
+	sName.name = "name_of_2_metric_seconds"
+	sLabels := s
+	sLabels.labels = map[string]string{"service": "srvA2"}
+	sDef := s
+	sDef.histogramDef = []string{"3.3", "2.0", "6"}
+
+	a.True(t, id.matches(&s))
+	a.True(t, id.matches(&sValue))
+	a.False(t, id.matches(&sKind))
+	a.False(t, id.matches(&sName))
+	a.False(t, id.matches(&sLabels))
+	a.False(t, id.matches(&sDef))
+}
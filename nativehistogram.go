@@ -0,0 +1,286 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const (
+	// nativeHistogramSchemaMin and nativeHistogramSchemaMax bound resolution of the native histogram.
+	// Bucket bounds of schema n grow by factor 2^(2^-n), e.g. ~9% for schema 3.
+	nativeHistogramSchemaMin = -4
+	nativeHistogramSchemaMax = 8
+
+	// nativeHistogramMaxBuckets limits number of the populated buckets of single histogram.
+	// Resolution is halved (schema decreased) until the histogram fits in the limit.
+	nativeHistogramMaxBuckets = 160
+
+	// fields of io.prometheus.client.Histogram message holding the native histogram.
+	// Vendored client_model predates them, so they are encoded directly.
+	nativeHistogramFieldSchema        = 5
+	nativeHistogramFieldZeroThreshold = 6
+	nativeHistogramFieldZeroCount     = 7
+	nativeHistogramFieldNegativeSpan  = 9
+	nativeHistogramFieldNegativeDelta = 10
+	nativeHistogramFieldPositiveSpan  = 12
+	nativeHistogramFieldPositiveDelta = 13
+
+	// fields of io.prometheus.client.BucketSpan message
+	nativeHistogramFieldSpanOffset = 1
+	nativeHistogramFieldSpanLength = 2
+)
+
+// nativeHistogramDef is a definition of the native histogram: initial resolution (schema) and width of the zero bucket.
+type nativeHistogramDef struct {
+	schema        int32
+	zeroThreshold float64
+}
+
+// nativeHistogramDefOf converts histogram definition of the sample (schema;zeroThreshold) to native histogram definition.
+func nativeHistogramDefOf(s *sample) (nativeHistogramDef, error) {
+	if len(s.histogramDef) != 2 {
+		return nativeHistogramDef{}, ErrHistogramDefInvalid
+	}
+	schema, err := strconv.Atoi(s.histogramDef[0])
+	if err != nil || schema < nativeHistogramSchemaMin || schema > nativeHistogramSchemaMax {
+		return nativeHistogramDef{}, ErrHistogramDefInvalid
+	}
+	zeroThreshold, err := strconv.ParseFloat(s.histogramDef[1], 64)
+	if err != nil || !(zeroThreshold >= 0) || math.IsInf(zeroThreshold, 0) {
+		return nativeHistogramDef{}, ErrHistogramDefInvalid
+	}
+
+	return nativeHistogramDef{schema: int32(schema), zeroThreshold: zeroThreshold}, nil
+}
+
+// nativeHistogram is a Prometheus native histogram, with sparse buckets growing exponentially.
+// Native buckets are exposed only in protobuf exposition format.
+// Text format gets classic buckets instead, with upper bounds of the populated native buckets.
+type nativeHistogram struct {
+	desc          *prometheus.Desc
+	zeroThreshold float64
+
+	// mu protects scraping from interfering with observations
+	mu sync.Mutex
+	// schema is decreased when there are too many buckets
+	schema int32
+	// positive and negative hold counts of the populated buckets by bucket index.
+	// Weighted observations make counts fractional, they are rounded on exposition.
+	positive  map[int]float64
+	negative  map[int]float64
+	zeroCount float64
+	sum       float64
+}
+
+// newNativeHistogram creates native histogram described by opts and def. Buckets of opts are ignored.
+func newNativeHistogram(opts prometheus.HistogramOpts, def nativeHistogramDef) *nativeHistogram {
+	return &nativeHistogram{
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, opts.Subsystem, opts.Name),
+			opts.Help,
+			nil,
+			opts.ConstLabels,
+		),
+		zeroThreshold: def.zeroThreshold,
+		schema:        def.schema,
+		positive:      make(map[int]float64),
+		negative:      make(map[int]float64),
+	}
+}
+
+// Desc implements prometheus.Metric.
+func (h *nativeHistogram) Desc() *prometheus.Desc {
+	return h.desc
+}
+
+// Write implements prometheus.Metric.
+func (h *nativeHistogram) Write(out *dto.Metric) error {
+	h.mu.Lock()
+	schema, sum := h.schema, h.sum
+	// counts are rounded per bucket, Prometheus requires count of the histogram to be equal to the sum of buckets
+	zeroCount := roundCount(h.zeroCount)
+	positive, positiveCount := nativeBucketsRounded(h.positive)
+	negative, negativeCount := nativeBucketsRounded(h.negative)
+	h.mu.Unlock()
+
+	// classic buckets are placed at upper bounds of the native ones, zero bucket at the zero threshold
+	counts := map[float64]uint64{h.zeroThreshold: zeroCount}
+	for i, c := range positive {
+		counts[nativeBucketBound(i, schema)] += c
+	}
+	for i, c := range negative {
+		counts[-nativeBucketBound(i-1, schema)] += c
+	}
+	bounds := make([]float64, 0, len(counts))
+	for ub := range counts {
+		bounds = append(bounds, ub)
+	}
+	sort.Float64s(bounds)
+	var cumulative uint64
+	buckets := make(map[float64]uint64, len(bounds))
+	for _, ub := range bounds {
+		cumulative += counts[ub]
+		buckets[ub] = cumulative
+	}
+
+	m, err := prometheus.NewConstHistogram(h.desc, zeroCount+positiveCount+negativeCount, sum, buckets)
+	if err != nil {
+		return err
+	}
+	if err := m.Write(out); err != nil {
+		return err
+	}
+	// unknown fields are kept by protobuf encoding and ignored by text encoding
+	out.Histogram.XXX_unrecognized = nativeHistogramFields(schema, h.zeroThreshold, zeroCount, positive, negative)
+	return nil
+}
+
+// Observe implements prometheus.Histogram.
+func (h *nativeHistogram) Observe(v float64) {
+	h.observeWeighted(v, 1)
+}
+
+// observeWeighted accounts single observation as w observations of the same value.
+func (h *nativeHistogram) observeWeighted(v, w float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	switch {
+	case math.Abs(v) <= h.zeroThreshold:
+		h.zeroCount += w
+	case v > 0:
+		h.positive[nativeBucketIndex(v, h.schema)] += w
+	default:
+		h.negative[nativeBucketIndex(-v, h.schema)] += w
+	}
+	h.sum += v * w
+
+	for len(h.positive)+len(h.negative) > nativeHistogramMaxBuckets && h.schema > nativeHistogramSchemaMin {
+		h.schema--
+		h.positive = nativeBucketsHalved(h.positive)
+		h.negative = nativeBucketsHalved(h.negative)
+	}
+}
+
+// nativeBucketIndex returns index of the bucket for positive value v.
+// Bucket i holds values in (2^((i-1)*2^-schema), 2^(i*2^-schema)].
+func nativeBucketIndex(v float64, schema int32) int {
+	// v = frac * 2^exp, frac in [0.5, 1)
+	frac, exp := math.Frexp(v)
+	if schema > 0 {
+		scale := 1 << uint(schema)
+		return int(math.Ceil(math.Log2(frac)*float64(scale))) + exp*scale
+	}
+
+	// power of two is the upper bound of the bucket
+	i := exp
+	if frac == 0.5 {
+		i--
+	}
+	return (i + 1<<uint(-schema) - 1) >> uint(-schema)
+}
+
+// nativeBucketBound returns upper bound of the positive bucket i.
+func nativeBucketBound(i int, schema int32) float64 {
+	if schema > 0 {
+		return math.Exp2(float64(i) / float64(int(1)<<uint(schema)))
+	}
+	return math.Ldexp(1, i<<uint(-schema))
+}
+
+// nativeBucketsHalved merges buckets in pairs, converting them to the schema lower by one.
+func nativeBucketsHalved(buckets map[int]float64) map[int]float64 {
+	out := make(map[int]float64, len(buckets))
+	for i, c := range buckets {
+		// bucket i of the lower schema covers buckets 2i-1 and 2i
+		out[(i+1)>>1] += c
+	}
+	return out
+}
+
+// nativeBucketsRounded returns buckets with counts rounded to integers and the sum of them.
+func nativeBucketsRounded(buckets map[int]float64) (map[int]uint64, uint64) {
+	out := make(map[int]uint64, len(buckets))
+	var total uint64
+	for i, c := range buckets {
+		out[i] = roundCount(c)
+		total += out[i]
+	}
+	return out, total
+}
+
+// nativeHistogramFields encodes native part of the histogram as fields of the Histogram protobuf message.
+func nativeHistogramFields(schema int32, zeroThreshold float64, zeroCount uint64, positive, negative map[int]uint64) []byte {
+	b := proto.NewBuffer(nil)
+
+	b.EncodeVarint(nativeHistogramFieldSchema<<3 | proto.WireVarint)
+	b.EncodeZigzag32(uint64(schema))
+	b.EncodeVarint(nativeHistogramFieldZeroThreshold<<3 | proto.WireFixed64)
+	b.EncodeFixed64(math.Float64bits(zeroThreshold))
+	b.EncodeVarint(nativeHistogramFieldZeroCount<<3 | proto.WireVarint)
+	b.EncodeVarint(zeroCount)
+
+	nativeBucketsEncode(b, nativeHistogramFieldNegativeSpan, nativeHistogramFieldNegativeDelta, negative)
+	nativeBucketsEncode(b, nativeHistogramFieldPositiveSpan, nativeHistogramFieldPositiveDelta, positive)
+
+	// empty span marks histogram without buckets as native one
+	if len(positive) == 0 && len(negative) == 0 {
+		nativeSpanEncode(b, nativeHistogramFieldPositiveSpan, 0, 0)
+	}
+
+	return b.Bytes()
+}
+
+// nativeBucketsEncode encodes buckets as spans of consecutive indexes and deltas of the counts.
+// Offset of the first span is the index of its first bucket, offsets of the next ones are gaps after the previous span.
+func nativeBucketsEncode(b *proto.Buffer, spanField, deltaField uint64, buckets map[int]uint64) {
+	indexes := make([]int, 0, len(buckets))
+	for i := range buckets {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+
+	var (
+		prev  int
+		spans [][2]int
+	)
+	for n, i := range indexes {
+		switch {
+		case n == 0:
+			spans = append(spans, [2]int{i, 0})
+		case i != prev+1:
+			spans = append(spans, [2]int{i - prev - 1, 0})
+		}
+		spans[len(spans)-1][1]++
+		prev = i
+	}
+	for _, span := range spans {
+		nativeSpanEncode(b, spanField, span[0], span[1])
+	}
+
+	// count of the first bucket is a delta to zero
+	var prevCount int64
+	for _, i := range indexes {
+		b.EncodeVarint(deltaField<<3 | proto.WireVarint)
+		b.EncodeZigzag64(uint64(int64(buckets[i]) - prevCount))
+		prevCount = int64(buckets[i])
+	}
+}
+
+// nativeSpanEncode encodes single BucketSpan message.
+func nativeSpanEncode(b *proto.Buffer, field uint64, offset, length int) {
+	span := proto.NewBuffer(nil)
+	span.EncodeVarint(nativeHistogramFieldSpanOffset<<3 | proto.WireVarint)
+	span.EncodeZigzag32(uint64(offset))
+	span.EncodeVarint(nativeHistogramFieldSpanLength<<3 | proto.WireVarint)
+	span.EncodeVarint(uint64(length))
+
+	b.EncodeVarint(field<<3 | proto.WireBytes)
+	b.EncodeRawBytes(span.Bytes())
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"math"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	a "github.com/stretchr/testify/assert"
+)
+
+// tfNativeHistogram is a native part of the Histogram protobuf message.
+type tfNativeHistogram struct {
+	schema         int32
+	zeroThreshold  float64
+	zeroCount      uint64
+	positiveSpans  [][2]int
+	positiveDeltas []int64
+	negativeSpans  [][2]int
+	negativeDeltas []int64
+}
+
+// thNativeHistogramDecode decodes fields of the native histogram encoded by nativeHistogramFields.
+func thNativeHistogramDecode(t *testing.T, b []byte) tfNativeHistogram {
+	var out tfNativeHistogram
+	decodeSpan := func(raw []byte) [2]int {
+		var span [2]int
+		sb := proto.NewBuffer(raw)
+		for {
+			key, err := sb.DecodeVarint()
+			if err != nil {
+				return span
+			}
+			switch key >> 3 {
+			case nativeHistogramFieldSpanOffset:
+				v, _ := sb.DecodeZigzag32()
+				span[0] = int(int32(v))
+			case nativeHistogramFieldSpanLength:
+				v, _ := sb.DecodeVarint()
+				span[1] = int(v)
+			}
+		}
+	}
+
+	buf := proto.NewBuffer(b)
+	for {
+		key, err := buf.DecodeVarint()
+		if err != nil {
+			return out
+		}
+		switch key >> 3 {
+		case nativeHistogramFieldSchema:
+			v, _ := buf.DecodeZigzag32()
+			out.schema = int32(v)
+		case nativeHistogramFieldZeroThreshold:
+			v, _ := buf.DecodeFixed64()
+			out.zeroThreshold = math.Float64frombits(v)
+		case nativeHistogramFieldZeroCount:
+			out.zeroCount, _ = buf.DecodeVarint()
+		case nativeHistogramFieldPositiveSpan:
+			raw, _ := buf.DecodeRawBytes(true)
+			out.positiveSpans = append(out.positiveSpans, decodeSpan(raw))
+		case nativeHistogramFieldNegativeSpan:
+			raw, _ := buf.DecodeRawBytes(true)
+			out.negativeSpans = append(out.negativeSpans, decodeSpan(raw))
+		case nativeHistogramFieldPositiveDelta:
+			v, _ := buf.DecodeZigzag64()
+			out.positiveDeltas = append(out.positiveDeltas, int64(v))
+		case nativeHistogramFieldNegativeDelta:
+			v, _ := buf.DecodeZigzag64()
+			out.negativeDeltas = append(out.negativeDeltas, int64(v))
+		default:
+			t.Fatalf("unexpected field: %d", key>>3)
+		}
+	}
+}
+
+func Test_NativeBucketIndex(t *testing.T) {
+	tests := []struct {
+		v      float64
+		schema int32
+		exp    int
+	}{
+		{1, 0, 0},
+		{2, 0, 1},
+		{3, 0, 2},
+		{0.5, 0, -1},
+		{0.3, 0, -1},
+		{1, 2, 0},
+		{1.1, 2, 1},
+		{1.2, 2, 2},
+		{2, 2, 4},
+		{1, -1, 0},
+		{4, -1, 1},
+		{5, -1, 2},
+		{0.2, -1, -1},
+	}
+	for _, tc := range tests {
+		i := nativeBucketIndex(tc.v, tc.schema)
+		a.Equal(t, tc.exp, i, "v: %v, schema: %d", tc.v, tc.schema)
+		a.True(t, tc.v <= nativeBucketBound(i, tc.schema) && tc.v > nativeBucketBound(i-1, tc.schema), "v: %v, schema: %d", tc.v, tc.schema)
+	}
+
+	// buckets of the lower schema are merged pairs of buckets of the higher one
+	for _, v := range []float64{0.001, 0.3, 1, 1.1, 1.5, 2, 3, 1000, 12345.678} {
+		for schema := int32(nativeHistogramSchemaMax); schema > nativeHistogramSchemaMin; schema-- {
+			a.Equal(t, (nativeBucketIndex(v, schema)+1)>>1, nativeBucketIndex(v, schema-1), "v: %v, schema: %d", v, schema)
+		}
+	}
+}
+
+func Test_NativeHistogram_Write(t *testing.T) {
+	h := newNativeHistogram(
+		prometheus.HistogramOpts{Name: "name_of_1_metric_seconds", Help: "auto", ConstLabels: prometheus.Labels{"labelA": "labelValueA"}},
+		nativeHistogramDef{schema: 0, zeroThreshold: 0.001},
+	)
+	for _, v := range []float64{0, 0.0005, 1, 1.5, 3, 3.5, 20, -3} {
+		h.Observe(v)
+	}
+	h.observeWeighted(3, 4)
+
+	var mm dto.Metric
+	if !a.NoError(t, h.Write(&mm)) {
+		t.FailNow()
+	}
+
+	// classic buckets at upper bounds of the native ones are exposed in text format
+	a.Equal(t, uint64(12), mm.Histogram.GetSampleCount())
+	a.Equal(t, 38.0005, mm.Histogram.GetSampleSum())
+	got := make(map[float64]uint64)
+	for _, b := range mm.Histogram.GetBucket() {
+		got[b.GetUpperBound()] = b.GetCumulativeCount()
+	}
+	a.Equal(t, map[float64]uint64{-2: 1, 0.001: 3, 1: 4, 2: 5, 4: 11, 32: 12}, got)
+
+	a.Equal(t, tfNativeHistogram{
+		schema:         0,
+		zeroThreshold:  0.001,
+		zeroCount:      2,
+		positiveSpans:  [][2]int{{0, 3}, {2, 1}},
+		positiveDeltas: []int64{1, 0, 5, -5},
+		negativeSpans:  [][2]int{{2, 1}},
+		negativeDeltas: []int64{1},
+	}, thNativeHistogramDecode(t, mm.Histogram.XXX_unrecognized))
+
+	// native fields are kept by protobuf exposition
+	b, err := proto.Marshal(&mm)
+	if !a.NoError(t, err) {
+		t.FailNow()
+	}
+	var decoded dto.Metric
+	a.NoError(t, proto.Unmarshal(b, &decoded))
+	a.Equal(t, mm.Histogram.XXX_unrecognized, decoded.Histogram.XXX_unrecognized)
+}
+
+func Test_NativeHistogram_Write_Empty(t *testing.T) {
+	h := newNativeHistogram(prometheus.HistogramOpts{Name: "h", Help: "auto"}, nativeHistogramDef{schema: 3})
+
+	var mm dto.Metric
+	if !a.NoError(t, h.Write(&mm)) {
+		t.FailNow()
+	}
+	// empty span marks the histogram as native one
+	a.Equal(t, tfNativeHistogram{schema: 3, positiveSpans: [][2]int{{0, 0}}}, thNativeHistogramDecode(t, mm.Histogram.XXX_unrecognized))
+}
+
+func Test_NativeHistogram_Observe_ResolutionReduced(t *testing.T) {
+	h := newNativeHistogram(prometheus.HistogramOpts{Name: "h", Help: "auto"}, nativeHistogramDef{schema: 8})
+
+	// ~14.3 octaves of values, 8 buckets per octave (schema 3) is the highest resolution within the limit
+	for i := 0; i < 1000; i++ {
+		h.Observe(math.Pow(1.01, float64(i)))
+	}
+
+	a.Equal(t, int32(3), h.schema)
+	a.True(t, len(h.positive) <= nativeHistogramMaxBuckets)
+	var mm dto.Metric
+	h.Write(&mm)
+	a.Equal(t, uint64(1000), mm.Histogram.GetSampleCount())
+	a.Equal(t, int32(3), thNativeHistogramDecode(t, mm.Histogram.XXX_unrecognized).schema)
+}
+
+func Test_NativeHistogramDefOf(t *testing.T) {
+	def, err := nativeHistogramDefOf(&sample{histogramDef: []string{"-2", "0.001"}})
+	a.NoError(t, err)
+	a.Equal(t, nativeHistogramDef{schema: -2, zeroThreshold: 0.001}, def)
+
+	for _, hd := range [][]string{
+		{"3"},
+		{"3", "0", "1"},
+		{"9", "0"},
+		{"-5", "0"},
+		{"a", "0"},
+		{"3", "-1"},
+		{"3", "NaN"},
+		{"3", "Inf"},
+	} {
+		_, err := nativeHistogramDefOf(&sample{histogramDef: hd})
+		a.Equal(t, ErrHistogramDefInvalid, err, "%v", hd)
+	}
+}
+
+func Test_Collector_Process_NativeHistogram(t *testing.T) {
+	c := newCollector()
+	c.hasher = hashMD5
+
+	s := &sample{name: "name_of_1_metric_seconds", kind: sampleHistogramNative, labels: map[string]string{}, histogramDef: []string{"0", "0.001"}, value: 3}
+	c.processSample(s)
+	// same definition written differently ends up in the same series
+	c.processSample(&sample{name: "name_of_1_metric_seconds", kind: sampleHistogramNative, labels: map[string]string{}, histogramDef: []string{"0", "0.0010"}, value: 1, rate: 0.5})
+	// other resolution conflicts with the family
+	c.processSample(&sample{name: "name_of_1_metric_seconds", kind: sampleHistogramNative, labels: map[string]string{}, histogramDef: []string{"1", "0.001"}, value: 1})
+	c.processSample(&sample{name: "name_of_2_metric_seconds", kind: sampleHistogramNative, labels: map[string]string{}, histogramDef: []string{"9", "0"}, value: 1})
+
+	if !a.Len(t, c.nativeHistograms, 1) {
+		t.FailNow()
+	}
+	var mm dto.Metric
+	c.nativeHistograms[string(c.hasher(s))].Write(&mm)
+	a.Equal(t, uint64(3), mm.Histogram.GetSampleCount())
+	a.Equal(t, 5.0, mm.Histogram.GetSampleSum())
+
+	c.metricConflicts.WithLabelValues(familyConflictHistogramLayout).Write(&mm)
+	a.Equal(t, float64(1), mm.Counter.GetValue())
+	c.metricSamplesRejected.WithLabelValues("histogram_def_invalid").Write(&mm)
+	a.Equal(t, float64(1), mm.Counter.GetValue())
+
+	// native histogram is gathered as histogram family
+	reg := prometheus.NewRegistry()
+	if !a.NoError(t, reg.Register(c)) {
+		t.FailNow()
+	}
+	mfs, err := reg.Gather()
+	if !a.NoError(t, err) {
+		t.FailNow()
+	}
+	for _, mf := range mfs {
+		if mf.GetName() == s.name {
+			a.Equal(t, dto.MetricType_HISTOGRAM, mf.GetType())
+			a.NotEmpty(t, mf.Metric[0].Histogram.XXX_unrecognized)
+		}
+	}
+
+	// series is removed from the storage
+	c.removeSeries(string(c.hasher(s)))
+	a.Len(t, c.nativeHistograms, 0)
+}
+
+func Test_Collector_SnapshotRestore_NativeHistogram(t *testing.T) {
+	dir, cleanup := thSnapshotDir(t)
+	defer cleanup()
+	path := filepath.Join(dir, "state.snapshot")
+
+	s := &sample{name: "name_of_1_metric_seconds", kind: sampleHistogramNative, labels: map[string]string{}, histogramDef: []string{"8", "0.001"}}
+	src := newCollector()
+	src.hasher = hashMD5
+	for i := 0; i < 1000; i++ {
+		smp := *s
+		smp.value = math.Pow(1.01, float64(i))
+		src.processSample(&smp)
+	}
+	smp := *s
+	smp.rate = 0.5
+	src.processSample(&smp)
+
+	if !a.NoError(t, writeSnapshot(path, src.snapshot())) {
+		t.FailNow()
+	}
+	snap, err := readSnapshot(path)
+	if !a.NoError(t, err) {
+		t.FailNow()
+	}
+
+	dst := newCollector()
+	dst.hasher = hashMD5
+	dst.restore(snap)
+
+	srcH := src.nativeHistograms[string(src.hasher(s))]
+	dstH := dst.nativeHistograms[string(dst.hasher(s))]
+	if !a.NotNil(t, dstH) {
+		t.FailNow()
+	}
+	// reduced resolution is kept
+	a.Equal(t, int32(3), dstH.schema)
+	a.Equal(t, srcH.positive, dstH.positive)
+	a.Equal(t, srcH.zeroCount, dstH.zeroCount)
+	a.Equal(t, srcH.sum, dstH.sum)
+}
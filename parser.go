@@ -3,9 +3,11 @@ package main
 import (
 	"bufio"
 	"io"
+	"math"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type sampleParserState int
@@ -16,8 +18,14 @@ const (
 
 	sampleParserLabelsSeparator         = ";"
 	sampleParserHistogramDefSeparator   = ";"
+	sampleParserSummaryDefSeparator     = ";"
+	sampleParserObjectiveSeparator      = ":"
 	sampleParserLabelFromValueSeparator = "="
 	sampleParserSamplePartsSeparator    = "|"
+	sampleParserAggregatePartsSeparator = ":"
+	sampleParserBucketCountsSeparator   = ","
+	sampleParserRatePrefix              = "@"
+	sampleParserTimestampPrefix         = "T"
 )
 
 var (
@@ -29,24 +37,53 @@ var (
 
 	sampleParserSharedLabelsLineRE = regexp.MustCompile(`^` + sampleParserLabelsREPart + `$`)
 
-	metricNameREPart         = `[a-zA-Z0-9_]+`
+	metricNameREPart = `[a-zA-Z0-9_]+`
+	// sampleNameREPart accepts also flat names sent by legacy (statsd) clients, they are mapped to valid names later
+	sampleNameREPart         = `[a-zA-Z0-9_.-]+`
 	sampleKindREPart         = `[a-z]{1,2}`
 	sampleHistogramDefREPart = `[0-9.]+;[0-9.]+;[0-9.]+`
+	// sampleNativeHistogramDefREPart is a schema and zero threshold of the native histogram
+	sampleNativeHistogramDefREPart = `-?[0-9]+;[0-9.]+`
+	sampleSummaryDefREPart         = `[0-9.]+(;[0-9.]+:[0-9.]+)+`
 	// TODO(szpakas): tighter regexp with only one decimal separator
 	sampleValueREPart            = `[0-9.]+`
+	sampleAggregateValueREPart   = `[0-9]+(,[0-9]+)*:[0-9.]+:[0-9]+`
+	sampleRateREPart             = `@[0-9.]+`
+	sampleTimestampREPart        = `T[0-9]+(\.[0-9]+)?`
 	sampleParserSampleLineREPart = `^` +
-		metricNameREPart + `\|` +
+		sampleNameREPart + `\|` +
 		sampleKindREPart + `\|` +
-		`(` + sampleHistogramDefREPart + `\|)?` + // optional
+		`((` + sampleHistogramDefREPart + `|` + sampleNativeHistogramDefREPart + `|` + sampleSummaryDefREPart + `)\|)?` + // optional
 		`(` + sampleParserLabelsREPart + `\|)?` + // optional
-		sampleValueREPart +
+		`(` + sampleValueREPart + `|` + sampleAggregateValueREPart + `)` +
+		`(\|` + sampleRateREPart + `)?` + // optional
+		`(\|` + sampleTimestampREPart + `)?` + // optional
 		`$`
 	sampleParserSampleLineRE = regexp.MustCompile(sampleParserSampleLineREPart)
+
+	setMemberREPart           = `[a-zA-Z0-9._-]+`
+	sampleParserSetLineREPart = `^` +
+		sampleNameREPart + `\|` +
+		string(sampleSet) + `\|` +
+		`(` + sampleParserLabelsREPart + `\|)?` + // optional
+		setMemberREPart +
+		`(\|` + sampleTimestampREPart + `)?` + // optional
+		`$`
+	sampleParserSetLineRE = regexp.MustCompile(sampleParserSetLineREPart)
+
+	metadataUnitRE             = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
+	sampleParserMetadataLineRE = regexp.MustCompile(`^#(` + string(metadataHelp) + `|` + string(metadataUnit) + `) ` +
+		`(` + metricNameREPart + `) ` +
+		`(.+)$`)
 )
 
-// parseSample reads a single sample/s description and converts it to set of samples
-func parseSample(r io.Reader) ([]*sample, error) {
-	var out []*sample
+// parseSample reads a single sample/s description and converts it to set of samples.
+// Metadata lines are returned separately.
+func parseSample(r io.Reader) ([]*sample, []*metadata, error) {
+	var (
+		out         []*sample
+		outMetadata []*metadata
+	)
 
 	scanner := bufio.NewScanner(r)
 
@@ -58,6 +95,14 @@ func parseSample(r io.Reader) ([]*sample, error) {
 			return sampleGauge
 		case string(sampleHistogramLinear):
 			return sampleHistogramLinear
+		case string(sampleHistogramExponential):
+			return sampleHistogramExponential
+		case string(sampleHistogramNative):
+			return sampleHistogramNative
+		case string(sampleSummary):
+			return sampleSummary
+		case string(sampleSet):
+			return sampleSet
 		}
 		return sampleUnknown
 	}
@@ -71,7 +116,7 @@ func parseSample(r io.Reader) ([]*sample, error) {
 	}
 
 	isSampleLine := func(s string) bool {
-		return sampleParserSampleLineRE.MatchString(s)
+		return sampleParserSampleLineRE.MatchString(s) || sampleParserSetLineRE.MatchString(s)
 	}
 
 	parseSampleLine := func(s string, sharedLabels map[string]string) *sample {
@@ -87,18 +132,81 @@ func parseSample(r io.Reader) ([]*sample, error) {
 			kind:   kindMapper(samplePartsSlice[1]),
 			labels: labels,
 		}
-		smp.value, _ = strconv.ParseFloat(samplePartsSlice[len(samplePartsSlice)-1], 10)
+
+		// optional timestamp is the last part, for sets it's recognized by the number of parts as member can look the same
+		if tsPart := samplePartsSlice[len(samplePartsSlice)-1]; strings.HasPrefix(tsPart, sampleParserTimestampPrefix) {
+			partsWithTimestamp := 4
+			if strings.Contains(samplePartsSlice[2], sampleParserLabelFromValueSeparator) {
+				partsWithTimestamp = 5
+			}
+			if smp.kind != sampleSet || len(samplePartsSlice) == partsWithTimestamp {
+				ts, err := strconv.ParseFloat(strings.TrimPrefix(tsPart, sampleParserTimestampPrefix), 64)
+				if err != nil {
+					return nil
+				}
+				sec := math.Floor(ts)
+				smp.timestamp = time.Unix(int64(sec), int64((ts-sec)*1e9))
+				samplePartsSlice = samplePartsSlice[:len(samplePartsSlice)-1]
+			}
+		}
+
+		// optional sampling rate is the last part, remaining parts are handled as if it was not there
+		if ratePart := samplePartsSlice[len(samplePartsSlice)-1]; strings.HasPrefix(ratePart, sampleParserRatePrefix) {
+			switch smp.kind {
+			case sampleCounter, sampleHistogramLinear, sampleHistogramExponential, sampleHistogramNative:
+			default:
+				return nil
+			}
+			var err error
+			smp.rate, err = strconv.ParseFloat(strings.TrimPrefix(ratePart, sampleParserRatePrefix), 64)
+			if err != nil || smp.rate <= 0 || smp.rate > 1 {
+				return nil
+			}
+			samplePartsSlice = samplePartsSlice[:len(samplePartsSlice)-1]
+		}
+		valuePart := samplePartsSlice[len(samplePartsSlice)-1]
+		switch {
+		case smp.kind == sampleSet:
+			smp.member = valuePart
+		case strings.Contains(valuePart, sampleParserAggregatePartsSeparator):
+			// pre-aggregated value is allowed only for histograms and is never sampled
+			if smp.kind != sampleHistogramLinear && smp.kind != sampleHistogramExponential || smp.rate != 0 {
+				return nil
+			}
+			if smp.aggregate = parseHistogramAggregate(valuePart); smp.aggregate == nil {
+				return nil
+			}
+		default:
+			// values out of range (e.g. 1e999) are rejected rather than stored as infinity
+			var err error
+			if smp.value, err = strconv.ParseFloat(valuePart, 64); err != nil {
+				return nil
+			}
+		}
 
 		switch smp.kind {
-		case sampleHistogramLinear:
+		case sampleHistogramLinear, sampleHistogramExponential, sampleHistogramNative:
 			smp.histogramDef = strings.Split(samplePartsSlice[2], sampleParserHistogramDefSeparator)
 			// account for histogramDef
 			if len(samplePartsSlice) == 5 {
 				labelsMapper(samplePartsSlice[3], smp.labels)
 			}
+		case sampleSummary:
+			smp.summaryDef = strings.Split(samplePartsSlice[2], sampleParserSummaryDefSeparator)
+			// account for summaryDef
+			if len(samplePartsSlice) == 5 {
+				labelsMapper(samplePartsSlice[3], smp.labels)
+			}
 		default:
-			if len(samplePartsSlice) == 4 {
+			switch len(samplePartsSlice) {
+			case 4:
+				// line regexp accepts type config in place of labels, it's allowed only for histograms and summaries
+				if !sampleParserSharedLabelsLineRE.MatchString(samplePartsSlice[2]) {
+					return nil
+				}
 				labelsMapper(samplePartsSlice[2], smp.labels)
+			case 5:
+				return nil
 			}
 		}
 
@@ -109,6 +217,14 @@ func parseSample(r io.Reader) ([]*sample, error) {
 	sharedLabels := make(map[string]string)
 
 	for scanner.Scan() {
+		// metadata lines are allowed anywhere in the packet
+		if m := sampleParserMetadataLineRE.FindStringSubmatch(scanner.Text()); m != nil {
+			if md := parseMetadataLine(m); md != nil {
+				outMetadata = append(outMetadata, md)
+			}
+			continue
+		}
+
 		switch state {
 		case sampleParserStateSearching:
 			if sampleParserSharedLabelsLineRE.MatchString(scanner.Text()) {
@@ -119,17 +235,69 @@ func parseSample(r io.Reader) ([]*sample, error) {
 			}
 
 			if isSampleLine(scanner.Text()) {
-				out = append(out, parseSampleLine(scanner.Text(), sharedLabels))
+				if smp := parseSampleLine(scanner.Text(), sharedLabels); smp != nil {
+					out = append(out, smp)
+				}
 				continue
 			}
 
 		case sampleParserStateSample:
 			if isSampleLine(scanner.Text()) {
-				out = append(out, parseSampleLine(scanner.Text(), sharedLabels))
+				if smp := parseSampleLine(scanner.Text(), sharedLabels); smp != nil {
+					out = append(out, smp)
+				}
 				continue
 			}
 		}
 	}
 
-	return out, nil
+	// shared labels line can follow metadata lines, so labels are set when whole packet is parsed
+	for _, md := range outMetadata {
+		md.labels = sharedLabels
+	}
+
+	// lines parsed before the error (e.g. line too long) are returned
+	return out, outMetadata, scanner.Err()
+}
+
+// parseHistogramAggregate converts value of pre-aggregated histogram.
+// Format (enforced by earlier regexp check): count1,count2,...,countN:sum:count
+// Returns nil if any of the numbers is out of range.
+func parseHistogramAggregate(s string) *histogramAggregate {
+	parts := strings.Split(s, sampleParserAggregatePartsSeparator)
+
+	var (
+		agg histogramAggregate
+		err error
+	)
+	for _, c := range strings.Split(parts[0], sampleParserBucketCountsSeparator) {
+		v, err := strconv.ParseUint(c, 10, 64)
+		if err != nil {
+			return nil
+		}
+		agg.counts = append(agg.counts, v)
+	}
+	if agg.sum, err = strconv.ParseFloat(parts[1], 64); err != nil {
+		return nil
+	}
+	if agg.count, err = strconv.ParseUint(parts[2], 10, 64); err != nil {
+		return nil
+	}
+
+	return &agg
+}
+
+// parseMetadataLine converts submatches of the metadata line regexp to metadata.
+func parseMetadataLine(m []string) *metadata {
+	md := metadata{
+		kind:  metadataKind(m[1]),
+		name:  m[2],
+		value: m[3],
+	}
+
+	if md.kind == metadataUnit && !metadataUnitRE.MatchString(md.value) {
+		return nil
+	}
+
+	return &md
 }
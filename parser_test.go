@@ -3,6 +3,7 @@ package main
 import (
 	"strings"
 	"testing"
+	"time"
 
 	a "github.com/stretchr/testify/assert"
 )
@@ -74,11 +75,194 @@ name_of_3_metric|g|17.3`,
 				},
 			},
 		},
+		"histogram, exponential buckets": {
+			`name_of_1_metric_seconds|he|0.001;2;12|labelA=labelValueA;label2=labelValue2|12.345`,
+			[]sample{
+				{
+					name: "name_of_1_metric_seconds", kind: sampleHistogramExponential,
+					labels:       map[string]string{"labelA": "labelValueA", "label2": "labelValue2"},
+					value:        12.345,
+					histogramDef: []string{"0.001", "2", "12"},
+				},
+			},
+		},
+		"histogram, native": {
+			`name_of_1_metric_seconds|hn|3;0.001|labelA=labelValueA|12.345|@0.5
+name_of_2_metric_seconds|hn|-2;0|1
+name_of_3_metric_seconds|hn|3;0|1:2:3`,
+			[]sample{
+				{
+					name: "name_of_1_metric_seconds", kind: sampleHistogramNative,
+					labels:       map[string]string{"labelA": "labelValueA"},
+					value:        12.345,
+					rate:         0.5,
+					histogramDef: []string{"3", "0.001"},
+				},
+				{
+					name: "name_of_2_metric_seconds", kind: sampleHistogramNative,
+					labels:       map[string]string{},
+					value:        1,
+					histogramDef: []string{"-2", "0"},
+				},
+				// native histograms can not be pre-aggregated
+			},
+		},
+		"histogram, pre-aggregated": {
+			`name_of_1_metric_seconds|hl|3.3;2.0;3|labelA=labelValueA|0,4,2:47.5:8
+name_of_2_metric_seconds|he|1;2;1|3:2.5:3`,
+			[]sample{
+				{
+					name: "name_of_1_metric_seconds", kind: sampleHistogramLinear,
+					labels:       map[string]string{"labelA": "labelValueA"},
+					histogramDef: []string{"3.3", "2.0", "3"},
+					aggregate:    &histogramAggregate{counts: []uint64{0, 4, 2}, sum: 47.5, count: 8},
+				},
+				{
+					name: "name_of_2_metric_seconds", kind: sampleHistogramExponential,
+					labels:       map[string]string{},
+					histogramDef: []string{"1", "2", "1"},
+					aggregate:    &histogramAggregate{counts: []uint64{3}, sum: 2.5, count: 3},
+				},
+			},
+		},
+		"pre-aggregated value on non-histogram is skipped": {
+			`name_of_1_metric_total|c|1,2:3:4
+name_of_2_metric_total|c|56`,
+			[]sample{
+				{
+					name: "name_of_2_metric_total", kind: sampleCounter,
+					labels: map[string]string{},
+					value:  56,
+				},
+			},
+		},
+		"sampling rate": {
+			`name_of_1_metric_total|c|labelA=labelValueA|2|@0.1
+name_of_2_metric_total|c|3|@1
+name_of_3_metric|g|7.3|@0.5
+name_of_4_metric_total|c|3|@0
+name_of_5_metric_total|c|3|@1.5
+name_of_6_metric_seconds|hl|3.3;2.0;5|12.345|@0.25
+name_of_7_metric_seconds|hl|3.3;2.0;1|1:2:3|@0.25`,
+			[]sample{
+				{
+					name: "name_of_1_metric_total", kind: sampleCounter,
+					labels: map[string]string{"labelA": "labelValueA"},
+					value:  2,
+					rate:   0.1,
+				},
+				{
+					name: "name_of_2_metric_total", kind: sampleCounter,
+					labels: map[string]string{},
+					value:  3,
+					rate:   1,
+				},
+				// gauges, invalid rates and pre-aggregated histograms are skipped
+				{
+					name: "name_of_6_metric_seconds", kind: sampleHistogramLinear,
+					labels:       map[string]string{},
+					value:        12.345,
+					rate:         0.25,
+					histogramDef: []string{"3.3", "2.0", "5"},
+				},
+			},
+		},
+		"timestamp": {
+			`name_of_1_metric_total|c|labelA=labelValueA|2|@0.5|T1500000000.25
+name_of_2_metric|g|7.3|T1500000000
+name_of_3_metric_users|s|labelA=labelValueA|user1|T1500000000
+name_of_3_metric_users|s|user2|T1500000000
+name_of_3_metric_users|s|T1500000000`,
+			[]sample{
+				{
+					name: "name_of_1_metric_total", kind: sampleCounter,
+					labels:    map[string]string{"labelA": "labelValueA"},
+					value:     2,
+					rate:      0.5,
+					timestamp: time.Unix(1500000000, 250000000),
+				},
+				{
+					name: "name_of_2_metric", kind: sampleGauge,
+					labels:    map[string]string{},
+					value:     7.3,
+					timestamp: time.Unix(1500000000, 0),
+				},
+				{
+					name: "name_of_3_metric_users", kind: sampleSet,
+					labels:    map[string]string{"labelA": "labelValueA"},
+					member:    "user1",
+					timestamp: time.Unix(1500000000, 0),
+				},
+				{
+					name: "name_of_3_metric_users", kind: sampleSet,
+					labels:    map[string]string{},
+					member:    "user2",
+					timestamp: time.Unix(1500000000, 0),
+				},
+				// member looking like a timestamp
+				{
+					name: "name_of_3_metric_users", kind: sampleSet,
+					labels: map[string]string{},
+					member: "T1500000000",
+				},
+			},
+		},
+		"flat names": {
+			`api.requests.GET-users|c|1
+api.users|s|user1`,
+			[]sample{
+				{
+					name: "api.requests.GET-users", kind: sampleCounter,
+					labels: map[string]string{},
+					value:  1,
+				},
+				{
+					name: "api.users", kind: sampleSet,
+					labels: map[string]string{},
+					member: "user1",
+				},
+			},
+		},
+		"summary": {
+			`name_of_1_metric_seconds|sm|600;0.5:0.05;0.99:0.001|labelA=labelValueA|12.345
+name_of_2_metric_seconds|sm|60;0.9:0.01|2`,
+			[]sample{
+				{
+					name: "name_of_1_metric_seconds", kind: sampleSummary,
+					labels:     map[string]string{"labelA": "labelValueA"},
+					value:      12.345,
+					summaryDef: []string{"600", "0.5:0.05", "0.99:0.001"},
+				},
+				{
+					name: "name_of_2_metric_seconds", kind: sampleSummary,
+					labels:     map[string]string{},
+					value:      2,
+					summaryDef: []string{"60", "0.9:0.01"},
+				},
+			},
+		},
+		"set": {
+			`service=srvA1
+name_of_1_metric_users|s|labelA=labelValueA|user-1234
+name_of_1_metric_users|s|0.12`,
+			[]sample{
+				{
+					name: "name_of_1_metric_users", kind: sampleSet,
+					labels: map[string]string{"service": "srvA1", "labelA": "labelValueA"},
+					member: "user-1234",
+				},
+				{
+					name: "name_of_1_metric_users", kind: sampleSet,
+					labels: map[string]string{"service": "srvA1"},
+					member: "0.12",
+				},
+			},
+		},
 	}
 
 	for k, tc := range cases {
 		r := strings.NewReader(tc.in)
-		got, err := parseSample(r)
+		got, _, err := parseSample(r)
 		if !a.NoError(t, err, k) {
 			continue
 		}
@@ -93,3 +277,67 @@ name_of_3_metric|g|17.3`,
 		}
 	}
 }
+
+func Test_SampleParser_Parse_TypeConfigOfOtherKind(t *testing.T) {
+	// type config is allowed only for histograms and summaries, such lines are skipped
+	in := `name_of_1_metric_total|c|600;0.5:0.05|5
+name_of_1_metric_total|c|1;2;3|5
+name_of_2_metric|g|1;2;3|labelA=labelValueA|5
+name_of_3_metric_users|s|1;2;3|5
+name_of_1_metric_total|c|labelA=labelValueA|5`
+
+	got, _, err := parseSample(strings.NewReader(in))
+	a.NoError(t, err)
+	if a.Len(t, got, 1) {
+		a.Equal(t, sample{
+			name: "name_of_1_metric_total", kind: sampleCounter,
+			labels: map[string]string{"labelA": "labelValueA"},
+			value:  5,
+		}, *got[0])
+	}
+}
+
+func Test_SampleParser_Parse_OutOfRange(t *testing.T) {
+	// numbers out of range are rejected rather than stored as infinity, as well as malformed ones
+	huge := strings.Repeat("9", 400)
+	in := `name_of_1_metric_total|c|` + huge + `
+name_of_2_metric|g|1.2.3
+name_of_3_metric_seconds|hl|1;1;3|1,99999999999999999999:2:1
+name_of_4_metric_seconds|hl|1;1;3|1,1:` + huge + `:1
+name_of_5_metric_total|c|1|T` + huge + `
+name_of_6_metric_total|c|5`
+
+	got, _, err := parseSample(strings.NewReader(in))
+	a.NoError(t, err)
+	if a.Len(t, got, 1) {
+		a.Equal(t, "name_of_6_metric_total", got[0].name)
+	}
+}
+
+func Test_SampleParser_Parse_LineTooLong(t *testing.T) {
+	in := "name_of_1_metric_total|c|5\nname_of_2_metric_total|c|" + strings.Repeat("labelA=labelValueA;", 5000) + "|5"
+
+	got, _, err := parseSample(strings.NewReader(in))
+	a.Error(t, err)
+	a.Len(t, got, 1, "lines before the error are returned")
+}
+
+func Test_SampleParser_Parse_Metadata(t *testing.T) {
+	in := `#HELP name_of_1_metric_seconds Time spent on handling the request.
+service=srvA1
+#UNIT name_of_1_metric_seconds seconds
+name_of_1_metric_seconds|hl|3.3;2.0;5|12.345
+#UNIT name_of_1_metric_seconds not a unit
+#HELP name_of_2_metric_total`
+
+	samples, metadataGot, err := parseSample(strings.NewReader(in))
+	if !a.NoError(t, err) {
+		t.FailNow()
+	}
+
+	a.Len(t, samples, 1)
+	a.Equal(t, []*metadata{
+		{name: "name_of_1_metric_seconds", kind: metadataHelp, value: "Time spent on handling the request.", labels: map[string]string{"service": "srvA1"}},
+		{name: "name_of_1_metric_seconds", kind: metadataUnit, value: "seconds", labels: map[string]string{"service": "srvA1"}},
+	}, metadataGot)
+}
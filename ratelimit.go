@@ -0,0 +1,47 @@
+package main
+
+import (
+	"time"
+)
+
+// tokenBucket limits rate of the events, allowing bursts up to its size.
+// It's not safe for concurrent use.
+type tokenBucket struct {
+	// rate is a number of tokens added per second
+	rate float64
+	// burst is a max number of tokens
+	burst float64
+
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket creates bucket full of tokens. Burst lower than 1 is raised to 1, so any event can pass.
+func newTokenBucket(rate, burst float64, now time.Time) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   now,
+	}
+}
+
+// allow takes n tokens from the bucket. Returns false, without taking any, if there is not enough of them.
+func (b *tokenBucket) allow(now time.Time, n float64) bool {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+	}
+
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	a "github.com/stretchr/testify/assert"
+)
+
+func Test_TokenBucket_Allow(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	b := newTokenBucket(10, 5, now)
+
+	// burst is available from the start
+	for i := 0; i < 5; i++ {
+		a.True(t, b.allow(now, 1), "burst %d", i)
+	}
+	a.False(t, b.allow(now, 1))
+
+	// tokens are refilled with the rate
+	now = now.Add(200 * time.Millisecond)
+	a.True(t, b.allow(now, 2))
+	a.False(t, b.allow(now, 1))
+
+	// refill is capped at burst
+	now = now.Add(time.Hour)
+	a.False(t, b.allow(now, 6))
+	a.True(t, b.allow(now, 5))
+
+	// clock going back does not add tokens
+	a.False(t, b.allow(now.Add(-time.Second), 1))
+}
+
+func Test_TokenBucket_MinBurst(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	b := newTokenBucket(0.5, 0, now)
+
+	a.True(t, b.allow(now, 1))
+	a.False(t, b.allow(now.Add(time.Second), 1))
+	a.True(t, b.allow(now.Add(2*time.Second), 1))
+}
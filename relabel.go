@@ -0,0 +1,278 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v2"
+)
+
+// relabelAction is an action taken by the relabel rule. Names follow Prometheus relabel_config.
+type relabelAction string
+
+const (
+	relabelReplace   relabelAction = "replace"
+	relabelKeep      relabelAction = "keep"
+	relabelDrop      relabelAction = "drop"
+	relabelLabelDrop relabelAction = "labeldrop"
+	relabelLabelKeep relabelAction = "labelkeep"
+	relabelLabelMap  relabelAction = "labelmap"
+	relabelHashMod   relabelAction = "hashmod"
+
+	// relabelNameLabel is a pseudo label holding metric name during relabeling.
+	relabelNameLabel = "__name__"
+
+	// relabelInternalPrefix starts names of the labels removed after relabeling.
+	relabelInternalPrefix = "__"
+)
+
+var (
+	// ErrRelabelConfigInvalid is returned when relabel rule is not valid.
+	ErrRelabelConfigInvalid = errors.New("relabel: invalid rule")
+
+	relabelLabelNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// relabelConfig is a single relabel rule. Format and defaults follow Prometheus relabel_config.
+type relabelConfig struct {
+	SourceLabels []string      `yaml:"source_labels"`
+	Separator    string        `yaml:"separator"`
+	Regex        string        `yaml:"regex"`
+	Modulus      uint64        `yaml:"modulus"`
+	TargetLabel  string        `yaml:"target_label"`
+	Replacement  string        `yaml:"replacement"`
+	Action       relabelAction `yaml:"action"`
+
+	// regex is compiled Regex, anchored on both ends
+	regex *regexp.Regexp
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler. Sets defaults of the missing fields.
+func (rc *relabelConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain relabelConfig
+	*rc = relabelConfig{
+		Separator:   ";",
+		Regex:       "(.*)",
+		Replacement: "$1",
+		Action:      relabelReplace,
+	}
+	return unmarshal((*plain)(rc))
+}
+
+// compile validates the rule and prepares it for use.
+func (rc *relabelConfig) compile() error {
+	re, err := regexp.Compile("^(?:" + rc.Regex + ")$")
+	if err != nil {
+		return errors.Wrapf(ErrRelabelConfigInvalid, "regex: %s", err)
+	}
+	rc.regex = re
+
+	switch rc.Action {
+	case relabelReplace:
+		if rc.TargetLabel == "" {
+			return errors.Wrap(ErrRelabelConfigInvalid, "target_label required for replace")
+		}
+	case relabelHashMod:
+		if rc.TargetLabel == "" || rc.Modulus == 0 {
+			return errors.Wrap(ErrRelabelConfigInvalid, "target_label and modulus required for hashmod")
+		}
+	case relabelKeep, relabelDrop, relabelLabelDrop, relabelLabelKeep, relabelLabelMap:
+	default:
+		return errors.Wrapf(ErrRelabelConfigInvalid, "unknown action: %s", rc.Action)
+	}
+
+	return nil
+}
+
+// apply runs the rule on labels of the sample, metric name included as __name__.
+// Returns false if the sample should be dropped.
+func (rc *relabelConfig) apply(labels map[string]string) bool {
+	values := make([]string, 0, len(rc.SourceLabels))
+	for _, ln := range rc.SourceLabels {
+		values = append(values, labels[ln])
+	}
+	val := strings.Join(values, rc.Separator)
+
+	switch rc.Action {
+	case relabelKeep:
+		return rc.regex.MatchString(val)
+
+	case relabelDrop:
+		return !rc.regex.MatchString(val)
+
+	case relabelReplace:
+		indexes := rc.regex.FindStringSubmatchIndex(val)
+		if indexes == nil {
+			break
+		}
+		target := string(rc.regex.ExpandString(nil, rc.TargetLabel, val, indexes))
+		res := string(rc.regex.ExpandString(nil, rc.Replacement, val, indexes))
+		if res == "" {
+			delete(labels, target)
+			break
+		}
+		labels[target] = res
+
+	case relabelHashMod:
+		sum := md5.Sum([]byte(val))
+		labels[rc.TargetLabel] = strconv.FormatUint(binary.BigEndian.Uint64(sum[8:])%rc.Modulus, 10)
+
+	case relabelLabelDrop:
+		for ln := range labels {
+			if rc.regex.MatchString(ln) {
+				delete(labels, ln)
+			}
+		}
+
+	case relabelLabelKeep:
+		for ln := range labels {
+			if ln != relabelNameLabel && !rc.regex.MatchString(ln) {
+				delete(labels, ln)
+			}
+		}
+
+	case relabelLabelMap:
+		mapped := make(map[string]string)
+		for ln, lv := range labels {
+			if rc.regex.MatchString(ln) {
+				mapped[rc.regex.ReplaceAllString(ln, rc.Replacement)] = lv
+			}
+		}
+		for ln, lv := range mapped {
+			labels[ln] = lv
+		}
+	}
+
+	return true
+}
+
+// loadRelabelConfigs reads list of relabel rules in YAML.
+func loadRelabelConfigs(in io.Reader) ([]*relabelConfig, error) {
+	b, err := ioutil.ReadAll(in)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []*relabelConfig
+	if err := yaml.Unmarshal(b, &rules); err != nil {
+		return nil, errors.Wrap(err, "relabel: parse")
+	}
+
+	if err := compileRelabelConfigs(rules); err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+// compileRelabelConfigs validates all rules and prepares them for use.
+func compileRelabelConfigs(rules []*relabelConfig) error {
+	for i, rc := range rules {
+		if err := rc.compile(); err != nil {
+			return errors.Wrapf(err, "rule %d", i)
+		}
+	}
+	return nil
+}
+
+// relabeler applies relabel rules to samples before they are handed over to the collector.
+type relabeler struct {
+	rules   []*relabelConfig
+	rulesMu sync.RWMutex
+
+	metricSamplesDropped *prometheus.CounterVec
+}
+
+func newRelabeler(rules []*relabelConfig) *relabeler {
+	return &relabeler{
+		rules: rules,
+		metricSamplesDropped: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "app_relabel_samples_dropped_total",
+				Help: "Number of samples dropped by relabeling.",
+			},
+			[]string{"reason"},
+		),
+	}
+}
+
+// setRules replaces rules applied to the following samples.
+func (r *relabeler) setRules(rules []*relabelConfig) {
+	r.rulesMu.Lock()
+	r.rules = rules
+	r.rulesMu.Unlock()
+}
+
+// relabel applies all rules to the sample. Metric name is available to the rules as __name__ label.
+// Labels starting with __ are removed at the end.
+// Returns nil if the sample is dropped.
+func (r *relabeler) relabel(s *sample) *sample {
+	r.rulesMu.RLock()
+	rules := r.rules
+	r.rulesMu.RUnlock()
+	if len(rules) == 0 {
+		return s
+	}
+
+	labels := make(map[string]string, len(s.labels)+1)
+	for ln, lv := range s.labels {
+		labels[ln] = lv
+	}
+	labels[relabelNameLabel] = s.name
+
+	for _, rc := range rules {
+		if !rc.apply(labels) {
+			r.metricSamplesDropped.WithLabelValues("rule").Inc()
+			return nil
+		}
+	}
+
+	out := *s
+	out.name = labels[relabelNameLabel]
+	if !metricNameValid(out.name) {
+		r.metricSamplesDropped.WithLabelValues("invalid_name").Inc()
+		return nil
+	}
+
+	out.labels = make(map[string]string, len(labels))
+	for ln, lv := range labels {
+		if strings.HasPrefix(ln, relabelInternalPrefix) {
+			continue
+		}
+		if !relabelLabelNameRE.MatchString(ln) {
+			r.metricSamplesDropped.WithLabelValues("invalid_label").Inc()
+			return nil
+		}
+		out.labels[ln] = lv
+	}
+
+	return &out
+}
+
+// handler wraps sample handler so samples are relabeled first. Dropped samples are not passed on.
+func (r *relabeler) handler(next sampleHandler) sampleHandler {
+	return func(s *sample) error {
+		if s = r.relabel(s); s == nil {
+			return nil
+		}
+		return next(s)
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (r *relabeler) Describe(ch chan<- *prometheus.Desc) {
+	r.metricSamplesDropped.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (r *relabeler) Collect(ch chan<- prometheus.Metric) {
+	r.metricSamplesDropped.Collect(ch)
+}
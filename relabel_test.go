@@ -0,0 +1,195 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+
+	a "github.com/stretchr/testify/assert"
+)
+
+func thRelabeler(t *testing.T, config string) *relabeler {
+	rules, err := loadRelabelConfigs(strings.NewReader(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newRelabeler(rules)
+}
+
+func Test_Relabeler_Relabel(t *testing.T) {
+	tfSample := func() *sample {
+		return &sample{
+			name: "legacy_requests_total", kind: sampleCounter,
+			labels: map[string]string{"service": "srvA1", "host": "hostA", "phpVersion": "5.6"},
+			value:  1,
+		}
+	}
+
+	cases := map[string]struct {
+		config    string
+		expName   string
+		expLabels map[string]string
+	}{
+		"labeldrop": {
+			config: `
+- action: labeldrop
+  regex: phpVersion`,
+			expName:   "legacy_requests_total",
+			expLabels: map[string]string{"service": "srvA1", "host": "hostA"},
+		},
+		"labelkeep keeps name": {
+			config: `
+- action: labelkeep
+  regex: service`,
+			expName:   "legacy_requests_total",
+			expLabels: map[string]string{"service": "srvA1"},
+		},
+		"rename": {
+			config: `
+- source_labels: [__name__]
+  regex: legacy_(.*)
+  target_label: __name__
+  replacement: app_$1`,
+			expName:   "app_requests_total",
+			expLabels: map[string]string{"service": "srvA1", "host": "hostA", "phpVersion": "5.6"},
+		},
+		"replace from many labels": {
+			config: `
+- source_labels: [service, host]
+  separator: "@"
+  target_label: instance
+- action: labeldrop
+  regex: service|host|phpVersion`,
+			expName:   "legacy_requests_total",
+			expLabels: map[string]string{"instance": "srvA1@hostA"},
+		},
+		"replace with empty value removes label": {
+			config: `
+- source_labels: [missing]
+  target_label: phpVersion`,
+			expName:   "legacy_requests_total",
+			expLabels: map[string]string{"service": "srvA1", "host": "hostA"},
+		},
+		"replace not matching": {
+			config: `
+- source_labels: [host]
+  regex: hostB
+  target_label: env
+  replacement: prod`,
+			expName:   "legacy_requests_total",
+			expLabels: map[string]string{"service": "srvA1", "host": "hostA", "phpVersion": "5.6"},
+		},
+		"labelmap": {
+			config: `
+- action: labelmap
+  regex: (serv)ice
+  replacement: ${1}er
+- action: labeldrop
+  regex: service|host|phpVersion`,
+			expName:   "legacy_requests_total",
+			expLabels: map[string]string{"server": "srvA1"},
+		},
+		"hashmod": {
+			config: `
+- source_labels: [host]
+  action: hashmod
+  modulus: 1
+  target_label: __shard
+- source_labels: [__shard]
+  target_label: shard
+- action: labelkeep
+  regex: shard`,
+			expName:   "legacy_requests_total",
+			expLabels: map[string]string{"shard": "0"},
+		},
+		"keep matching": {
+			config: `
+- source_labels: [service]
+  action: keep
+  regex: srvA.*`,
+			expName:   "legacy_requests_total",
+			expLabels: map[string]string{"service": "srvA1", "host": "hostA", "phpVersion": "5.6"},
+		},
+	}
+
+	for k, tc := range cases {
+		r := thRelabeler(t, tc.config)
+		got := r.relabel(tfSample())
+		if !a.NotNil(t, got, k) {
+			continue
+		}
+		a.Equal(t, tc.expName, got.name, k)
+		a.Equal(t, tc.expLabels, got.labels, k)
+		a.Equal(t, sampleCounter, got.kind, k)
+		a.Equal(t, float64(1), got.value, k)
+	}
+}
+
+func Test_Relabeler_Relabel_Dropped(t *testing.T) {
+	cases := map[string]struct {
+		config    string
+		expReason string
+	}{
+		"drop": {`
+- source_labels: [__name__]
+  action: drop
+  regex: legacy_.*`, "rule"},
+		"keep not matching": {`
+- source_labels: [service]
+  action: keep
+  regex: srvB.*`, "rule"},
+		"invalid name": {`
+- target_label: __name__
+  replacement: invalid-name`, "invalid_name"},
+		"name with leading digit": {`
+- target_label: __name__
+  replacement: 9requests_total`, "invalid_name"},
+		"invalid label": {`
+- target_label: invalid-label
+  replacement: v`, "invalid_label"},
+	}
+
+	for k, tc := range cases {
+		r := thRelabeler(t, tc.config)
+		s := &sample{name: "legacy_requests_total", kind: sampleCounter, labels: map[string]string{"service": "srvA1"}}
+		a.Nil(t, r.relabel(s), k)
+
+		var mm dto.Metric
+		r.metricSamplesDropped.WithLabelValues(tc.expReason).Write(&mm)
+		a.Equal(t, float64(1), mm.Counter.GetValue(), k)
+	}
+}
+
+func Test_Relabeler_Handler(t *testing.T) {
+	r := thRelabeler(t, `
+- source_labels: [__name__]
+  action: drop
+  regex: debug_.*`)
+
+	var got []*sample
+	h := r.handler(func(s *sample) error {
+		got = append(got, s)
+		return nil
+	})
+
+	a.NoError(t, h(&sample{name: "debug_requests_total", kind: sampleCounter, labels: map[string]string{}}))
+	a.NoError(t, h(&sample{name: "requests_total", kind: sampleCounter, labels: map[string]string{}}))
+	if a.Len(t, got, 1) {
+		a.Equal(t, "requests_total", got[0].name)
+	}
+}
+
+func Test_LoadRelabelConfigs_Invalid(t *testing.T) {
+	for _, config := range []string{
+		`- action: unknown`,
+		`- regex: "("`,
+		`- action: replace`,
+		`- action: hashmod
+  target_label: shard`,
+		`not a list`,
+	} {
+		_, err := loadRelabelConfigs(strings.NewReader(config))
+		a.Error(t, err, config)
+	}
+}
@@ -12,23 +12,35 @@ import (
 
 type sampleHandler func(samples *sample) error
 
+type metadataHandler func(m *metadata) error
+
 type server struct {
-	sampleHandler sampleHandler
-	buf           []byte
+	sampleHandler   sampleHandler
+	metadataHandler metadataHandler
+	bufSize         int
+	// sourceLimiter limits packets and samples of every source. Nil if sources are not limited.
+	sourceLimiter *sourceLimiter
+	// sourceNamer adds name of the source to every sample. Nil if label is not added.
+	sourceNamer *sourceNamer
 
 	metricRequestsTotal           prometheus.Counter
 	metricSamplesTotal            prometheus.Counter
+	metricSamplesDropped          *prometheus.CounterVec
+	metricParseErrors             prometheus.Counter
+	metricMetadataErrors          prometheus.Counter
 	metricRequestHandlingDuration prometheus.Summary
 }
 
 // newServer is factory for UDP server for incoming metrics data
 //
 // handler is a function of sampleHandler type responsible for dealing with incoming samples
+// mHandler is a function of metadataHandler type responsible for dealing with incoming metadata
 // bs is a UDP buffer size in bytes
-func newServer(handler sampleHandler, bs int) *server {
+func newServer(handler sampleHandler, mHandler metadataHandler, bs int) *server {
 	s := server{
-		sampleHandler: handler,
-		buf:           make([]byte, bs),
+		sampleHandler:   handler,
+		metadataHandler: mHandler,
+		bufSize:         bs,
 		metricRequestsTotal: prometheus.NewCounter(
 			prometheus.CounterOpts{
 				Name: "app_ingress_requests_total",
@@ -41,6 +53,25 @@ func newServer(handler sampleHandler, bs int) *server {
 				Help: "Number of samples entering server.",
 			},
 		),
+		metricSamplesDropped: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "app_ingress_samples_dropped_total",
+				Help: "Number of samples dropped by server.",
+			},
+			[]string{"reason"},
+		),
+		metricParseErrors: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "app_ingress_packet_parse_errors_total",
+				Help: "Number of packets which could not be parsed till the end.",
+			},
+		),
+		metricMetadataErrors: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "app_ingress_metadata_errors_total",
+				Help: "Number of metadata entries rejected by the handler.",
+			},
+		),
 		metricRequestHandlingDuration: prometheus.NewSummary(
 			prometheus.SummaryOpts{
 				Name: "app_ingress_request_handling_duration_ns",
@@ -50,11 +81,21 @@ func newServer(handler sampleHandler, bs int) *server {
 	}
 	prometheus.MustRegister(s.metricRequestsTotal)
 	prometheus.MustRegister(s.metricSamplesTotal)
+	prometheus.MustRegister(s.metricSamplesDropped)
+	prometheus.MustRegister(s.metricParseErrors)
+	prometheus.MustRegister(s.metricMetadataErrors)
 	prometheus.MustRegister(s.metricRequestHandlingDuration)
 	return &s
 }
 
+// Listen starts listening for samples handled by the sample handler of the server.
 func (s *server) Listen(ip string, port int) error {
+	return s.listen(ip, port, s.sampleHandler, s.metadataHandler)
+}
+
+// listen starts listening for samples and metadata handled by the given handlers.
+// Server can listen on many ports, every listener has its own buffer and goroutine.
+func (s *server) listen(ip string, port int, handler sampleHandler, mHandler metadataHandler) error {
 	listenAddr := net.UDPAddr{
 		Port: port,
 		IP:   net.ParseIP(ip),
@@ -68,23 +109,55 @@ func (s *server) Listen(ip string, port int) error {
 		var (
 			reader *bytes.Reader
 			tS     time.Time
+			buf    = make([]byte, s.bufSize)
 		)
 
 		for {
-			n, _, _ := conn.ReadFromUDP(s.buf)
+			n, addr, _ := conn.ReadFromUDP(buf)
 
 			tS = time.Now()
 
 			s.metricRequestsTotal.Inc()
 
-			reader = bytes.NewReader(s.buf[:n])
+			// packet limit is checked before parsing, so flood from a single source is cheap to drop
+			limited := s.sourceLimiter != nil && addr != nil
+			if limited && !s.sourceLimiter.allowPacket(addr.IP) {
+				continue
+			}
+
+			reader = bytes.NewReader(buf[:n])
+
+			// samples parsed before the error are still handled, the rest of the packet is lost.
+			// Number of samples lost is not known, so packet is counted instead.
+			samples, metadata, err := parseSample(reader)
+			if err != nil {
+				s.metricParseErrors.Inc()
+			}
 
-			samples, _ := parseSample(reader)
+			// metadata goes first so it's known when metrics for samples from the same packet are created
+			for _, m := range metadata {
+				if err := mHandler(m); err != nil {
+					s.metricMetadataErrors.Inc()
+				}
+			}
 
 			s.metricSamplesTotal.Add(float64(len(samples)))
 
+			if limited {
+				samples = samples[:s.sourceLimiter.allowSamples(addr.IP, len(samples))]
+			}
+			if s.sourceNamer != nil && addr != nil {
+				s.sourceNamer.labelSamples(addr.IP, samples)
+			}
+
 			for _, sample := range samples {
-				_ = s.sampleHandler(sample)
+				err := handler(sample)
+				switch n := ingressDropped(err); {
+				case n > 0:
+					s.metricSamplesDropped.WithLabelValues("queue_full").Add(float64(n))
+				case err != nil:
+					s.metricSamplesDropped.WithLabelValues("handler_error").Inc()
+				}
 			}
 
 			s.metricRequestHandlingDuration.Observe(float64(time.Since(tS).Nanoseconds()))
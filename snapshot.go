@@ -0,0 +1,424 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/log"
+)
+
+const (
+	// snapshotMagic starts the header line of the snapshot file.
+	snapshotMagic = "prometheus-aggregator-snapshot"
+
+	// snapshotVersion is a version of the snapshot format written.
+	snapshotVersion = 1
+
+	// snapshotHeaderFormat is a format of the header line: magic, version and CRC32 (IEEE) of the payload.
+	snapshotHeaderFormat = "%s v%d %08x\n"
+)
+
+var (
+	// ErrSnapshotInvalid is returned when snapshot file is malformed.
+	ErrSnapshotInvalid = errors.New("snapshot: invalid file")
+
+	// ErrSnapshotVersion is returned when snapshot file is written in unsupported version of the format.
+	ErrSnapshotVersion = errors.New("snapshot: unsupported version")
+
+	// ErrSnapshotChecksum is returned when payload of the snapshot file does not match the checksum.
+	ErrSnapshotChecksum = errors.New("snapshot: checksum mismatch")
+)
+
+// snapshot is a persisted state of the series.
+// Only counters, gauges and histograms are included.
+type snapshot struct {
+	Created time.Time `json:"created"`
+	// WALSeq is a sequence number of the last sample from the write-ahead log included in the snapshot
+	WALSeq uint64            `json:"walSeq,omitempty"`
+	Series []*snapshotSeries `json:"series"`
+}
+
+// snapshotSeries is a persisted state of single series.
+type snapshotSeries struct {
+	Kind         sampleKind        `json:"kind"`
+	Name         string            `json:"name"`
+	Labels       map[string]string `json:"labels"`
+	HistogramDef []string          `json:"histogramDef,omitempty"`
+	Help         string            `json:"help"`
+
+	// Value is set for counters and gauges
+	Value persistedFloat `json:"value,omitempty"`
+
+	// Counts, Sum and Count are set for histograms. Counts are non-cumulative and include +Inf bucket.
+	Counts []persistedFloat `json:"counts,omitempty"`
+	Sum    persistedFloat   `json:"sum,omitempty"`
+	Count  persistedFloat   `json:"count,omitempty"`
+
+	// Schema, ZeroCount, Positive and Negative are set for native histograms, along with Sum.
+	// Buckets are keyed by index, schema is the current one as it's decreased when there are too many buckets.
+	Schema    int32                  `json:"schema,omitempty"`
+	ZeroCount persistedFloat         `json:"zeroCount,omitempty"`
+	Positive  map[int]persistedFloat `json:"positive,omitempty"`
+	Negative  map[int]persistedFloat `json:"negative,omitempty"`
+}
+
+// persistedFloat is a float encoded as JSON number, or as string if it's not finite (NaN, +Inf, -Inf),
+// as JSON has no numbers for them and single such value would fail encoding of the whole file.
+type persistedFloat float64
+
+// MarshalJSON implements json.Marshaler.
+func (f persistedFloat) MarshalJSON() ([]byte, error) {
+	v := float64(f)
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return json.Marshal(strconv.FormatFloat(v, 'g', -1, 64))
+	}
+	return json.Marshal(v)
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (f *persistedFloat) UnmarshalJSON(b []byte) error {
+	var v float64
+	if len(b) > 0 && b[0] == '"' {
+		var s string
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+		var err error
+		if v, err = strconv.ParseFloat(s, 64); err != nil {
+			return err
+		}
+	} else if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	*f = persistedFloat(v)
+	return nil
+}
+
+// snapshot creates copy of the state of all series.
+// Should be called only from process, it's the only one modifying storage.
+func (c *collector) snapshot() *snapshot {
+	out := snapshot{Created: time.Now(), WALSeq: c.walSeq}
+
+	for h, id := range c.identities {
+		// snapshot is encoded in background, so it shares nothing with the storage
+		labels := make(map[string]string, len(id.labels))
+		for k, v := range id.labels {
+			labels[k] = v
+		}
+		ss := snapshotSeries{
+			Kind:         id.kind,
+			Name:         id.name,
+			Labels:       labels,
+			HistogramDef: id.histogramDef,
+			Help:         c.families[id.name].help,
+		}
+
+		var mm dto.Metric
+		switch id.kind {
+		case sampleCounter:
+			m, found := c.counters[h]
+			if !found {
+				// delta series are not persisted
+				continue
+			}
+			m.Write(&mm)
+			ss.Value = persistedFloat(mm.Counter.GetValue())
+		case sampleGauge:
+			m, found := c.gauges[h]
+			if !found {
+				continue
+			}
+			m.Write(&mm)
+			ss.Value = persistedFloat(mm.Gauge.GetValue())
+		case sampleHistogramLinear, sampleHistogramExponential:
+			m := c.histograms[h]
+			m.mu.Lock()
+			ss.Counts = make([]persistedFloat, len(m.counts))
+			for i, v := range m.counts {
+				ss.Counts[i] = persistedFloat(v)
+			}
+			ss.Sum, ss.Count = persistedFloat(m.sum), persistedFloat(m.count)
+			m.mu.Unlock()
+		case sampleHistogramNative:
+			m := c.nativeHistograms[h]
+			m.mu.Lock()
+			ss.Schema, ss.ZeroCount, ss.Sum = m.schema, persistedFloat(m.zeroCount), persistedFloat(m.sum)
+			ss.Positive, ss.Negative = persistedBuckets(m.positive), persistedBuckets(m.negative)
+			m.mu.Unlock()
+		default:
+			continue
+		}
+
+		out.Series = append(out.Series, &ss)
+	}
+
+	return &out
+}
+
+// restore recreates series from the snapshot.
+// Should be called before processing is started.
+func (c *collector) restore(snap *snapshot) {
+	c.walSeq = snap.WALSeq
+
+	for _, ss := range snap.Series {
+		s := &sample{
+			name:         ss.Name,
+			kind:         ss.Kind,
+			labels:       ss.Labels,
+			value:        float64(ss.Value),
+			histogramDef: ss.HistogramDef,
+		}
+		if s.labels == nil {
+			s.labels = make(map[string]string)
+		}
+
+		// help of the family is persisted as metadata sent by clients is not
+		if _, found := c.families[s.name]; !found {
+			fam := newFamily(s, ss.Help)
+			fam.delta = c.deltaMetrics != nil && c.deltaMetrics.MatchString(s.name)
+			c.families[s.name] = fam
+		}
+
+		switch s.kind {
+		case sampleCounter:
+			c.processSample(s)
+		case sampleGauge:
+			c.processSample(s)
+			// restored value is not an observation of the current window
+			if g, found := c.gaugeAggs[c.seriesKey(s)]; found {
+				g.reset()
+			}
+		case sampleHistogramLinear, sampleHistogramExponential:
+			// empty aggregate creates the series without observations
+			buckets, err := histogramBuckets(s)
+			if err != nil || len(ss.Counts) != len(buckets)+1 {
+				continue
+			}
+			s.aggregate = &histogramAggregate{counts: make([]uint64, len(buckets))}
+			c.processSample(s)
+
+			m, found := c.histograms[c.seriesKey(s)]
+			if !found || !m.sameLayout(buckets) {
+				continue
+			}
+			m.mu.Lock()
+			for i, v := range ss.Counts {
+				m.counts[i] += float64(v)
+			}
+			m.sum += float64(ss.Sum)
+			m.count += float64(ss.Count)
+			m.mu.Unlock()
+		case sampleHistogramNative:
+			s.aggregate = &histogramAggregate{}
+			c.processSample(s)
+
+			m, found := c.nativeHistograms[c.seriesKey(s)]
+			if !found || ss.Schema < nativeHistogramSchemaMin || ss.Schema > m.schema {
+				continue
+			}
+			m.mu.Lock()
+			// state is restored at the persisted schema, lower than the defined one if there were too many buckets
+			m.schema = ss.Schema
+			for i, v := range ss.Positive {
+				m.positive[i] += float64(v)
+			}
+			for i, v := range ss.Negative {
+				m.negative[i] += float64(v)
+			}
+			m.zeroCount += float64(ss.ZeroCount)
+			m.sum += float64(ss.Sum)
+			m.mu.Unlock()
+		}
+	}
+}
+
+// persistedBuckets converts buckets of the native histogram to the persisted form.
+func persistedBuckets(buckets map[int]float64) map[int]persistedFloat {
+	out := make(map[int]persistedFloat, len(buckets))
+	for i, v := range buckets {
+		out[i] = persistedFloat(v)
+	}
+	return out
+}
+
+// snapshotResult is a result of the snapshot written in background.
+type snapshotResult struct {
+	err error
+	// walOffset is a size of the log with samples included in the snapshot, negative if unknown
+	walOffset int64
+	// walTruncations is a number of truncations of the log when offset was taken.
+	// Offset is stale if the log was truncated since then.
+	walTruncations uint64
+}
+
+// startSnapshot copies state of all series and writes it to the snapshot file in background,
+// so processing is not stalled by encoding and disk writes. Result is handled by finishSnapshot.
+// Snapshot is skipped if the previous one is still being written.
+// Should be called only from process.
+func (c *collector) startSnapshot() {
+	if c.snapshotDoneCh != nil {
+		c.metricSnapshots.WithLabelValues("skipped").Inc()
+		log.Warnf("Snapshot skipped, previous one is still being written")
+		return
+	}
+
+	snap := c.snapshot()
+	walOffset := int64(-1)
+	var walTruncations uint64
+	if c.wal != nil {
+		walTruncations = c.wal.truncations
+		// samples appended while snapshot is written are kept in the log
+		off, err := c.wal.offset()
+		if err != nil {
+			c.metricWALFailures.WithLabelValues("sync").Inc()
+			log.Errorf("WAL sync failed: %s", err)
+		} else {
+			walOffset = off
+		}
+	}
+
+	path := c.snapshotFile
+	done := make(chan *snapshotResult, 1)
+	c.snapshotDoneCh = done
+	go func() {
+		done <- &snapshotResult{err: writeSnapshot(path, snap), walOffset: walOffset, walTruncations: walTruncations}
+	}()
+}
+
+// finishSnapshot handles result of the snapshot written in background.
+// Samples included in the snapshot are removed from the log.
+// Should be called only from process.
+func (c *collector) finishSnapshot(res *snapshotResult) {
+	c.snapshotDoneCh = nil
+
+	if res.err != nil {
+		c.metricSnapshots.WithLabelValues("failure").Inc()
+		log.Errorf("Snapshot write failed: %s", res.err)
+		return
+	}
+	c.metricSnapshots.WithLabelValues("success").Inc()
+
+	// records appended after the log was truncated by the size limit are not in the snapshot
+	if c.wal != nil && res.walOffset >= 0 && res.walTruncations == c.wal.truncations {
+		if err := c.wal.discard(res.walOffset); err != nil {
+			c.metricWALFailures.WithLabelValues("truncate").Inc()
+			log.Errorf("WAL truncate failed: %s", err)
+		}
+		c.metricWALSize.Set(float64(c.wal.size))
+	}
+}
+
+// saveSnapshot writes state of all series to the snapshot file and waits for the write.
+// Should be called only from process.
+func (c *collector) saveSnapshot() error {
+	if err := writeSnapshot(c.snapshotFile, c.snapshot()); err != nil {
+		c.metricSnapshots.WithLabelValues("failure").Inc()
+		log.Errorf("Snapshot write failed: %s", err)
+		return err
+	}
+	c.metricSnapshots.WithLabelValues("success").Inc()
+
+	// samples in the log are persisted in the snapshot
+	if c.wal != nil {
+		if err := c.wal.truncate(); err != nil {
+			c.metricWALFailures.WithLabelValues("truncate").Inc()
+			log.Errorf("WAL truncate failed: %s", err)
+		}
+		c.metricWALSize.Set(float64(c.wal.size))
+	}
+	return nil
+}
+
+// writeSnapshot writes snapshot to the file atomically.
+// Content is written to a temporary file in the same directory, synced and renamed over the target.
+func writeSnapshot(path string, snap *snapshot) error {
+	payload, err := json.Marshal(snap)
+	if err != nil {
+		return errors.Wrap(err, "snapshot: encode")
+	}
+
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.Wrap(err, "snapshot: create")
+	}
+
+	w := bufio.NewWriter(f)
+	fmt.Fprintf(w, snapshotHeaderFormat, snapshotMagic, snapshotVersion, crc32.ChecksumIEEE(payload))
+	w.Write(payload)
+	if err := w.Flush(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return errors.Wrap(err, "snapshot: write")
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return errors.Wrap(err, "snapshot: sync")
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return errors.Wrap(err, "snapshot: close")
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return errors.Wrap(err, "snapshot: rename")
+	}
+
+	// rename is durable only after the directory is synced
+	if d, err := os.Open(filepath.Dir(path)); err == nil {
+		d.Sync()
+		d.Close()
+	}
+
+	return nil
+}
+
+// readSnapshot reads and verifies snapshot file.
+func readSnapshot(path string) (*snapshot, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	i := bytes.IndexByte(b, '\n')
+	if i < 0 {
+		return nil, ErrSnapshotInvalid
+	}
+
+	var (
+		magic    string
+		version  int
+		checksum uint32
+	)
+	if _, err := fmt.Sscanf(string(b[:i+1]), snapshotHeaderFormat, &magic, &version, &checksum); err != nil || magic != snapshotMagic {
+		return nil, ErrSnapshotInvalid
+	}
+	if version != snapshotVersion {
+		return nil, ErrSnapshotVersion
+	}
+
+	payload := b[i+1:]
+	if crc32.ChecksumIEEE(payload) != checksum {
+		return nil, ErrSnapshotChecksum
+	}
+
+	var snap snapshot
+	if err := json.Unmarshal(payload, &snap); err != nil {
+		return nil, ErrSnapshotInvalid
+	}
+
+	return &snap, nil
+}
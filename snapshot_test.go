@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+
+	a "github.com/stretchr/testify/assert"
+)
+
+func thSnapshotDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+var tfSnapshotSamples = []*sample{
+	{name: "name_of_1_metric_total", kind: sampleCounter, labels: map[string]string{"labelA": "labelValueA"}, value: 3, rate: 0.5},
+	{name: "name_of_2_metric", kind: sampleGauge, labels: map[string]string{}, value: 7.3},
+	{name: "name_of_3_metric_seconds", kind: sampleHistogramLinear, labels: map[string]string{}, value: 2.5, rate: 0.3, histogramDef: []string{"1", "1", "3"}},
+	{name: "name_of_3_metric_seconds", kind: sampleHistogramLinear, labels: map[string]string{}, value: 10, histogramDef: []string{"1", "1", "3"}},
+	{name: "name_of_4_metric_users", kind: sampleSet, labels: map[string]string{}, member: "user1"},
+}
+
+func Test_Collector_SnapshotRestore(t *testing.T) {
+	dir, cleanup := thSnapshotDir(t)
+	defer cleanup()
+	path := filepath.Join(dir, "state.snapshot")
+
+	src := newCollector()
+	src.hasher = hashMD5
+	a.NoError(t, src.WriteMetadata(&metadata{name: "name_of_2_metric", kind: metadataHelp, value: "Current value."}))
+	thCollectorProcessPopulate(src, tfSnapshotSamples)
+	thCollectorProcessSynchronise(t, src)
+
+	if !a.NoError(t, writeSnapshot(path, src.snapshot())) {
+		t.FailNow()
+	}
+	snap, err := readSnapshot(path)
+	if !a.NoError(t, err) {
+		t.FailNow()
+	}
+	// sets are not persisted
+	a.Len(t, snap.Series, 3)
+
+	dst := newCollector()
+	dst.hasher = hashMD5
+	dst.restore(snap)
+
+	var mm dto.Metric
+	dst.counters[string(dst.hasher(tfSnapshotSamples[0]))].Write(&mm)
+	a.Equal(t, float64(6), mm.Counter.GetValue())
+
+	g := dst.gauges[string(dst.hasher(tfSnapshotSamples[1]))]
+	g.Write(&mm)
+	a.Equal(t, 7.3, mm.Gauge.GetValue())
+	a.Contains(t, g.Desc().String(), `help: "Current value."`)
+
+	srcH := src.histograms[string(src.hasher(tfSnapshotSamples[2]))]
+	dstH := dst.histograms[string(dst.hasher(tfSnapshotSamples[2]))]
+	if !a.NotNil(t, dstH) {
+		t.FailNow()
+	}
+	// fractional counts of sampled observations are kept
+	a.Equal(t, srcH.counts, dstH.counts)
+	a.Equal(t, srcH.sum, dstH.sum)
+	a.Equal(t, srcH.count, dstH.count)
+
+	a.Len(t, dst.sets, 0)
+}
+
+func Test_Collector_SnapshotRestore_NonFinite(t *testing.T) {
+	dir, cleanup := thSnapshotDir(t)
+	defer cleanup()
+	path := filepath.Join(dir, "state.snapshot")
+
+	samples := []*sample{
+		{name: "name_of_1_metric", kind: sampleGauge, labels: map[string]string{}, value: math.Inf(1)},
+		{name: "name_of_2_metric", kind: sampleGauge, labels: map[string]string{}, value: 2},
+	}
+	src := newCollector()
+	src.hasher = hashMD5
+	thCollectorProcessPopulate(src, samples)
+	thCollectorProcessSynchronise(t, src)
+
+	// single non-finite value does not fail the whole snapshot
+	if !a.NoError(t, writeSnapshot(path, src.snapshot())) {
+		t.FailNow()
+	}
+	snap, err := readSnapshot(path)
+	if !a.NoError(t, err) {
+		t.FailNow()
+	}
+
+	dst := newCollector()
+	dst.hasher = hashMD5
+	dst.restore(snap)
+
+	var mm dto.Metric
+	dst.gauges[string(dst.hasher(samples[0]))].Write(&mm)
+	a.True(t, math.IsInf(mm.Gauge.GetValue(), 1))
+	dst.gauges[string(dst.hasher(samples[1]))].Write(&mm)
+	a.Equal(t, float64(2), mm.Gauge.GetValue())
+}
+
+func Test_PersistedFloat_JSON(t *testing.T) {
+	for _, v := range []float64{0, -1.5, 1e300, math.Inf(1), math.Inf(-1), math.NaN()} {
+		b, err := json.Marshal(persistedFloat(v))
+		if !a.NoError(t, err, "value: %v", v) {
+			continue
+		}
+		var got persistedFloat
+		a.NoError(t, json.Unmarshal(b, &got), "value: %v", v)
+		if math.IsNaN(v) {
+			a.True(t, math.IsNaN(float64(got)))
+			continue
+		}
+		a.Equal(t, v, float64(got))
+	}
+
+	var got persistedFloat
+	a.Error(t, json.Unmarshal([]byte(`"not a number"`), &got))
+}
+
+func Test_ReadSnapshot_Failure(t *testing.T) {
+	dir, cleanup := thSnapshotDir(t)
+	defer cleanup()
+	path := filepath.Join(dir, "state.snapshot")
+
+	if err := writeSnapshot(path, &snapshot{}); err != nil {
+		t.Fatal(err)
+	}
+	valid, _ := ioutil.ReadFile(path)
+
+	cases := map[string]struct {
+		content []byte
+		exp     error
+	}{
+		"no header":       {[]byte(`{"series":[]}`), ErrSnapshotInvalid},
+		"other magic":     {[]byte(strings.Replace(string(valid), snapshotMagic, "other", 1)), ErrSnapshotInvalid},
+		"version":         {[]byte(strings.Replace(string(valid), " v1 ", " v2 ", 1)), ErrSnapshotVersion},
+		"corrupted":       {append(valid[:len(valid)-1:len(valid)-1], '!'), ErrSnapshotChecksum},
+		"truncated":       {valid[:len(valid)-2], ErrSnapshotChecksum},
+		"invalid payload": {[]byte(snapshotMagic + " v1 00000000\n"), ErrSnapshotInvalid},
+	}
+
+	for k, tc := range cases {
+		if err := ioutil.WriteFile(path, tc.content, 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := readSnapshot(path)
+		a.Equal(t, tc.exp, err, k)
+	}
+
+	_, err := readSnapshot(filepath.Join(dir, "missing"))
+	a.True(t, os.IsNotExist(err))
+}
+
+func Test_Collector_Process_SnapshotOnStop(t *testing.T) {
+	dir, cleanup := thSnapshotDir(t)
+	defer cleanup()
+
+	c := newCollector()
+	c.snapshotFile = filepath.Join(dir, "state.snapshot")
+	c.shutdownTimeout = time.Second
+	go c.process()
+	if err := c.stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := readSnapshot(c.snapshotFile)
+	a.NoError(t, err)
+	// temporary file is renamed over the target
+	_, err = os.Stat(c.snapshotFile + ".tmp")
+	a.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"container/list"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// sourceLimitsMaxSourcesDefault is a default bound of the number of tracked sources.
+	sourceLimitsMaxSourcesDefault = 10000
+
+	// sourceLimitDefaultID identifies default limit in metrics.
+	sourceLimitDefaultID = "default"
+)
+
+// ErrSourceLimitInvalid is returned when source limit is not valid.
+var ErrSourceLimitInvalid = errors.New("source limits: invalid limit")
+
+// sourceLimitsConfig defines rate limits of the sources (hosts) sending samples.
+type sourceLimitsConfig struct {
+	// MaxSources bounds number of the tracked sources, the least recently seen one is forgotten above it.
+	MaxSources int `yaml:"max_sources"`
+	// Default applies to every source not matched by any rule. Nil leaves such sources unlimited.
+	Default *sourceLimit `yaml:"default"`
+	// Rules apply to sources from their networks. First matching rule wins.
+	Rules []*sourceLimit `yaml:"rules"`
+}
+
+// sourceLimit is a token bucket limit of the samples and packets. Zero rate leaves the unit unlimited.
+type sourceLimit struct {
+	// ID identifies the limit in metrics, defaults to CIDR
+	ID   string `yaml:"id"`
+	CIDR string `yaml:"cidr"`
+	// Shared makes all sources from the network share single limit, otherwise every IP has its own one
+	Shared bool `yaml:"shared"`
+
+	SamplesPerSecond float64 `yaml:"samples_per_second"`
+	// SamplesBurst is a number of samples accepted above the rate in short bursts. Defaults to the rate.
+	SamplesBurst     float64 `yaml:"samples_burst"`
+	PacketsPerSecond float64 `yaml:"packets_per_second"`
+	// PacketsBurst is a number of packets accepted above the rate in short bursts. Defaults to the rate.
+	PacketsBurst float64 `yaml:"packets_burst"`
+
+	network *net.IPNet
+}
+
+// compile validates the limit and prepares it for use.
+func (l *sourceLimit) compile() error {
+	if l.CIDR != "" {
+		_, network, err := net.ParseCIDR(l.CIDR)
+		if err != nil {
+			return errors.Wrapf(ErrSourceLimitInvalid, "cidr: %s", err)
+		}
+		l.network = network
+		if l.ID == "" {
+			l.ID = network.String()
+		}
+	}
+	if l.SamplesPerSecond < 0 || l.SamplesBurst < 0 || l.PacketsPerSecond < 0 || l.PacketsBurst < 0 {
+		return errors.Wrap(ErrSourceLimitInvalid, "negative rate")
+	}
+	if l.SamplesPerSecond == 0 && l.PacketsPerSecond == 0 {
+		return errors.Wrap(ErrSourceLimitInvalid, "samples_per_second or packets_per_second required")
+	}
+	return nil
+}
+
+// compile validates all limits and prepares them for use. Missing values are set to defaults.
+func (cfg *sourceLimitsConfig) compile() error {
+	if cfg.MaxSources < 0 {
+		return errors.Wrap(ErrSourceLimitInvalid, "negative max_sources")
+	}
+	if cfg.MaxSources == 0 {
+		cfg.MaxSources = sourceLimitsMaxSourcesDefault
+	}
+
+	ids := map[string]struct{}{sourceLimitDefaultID: {}}
+	for i, l := range cfg.Rules {
+		if l.CIDR == "" {
+			return errors.Wrapf(ErrSourceLimitInvalid, "rule %d: cidr required", i)
+		}
+		if err := l.compile(); err != nil {
+			return errors.Wrapf(err, "rule %d", i)
+		}
+		if _, found := ids[l.ID]; found {
+			return errors.Wrapf(ErrSourceLimitInvalid, "rule %d: duplicated id: %s", i, l.ID)
+		}
+		ids[l.ID] = struct{}{}
+	}
+
+	if cfg.Default != nil {
+		if cfg.Default.CIDR != "" {
+			return errors.Wrap(ErrSourceLimitInvalid, "default: cidr not allowed")
+		}
+		cfg.Default.ID = sourceLimitDefaultID
+		if err := cfg.Default.compile(); err != nil {
+			return errors.Wrap(err, "default")
+		}
+	}
+
+	return nil
+}
+
+// match finds limit of the source. Returns nil if source is not limited.
+func (cfg *sourceLimitsConfig) match(ip net.IP) *sourceLimit {
+	for _, l := range cfg.Rules {
+		if l.network.Contains(ip) {
+			return l
+		}
+	}
+	return cfg.Default
+}
+
+// sourceState holds buckets of the single source, or of the network with shared limit.
+type sourceState struct {
+	key     string
+	packets *tokenBucket
+	samples *tokenBucket
+}
+
+// sourceLimiter applies rate limits to the sources in the server read loops.
+// Number of the tracked sources is bounded, the least recently seen one is forgotten (with its buckets) above the bound.
+type sourceLimiter struct {
+	// mu guards all fields below, samples come from many listeners
+	mu      sync.Mutex
+	cfg     *sourceLimitsConfig
+	sources map[string]*list.Element
+	// recent holds sources ordered by the last packet, the most recent at front
+	recent *list.List
+
+	metricDropped        *prometheus.CounterVec
+	metricSourcesTracked prometheus.Gauge
+	metricSourcesEvicted prometheus.Counter
+}
+
+func newSourceLimiter(cfg *sourceLimitsConfig) *sourceLimiter {
+	sl := &sourceLimiter{
+		metricDropped: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "app_ingress_rate_limited_total",
+				Help: "Number of packets and samples dropped due to rate limit of the source.",
+			},
+			[]string{"limit", "unit"},
+		),
+		metricSourcesTracked: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "app_ingress_sources_tracked",
+				Help: "Number of sources tracked by the rate limiter.",
+			},
+		),
+		metricSourcesEvicted: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "app_ingress_sources_evicted_total",
+				Help: "Number of sources forgotten by the rate limiter due to the bound of tracked sources.",
+			},
+		),
+	}
+	sl.setConfig(cfg)
+	return sl
+}
+
+// setConfig replaces limits. State of all sources is forgotten.
+func (sl *sourceLimiter) setConfig(cfg *sourceLimitsConfig) {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+
+	sl.cfg = cfg
+	sl.sources = make(map[string]*list.Element)
+	sl.recent = list.New()
+	sl.metricSourcesTracked.Set(0)
+}
+
+// state returns state of the source, created if needed. Returns nil if the source is not limited.
+// Should be called with mu locked.
+func (sl *sourceLimiter) state(ip net.IP, now time.Time) (*sourceLimit, *sourceState) {
+	l := sl.cfg.match(ip)
+	if l == nil {
+		return nil, nil
+	}
+
+	key := l.ID
+	if !l.Shared {
+		key += "|" + ip.String()
+	}
+
+	if e, found := sl.sources[key]; found {
+		sl.recent.MoveToFront(e)
+		return l, e.Value.(*sourceState)
+	}
+
+	st := &sourceState{key: key}
+	if l.PacketsPerSecond > 0 {
+		burst := l.PacketsBurst
+		if burst == 0 {
+			burst = l.PacketsPerSecond
+		}
+		st.packets = newTokenBucket(l.PacketsPerSecond, burst, now)
+	}
+	if l.SamplesPerSecond > 0 {
+		burst := l.SamplesBurst
+		if burst == 0 {
+			burst = l.SamplesPerSecond
+		}
+		st.samples = newTokenBucket(l.SamplesPerSecond, burst, now)
+	}
+	sl.sources[key] = sl.recent.PushFront(st)
+
+	for len(sl.sources) > sl.cfg.MaxSources {
+		oldest := sl.recent.Back()
+		sl.recent.Remove(oldest)
+		delete(sl.sources, oldest.Value.(*sourceState).key)
+		sl.metricSourcesEvicted.Inc()
+	}
+	sl.metricSourcesTracked.Set(float64(len(sl.sources)))
+
+	return l, st
+}
+
+// allowPacket checks packet limit of the source.
+func (sl *sourceLimiter) allowPacket(ip net.IP) bool {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+
+	now := time.Now()
+	l, st := sl.state(ip, now)
+	if st == nil || st.packets == nil || st.packets.allow(now, 1) {
+		return true
+	}
+	sl.metricDropped.WithLabelValues(l.ID, "packets").Inc()
+	return false
+}
+
+// allowSamples checks samples limit of the source. Returns number of the samples allowed, out of n.
+func (sl *sourceLimiter) allowSamples(ip net.IP, n int) int {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+
+	now := time.Now()
+	l, st := sl.state(ip, now)
+	if st == nil || st.samples == nil {
+		return n
+	}
+
+	allowed := 0
+	for allowed < n && st.samples.allow(now, 1) {
+		allowed++
+	}
+	if allowed < n {
+		sl.metricDropped.WithLabelValues(l.ID, "samples").Add(float64(n - allowed))
+	}
+	return allowed
+}
+
+// Describe implements prometheus.Collector.
+func (sl *sourceLimiter) Describe(ch chan<- *prometheus.Desc) {
+	sl.metricDropped.Describe(ch)
+	sl.metricSourcesTracked.Describe(ch)
+	sl.metricSourcesEvicted.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (sl *sourceLimiter) Collect(ch chan<- prometheus.Metric) {
+	sl.metricDropped.Collect(ch)
+	sl.metricSourcesTracked.Collect(ch)
+	sl.metricSourcesEvicted.Collect(ch)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+
+	a "github.com/stretchr/testify/assert"
+)
+
+func thSourceLimiter(t *testing.T, cfg *sourceLimitsConfig) *sourceLimiter {
+	if !a.NoError(t, cfg.compile()) {
+		t.FailNow()
+	}
+	return newSourceLimiter(cfg)
+}
+
+func Test_SourceLimitsConfig_Compile(t *testing.T) {
+	valid := func() *sourceLimitsConfig {
+		return &sourceLimitsConfig{
+			Default: &sourceLimit{PacketsPerSecond: 100},
+			Rules: []*sourceLimit{
+				{CIDR: "10.1.0.0/16", SamplesPerSecond: 1000},
+				{ID: "office", CIDR: "192.168.0.0/24", Shared: true, PacketsPerSecond: 10, SamplesPerSecond: 100},
+			},
+		}
+	}
+	cfg := valid()
+	a.NoError(t, cfg.compile())
+	a.Equal(t, sourceLimitsMaxSourcesDefault, cfg.MaxSources)
+	a.Equal(t, "10.1.0.0/16", cfg.Rules[0].ID)
+	a.Equal(t, sourceLimitDefaultID, cfg.Default.ID)
+
+	cases := map[string]func(cfg *sourceLimitsConfig){
+		"invalid cidr":        func(cfg *sourceLimitsConfig) { cfg.Rules[0].CIDR = "10.1.0.0/33" },
+		"missing cidr":        func(cfg *sourceLimitsConfig) { cfg.Rules[0].CIDR = "" },
+		"cidr of default":     func(cfg *sourceLimitsConfig) { cfg.Default.CIDR = "10.0.0.0/8" },
+		"duplicated id":       func(cfg *sourceLimitsConfig) { cfg.Rules[1].ID = "10.1.0.0/16" },
+		"default id":          func(cfg *sourceLimitsConfig) { cfg.Rules[1].ID = "default" },
+		"no rate":             func(cfg *sourceLimitsConfig) { cfg.Rules[0].SamplesPerSecond = 0 },
+		"negative rate":       func(cfg *sourceLimitsConfig) { cfg.Rules[1].PacketsPerSecond = -1 },
+		"negative burst":      func(cfg *sourceLimitsConfig) { cfg.Default.PacketsBurst = -1 },
+		"negative max_source": func(cfg *sourceLimitsConfig) { cfg.MaxSources = -1 },
+	}
+	for k, modify := range cases {
+		cfg := valid()
+		modify(cfg)
+		a.Error(t, cfg.compile(), k)
+	}
+}
+
+func Test_SourceLimiter_AllowPacket(t *testing.T) {
+	sl := thSourceLimiter(t, &sourceLimitsConfig{
+		Default: &sourceLimit{PacketsPerSecond: 0.001, PacketsBurst: 2},
+		Rules: []*sourceLimit{
+			{ID: "office", CIDR: "192.168.0.0/24", Shared: true, PacketsPerSecond: 0.001},
+			{CIDR: "10.1.0.0/16", SamplesPerSecond: 1000},
+		},
+	})
+
+	ipA, ipB := net.ParseIP("172.16.0.1"), net.ParseIP("172.16.0.2")
+	for i := 0; i < 2; i++ {
+		a.True(t, sl.allowPacket(ipA), "burst %d", i)
+	}
+	a.False(t, sl.allowPacket(ipA))
+	// every source has its own limit
+	a.True(t, sl.allowPacket(ipB))
+
+	// sources of the shared limit share tokens
+	a.True(t, sl.allowPacket(net.ParseIP("192.168.0.1")))
+	a.False(t, sl.allowPacket(net.ParseIP("192.168.0.2")))
+
+	// packets are not limited by the rule limiting samples only
+	for i := 0; i < 5; i++ {
+		a.True(t, sl.allowPacket(net.ParseIP("10.1.0.1")))
+	}
+
+	var mm dto.Metric
+	sl.metricDropped.WithLabelValues("default", "packets").Write(&mm)
+	a.Equal(t, float64(1), mm.Counter.GetValue())
+	sl.metricDropped.WithLabelValues("office", "packets").Write(&mm)
+	a.Equal(t, float64(1), mm.Counter.GetValue())
+}
+
+func Test_SourceLimiter_AllowSamples(t *testing.T) {
+	sl := thSourceLimiter(t, &sourceLimitsConfig{
+		Rules: []*sourceLimit{
+			{CIDR: "10.1.0.0/16", SamplesPerSecond: 0.001, SamplesBurst: 5},
+		},
+	})
+
+	ip := net.ParseIP("10.1.0.1")
+	a.Equal(t, 3, sl.allowSamples(ip, 3))
+	a.Equal(t, 2, sl.allowSamples(ip, 3))
+	a.Equal(t, 0, sl.allowSamples(ip, 3))
+
+	// sources not matched by any rule are not limited without default
+	a.Equal(t, 100, sl.allowSamples(net.ParseIP("10.2.0.1"), 100))
+	a.Len(t, sl.sources, 1)
+
+	var mm dto.Metric
+	sl.metricDropped.WithLabelValues("10.1.0.0/16", "samples").Write(&mm)
+	a.Equal(t, float64(4), mm.Counter.GetValue())
+}
+
+func Test_SourceLimiter_MaxSources(t *testing.T) {
+	sl := thSourceLimiter(t, &sourceLimitsConfig{
+		MaxSources: 2,
+		Default:    &sourceLimit{PacketsPerSecond: 0.001},
+	})
+
+	ipA, ipB, ipC := net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2"), net.ParseIP("10.0.0.3")
+	a.True(t, sl.allowPacket(ipA))
+	a.True(t, sl.allowPacket(ipB))
+	a.False(t, sl.allowPacket(ipA))
+
+	// B is the least recently seen, so it's forgotten
+	a.True(t, sl.allowPacket(ipC))
+	a.Len(t, sl.sources, 2)
+	a.False(t, sl.allowPacket(ipA))
+	a.True(t, sl.allowPacket(ipB), "forgotten source starts with full bucket")
+
+	var mm dto.Metric
+	sl.metricSourcesEvicted.Write(&mm)
+	a.Equal(t, float64(2), mm.Counter.GetValue())
+	sl.metricSourcesTracked.Write(&mm)
+	a.Equal(t, float64(2), mm.Gauge.GetValue())
+
+	// new config resets state of all sources
+	sl.setConfig(&sourceLimitsConfig{MaxSources: 2})
+	a.True(t, sl.allowPacket(ipA))
+	a.Len(t, sl.sources, 0)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// sourceNamerCacheSize bounds number of the names resolved by reverse DNS kept in cache.
+	sourceNamerCacheSize = 10000
+	// sourceNamerMaxLookups bounds number of the reverse DNS lookups running at the same time.
+	sourceNamerMaxLookups = 16
+)
+
+// ErrSourceNamesInvalid is returned when source names config is not valid.
+var ErrSourceNamesInvalid = errors.New("source names: invalid config")
+
+// sourceNamesConfig maps networks of the sources to static names.
+type sourceNamesConfig struct {
+	Sources []*sourceName `yaml:"sources"`
+}
+
+type sourceName struct {
+	CIDR string `yaml:"cidr"`
+	Name string `yaml:"name"`
+
+	network *net.IPNet
+}
+
+// loadSourceNamesConfig reads static names of the sources.
+func loadSourceNamesConfig(in io.Reader) (*sourceNamesConfig, error) {
+	b, err := ioutil.ReadAll(in)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg sourceNamesConfig
+	if err := yaml.Unmarshal(b, &cfg); err != nil {
+		return nil, errors.Wrap(err, "source names: parse")
+	}
+
+	for i, sn := range cfg.Sources {
+		_, network, err := net.ParseCIDR(sn.CIDR)
+		if err != nil {
+			return nil, errors.Wrapf(ErrSourceNamesInvalid, "source %d: cidr: %s", i, err)
+		}
+		if sn.Name == "" {
+			return nil, errors.Wrapf(ErrSourceNamesInvalid, "source %d: name required", i)
+		}
+		sn.network = network
+	}
+
+	return &cfg, nil
+}
+
+// sourceNameEntry is a name of the source used in the label, with the name resolved by reverse DNS.
+type sourceNameEntry struct {
+	// name is used in the label until the entry expires
+	name string
+	// resolved is a name returned by the last successful lookup, it replaces name when the entry expires
+	resolved string
+	expires  time.Time
+	// pending is set while the lookup is running
+	pending bool
+}
+
+// sourceNamer adds name of the source (sender of the packet) as a label of every sample.
+// Name is taken from the static config (first matching network), from reverse DNS if enabled, or it's the IP address.
+//
+// Reverse DNS lookups are run in background, so they never block reading of the packets.
+// Name used first for the source is kept until its entry expires, so the source is not split into series
+// with different labels when the lookup is done. New source is labeled with the IP address for the first TTL,
+// afterwards with the name resolved by the last successful lookup. Failed refresh keeps the name resolved before.
+type sourceNamer struct {
+	label string
+	names []*sourceName
+
+	reverseDNS bool
+	cacheTTL   time.Duration
+	lookupAddr func(addr string) ([]string, error)
+	// lookupSem bounds number of the running lookups, lookup is not started if it's full
+	lookupSem chan struct{}
+
+	// cacheMu guards cache, names are resolved by many listeners and lookups
+	cacheMu sync.Mutex
+	cache   map[string]*sourceNameEntry
+
+	metricLookups *prometheus.CounterVec
+}
+
+// newSourceNamer creates namer adding label with given name. Reverse DNS is used if cacheTTL is positive.
+func newSourceNamer(label string, cfg *sourceNamesConfig, cacheTTL time.Duration) *sourceNamer {
+	return &sourceNamer{
+		label:      label,
+		names:      cfg.Sources,
+		reverseDNS: cacheTTL > 0,
+		cacheTTL:   cacheTTL,
+		lookupAddr: net.LookupAddr,
+		lookupSem:  make(chan struct{}, sourceNamerMaxLookups),
+		cache:      make(map[string]*sourceNameEntry),
+		metricLookups: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "app_ingress_source_lookups_total",
+				Help: "Number of reverse DNS lookups of the sources.",
+			},
+			[]string{"result"},
+		),
+	}
+}
+
+// name returns name of the source.
+func (sn *sourceNamer) name(ip net.IP) string {
+	for _, n := range sn.names {
+		if n.network.Contains(ip) {
+			return n.Name
+		}
+	}
+
+	addr := ip.String()
+	if !sn.reverseDNS {
+		return addr
+	}
+
+	now := time.Now()
+	sn.cacheMu.Lock()
+	defer sn.cacheMu.Unlock()
+
+	e, found := sn.cache[addr]
+	if found {
+		if e.pending || now.Before(e.expires) {
+			return e.name
+		}
+		// label changes only when the entry expires
+		if e.resolved != "" {
+			e.name = e.resolved
+		}
+	}
+
+	select {
+	case sn.lookupSem <- struct{}{}:
+	default:
+		// too many lookups are running, it's retried with the next packet of the source
+		sn.metricLookups.WithLabelValues("skipped").Inc()
+		if found {
+			return e.name
+		}
+		return addr
+	}
+
+	if !found {
+		if len(sn.cache) >= sourceNamerCacheSize {
+			sn.evict()
+		}
+		// IP is used until the entry expires, also if the lookup is done earlier
+		e = &sourceNameEntry{name: addr}
+		sn.cache[addr] = e
+	}
+	e.pending = true
+	e.expires = now.Add(sn.cacheTTL)
+	go sn.lookup(addr, e)
+
+	return e.name
+}
+
+// evict removes an arbitrary entry which is not pending, map iteration order is not specified.
+// Pending entries are never removed, so they are not looked up again. Cache must be locked by the caller.
+func (sn *sourceNamer) evict() {
+	for k, e := range sn.cache {
+		if !e.pending {
+			delete(sn.cache, k)
+			return
+		}
+	}
+}
+
+// lookup resolves name of the source by reverse DNS. Resolved name is used when the entry expires.
+// Name resolved before is kept if lookup fails.
+func (sn *sourceNamer) lookup(addr string, e *sourceNameEntry) {
+	defer func() { <-sn.lookupSem }()
+
+	var name string
+	names, err := sn.lookupAddr(addr)
+	switch {
+	case err != nil || len(names) == 0:
+		sn.metricLookups.WithLabelValues("failure").Inc()
+	default:
+		sn.metricLookups.WithLabelValues("success").Inc()
+		name = strings.TrimSuffix(names[0], ".")
+	}
+
+	sn.cacheMu.Lock()
+	defer sn.cacheMu.Unlock()
+	if name != "" {
+		e.resolved = name
+	}
+	e.pending = false
+}
+
+// labelSamples adds name of the source to all samples. Label sent by the client is overwritten.
+// Samples are modified in place, they have to be owned by the caller.
+func (sn *sourceNamer) labelSamples(ip net.IP, samples []*sample) {
+	if len(samples) == 0 {
+		return
+	}
+	name := sn.name(ip)
+	for _, s := range samples {
+		s.labels[sn.label] = name
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (sn *sourceNamer) Describe(ch chan<- *prometheus.Desc) {
+	sn.metricLookups.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (sn *sourceNamer) Collect(ch chan<- prometheus.Metric) {
+	sn.metricLookups.Collect(ch)
+}
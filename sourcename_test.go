@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+
+	a "github.com/stretchr/testify/assert"
+)
+
+func Test_LoadSourceNamesConfig(t *testing.T) {
+	cfg, err := loadSourceNamesConfig(strings.NewReader(`
+sources:
+- cidr: 10.1.0.0/16
+  name: dc1
+- cidr: 10.1.2.3/32
+  name: never-matched
+`))
+	if !a.NoError(t, err) {
+		t.FailNow()
+	}
+	a.Len(t, cfg.Sources, 2)
+
+	invalid := map[string]string{
+		"parse":        "sources: {",
+		"invalid cidr": "sources:\n- cidr: 10.1.0.0\n  name: dc1",
+		"missing name": "sources:\n- cidr: 10.1.0.0/16",
+	}
+	for k, in := range invalid {
+		_, err := loadSourceNamesConfig(strings.NewReader(in))
+		a.Error(t, err, k)
+	}
+}
+
+func Test_SourceNamer_Name_Static(t *testing.T) {
+	cfg, _ := loadSourceNamesConfig(strings.NewReader(`
+sources:
+- cidr: 10.1.0.0/16
+  name: dc1
+- cidr: 10.1.2.3/32
+  name: never-matched
+`))
+	sn := newSourceNamer("source", cfg, 0)
+
+	a.Equal(t, "dc1", sn.name(net.ParseIP("10.1.2.3")))
+	a.Equal(t, "10.2.0.1", sn.name(net.ParseIP("10.2.0.1")))
+	a.Len(t, sn.cache, 0)
+}
+
+// thSourceNamerWait waits for lookups started by the namer to be stored.
+func thSourceNamerWait(sn *sourceNamer) {
+	for i := 0; i < 100 && len(sn.lookupSem) > 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// thSourceNamerExpire makes all entries of the cache expired.
+func thSourceNamerExpire(sn *sourceNamer) {
+	sn.cacheMu.Lock()
+	for _, e := range sn.cache {
+		e.expires = time.Now().Add(-time.Second)
+	}
+	sn.cacheMu.Unlock()
+}
+
+func Test_SourceNamer_Name_ReverseDNS(t *testing.T) {
+	sn := newSourceNamer("source", &sourceNamesConfig{}, time.Hour)
+	lookupCh := make(chan string, 10)
+	sn.lookupAddr = func(addr string) ([]string, error) {
+		lookupCh <- addr
+		if addr == "10.0.0.1" {
+			return []string{"hostA.example.com."}, nil
+		}
+		return nil, errors.New("not found")
+	}
+
+	// IP is used until the entry expires
+	a.Equal(t, "10.0.0.1", sn.name(net.ParseIP("10.0.0.1")))
+	a.Equal(t, "10.0.0.2", sn.name(net.ParseIP("10.0.0.2")))
+	thSourceNamerWait(sn)
+	a.Equal(t, "10.0.0.1", sn.name(net.ParseIP("10.0.0.1")), "label is stable after the lookup")
+	a.Equal(t, "10.0.0.2", sn.name(net.ParseIP("10.0.0.2")))
+	a.Len(t, lookupCh, 2, "single lookup per entry")
+
+	// resolved name is used after the entry expires, and it's kept until the next expiry
+	thSourceNamerExpire(sn)
+	a.Equal(t, "hostA.example.com", sn.name(net.ParseIP("10.0.0.1")))
+	a.Equal(t, "10.0.0.2", sn.name(net.ParseIP("10.0.0.2")))
+	thSourceNamerWait(sn)
+	a.Equal(t, "hostA.example.com", sn.name(net.ParseIP("10.0.0.1")))
+	a.Len(t, lookupCh, 4, "entry is refreshed after expiry")
+
+	var mm dto.Metric
+	sn.metricLookups.WithLabelValues("success").Write(&mm)
+	a.Equal(t, float64(2), mm.Counter.GetValue())
+	sn.metricLookups.WithLabelValues("failure").Write(&mm)
+	a.Equal(t, float64(2), mm.Counter.GetValue())
+}
+
+func Test_SourceNamer_LabelSamples_Stable(t *testing.T) {
+	sn := newSourceNamer("source", &sourceNamesConfig{}, time.Hour)
+	sn.lookupAddr = func(addr string) ([]string, error) {
+		return []string{"hostA.example.com."}, nil
+	}
+
+	// every packet of the source gets the same label, whenever the lookup is done
+	names := make(map[string]struct{})
+	for i := 0; i < 100; i++ {
+		samples := []*sample{{name: "name_of_1_metric_total", kind: sampleCounter, labels: map[string]string{}}}
+		sn.labelSamples(net.ParseIP("10.0.0.1"), samples)
+		names[samples[0].labels["source"]] = struct{}{}
+		if i == 50 {
+			thSourceNamerWait(sn)
+		}
+	}
+	a.Equal(t, map[string]struct{}{"10.0.0.1": {}}, names)
+}
+
+func Test_SourceNamer_Name_LookupLimit(t *testing.T) {
+	sn := newSourceNamer("source", &sourceNamesConfig{}, time.Hour)
+	sn.lookupSem = make(chan struct{}, 1)
+	releaseCh := make(chan struct{})
+	sn.lookupAddr = func(addr string) ([]string, error) {
+		<-releaseCh
+		return []string{"host-" + addr}, nil
+	}
+
+	a.Equal(t, "10.0.0.1", sn.name(net.ParseIP("10.0.0.1")))
+	// lookup is not started while the limit is reached
+	a.Equal(t, "10.0.0.2", sn.name(net.ParseIP("10.0.0.2")))
+	a.Len(t, sn.cache, 1)
+
+	// pending entry is never evicted
+	sn.cacheMu.Lock()
+	sn.evict()
+	sn.cacheMu.Unlock()
+	a.Len(t, sn.cache, 1)
+
+	close(releaseCh)
+	thSourceNamerWait(sn)
+	thSourceNamerExpire(sn)
+	a.Equal(t, "host-10.0.0.1", sn.name(net.ParseIP("10.0.0.1")))
+
+	var mm dto.Metric
+	sn.metricLookups.WithLabelValues("skipped").Write(&mm)
+	a.Equal(t, float64(1), mm.Counter.GetValue())
+}
+
+func Test_SourceNamer_Name_RefreshFailed(t *testing.T) {
+	sn := newSourceNamer("source", &sourceNamesConfig{}, time.Hour)
+	sn.lookupAddr = func(addr string) ([]string, error) {
+		return nil, errors.New("timeout")
+	}
+	e := &sourceNameEntry{name: "hostA.example.com", resolved: "hostA.example.com", pending: true}
+	sn.cache["10.0.0.1"] = e
+	sn.lookupSem <- struct{}{}
+
+	sn.lookup("10.0.0.1", e)
+
+	a.Equal(t, "hostA.example.com", sn.name(net.ParseIP("10.0.0.1")), "resolved name is kept")
+	thSourceNamerWait(sn)
+}
+
+func Test_SourceNamer_LabelSamples(t *testing.T) {
+	sn := newSourceNamer("source", &sourceNamesConfig{}, 0)
+	samples := []*sample{
+		{name: "name_of_1_metric_total", kind: sampleCounter, labels: map[string]string{"source": "spoofed"}},
+		{name: "name_of_2_metric_total", kind: sampleCounter, labels: map[string]string{"host": "hostA"}},
+	}
+
+	sn.labelSamples(net.ParseIP("10.0.0.1"), samples)
+
+	a.Equal(t, map[string]string{"source": "10.0.0.1"}, samples[0].labels)
+	a.Equal(t, map[string]string{"host": "hostA", "source": "10.0.0.1"}, samples[1].labels)
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// tenantScrapePathPrefix starts path of the metrics endpoint of the tenant, followed by its name.
+	tenantScrapePathPrefix = "/metrics/"
+
+	// tenantDefault is a name used in metrics for the default tenant, owning samples not assigned to any other.
+	tenantDefault = "default"
+
+	// reasons of the drops before the collector of the tenant
+	tenantDropUnknown      = "unknown_tenant"
+	tenantDropUnauthorized = "unauthorized"
+	tenantDropRateLimit    = "rate_limit"
+)
+
+var (
+	// ErrTenancyInvalid is returned when tenancy config is not valid.
+	ErrTenancyInvalid = errors.New("tenancy: invalid config")
+
+	tenantNameRE = regexp.MustCompile(`^[a-zA-Z0-9]+$`)
+)
+
+// tenancyConfig defines tenants sharing the aggregator.
+// Sample is assigned to the tenant by listener port, token label or tenant label, in that order.
+// Samples not assigned to any tenant belong to the default one, exposed on the main metrics endpoint.
+type tenancyConfig struct {
+	// Label is a name of the label holding name of the tenant. Empty disables assignment by label.
+	// Tenants with token or own listener can not be assigned by label alone.
+	Label string `yaml:"label"`
+	// TokenLabel is a name of the label holding token of the tenant. Empty disables assignment by token.
+	TokenLabel string `yaml:"token_label"`
+
+	Tenants []*tenantConfig `yaml:"tenants"`
+}
+
+type tenantConfig struct {
+	// Name identifies the tenant in the label and in the path of its metrics endpoint
+	Name string `yaml:"name"`
+	// UDPPort is a port of the listener dedicated to the tenant. Zero if tenant has no listener.
+	UDPPort int `yaml:"udp_port"`
+	// Token assigns samples with the same value of the token label to the tenant. Empty if not used.
+	Token string `yaml:"token"`
+
+	// MaxSeries limits number of the series of the tenant. Zero disables the limit.
+	MaxSeries int `yaml:"max_series"`
+	// MaxSamplesPerSecond limits ingest rate of the tenant. Zero disables the limit.
+	MaxSamplesPerSecond float64 `yaml:"max_samples_per_second"`
+	// MaxSamplesBurst is a number of samples accepted above the rate in short bursts. Defaults to the rate.
+	MaxSamplesBurst float64 `yaml:"max_samples_burst"`
+}
+
+// validate checks all tenants. Listener ports are checked against the main one.
+func (tc *tenancyConfig) validate(udpPort int) error {
+	for _, ln := range []string{tc.Label, tc.TokenLabel} {
+		if ln != "" && !tenantNameRE.MatchString(ln) {
+			return errors.Wrapf(ErrTenancyInvalid, "label name: %s", ln)
+		}
+	}
+
+	names := make(map[string]struct{})
+	ports := map[int]struct{}{udpPort: {}}
+	tokens := make(map[string]struct{})
+	for _, t := range tc.Tenants {
+		if !tenantNameRE.MatchString(t.Name) || t.Name == tenantDefault {
+			return errors.Wrapf(ErrTenancyInvalid, "tenant name: %q", t.Name)
+		}
+		if _, found := names[t.Name]; found {
+			return errors.Wrapf(ErrTenancyInvalid, "duplicated tenant: %s", t.Name)
+		}
+		names[t.Name] = struct{}{}
+
+		if t.UDPPort != 0 {
+			if _, found := ports[t.UDPPort]; found || t.UDPPort < 0 || t.UDPPort > 65535 {
+				return errors.Wrapf(ErrTenancyInvalid, "tenant %s: port: %d", t.Name, t.UDPPort)
+			}
+			ports[t.UDPPort] = struct{}{}
+		}
+		if t.Token != "" {
+			if tc.TokenLabel == "" {
+				return errors.Wrapf(ErrTenancyInvalid, "tenant %s: token requires token_label", t.Name)
+			}
+			if _, found := tokens[t.Token]; found {
+				return errors.Wrapf(ErrTenancyInvalid, "tenant %s: duplicated token", t.Name)
+			}
+			tokens[t.Token] = struct{}{}
+		}
+		if t.MaxSeries < 0 || t.MaxSamplesPerSecond < 0 || t.MaxSamplesBurst < 0 {
+			return errors.Wrapf(ErrTenancyInvalid, "tenant %s: negative limit", t.Name)
+		}
+	}
+
+	return nil
+}
+
+// tenant owns separate collector, so it has its own series, processing queue and metrics endpoint.
+type tenant struct {
+	name      string
+	collector *collector
+	// protected tenant has token or own listener, so it can not be identified by the tenant label alone
+	protected bool
+
+	// limiterMu guards limiter, samples of the tenant may come from many listeners
+	limiterMu sync.Mutex
+	// limiter limits ingest rate of the tenant. Nil if not limited.
+	limiter *tokenBucket
+}
+
+// allow checks ingest rate limit of the tenant.
+func (t *tenant) allow() bool {
+	if t.limiter == nil {
+		return true
+	}
+	t.limiterMu.Lock()
+	defer t.limiterMu.Unlock()
+	return t.limiter.allow(time.Now(), 1)
+}
+
+// tenantRouter assigns samples to tenants and hands them over to collectors of the tenants.
+type tenantRouter struct {
+	label      string
+	tokenLabel string
+
+	def     *tenant
+	tenants []*tenant
+	byName  map[string]*tenant
+	byToken map[string]*tenant
+
+	metricSamplesDropped  *prometheus.CounterVec
+	metricMetadataDropped *prometheus.CounterVec
+}
+
+// newTenantRouter creates router with collector of the default tenant.
+// Tenants are added with add.
+func newTenantRouter(cfg *tenancyConfig, def *collector) *tenantRouter {
+	return &tenantRouter{
+		label:      cfg.Label,
+		tokenLabel: cfg.TokenLabel,
+		def:        &tenant{name: tenantDefault, collector: def},
+		byName:     make(map[string]*tenant),
+		byToken:    make(map[string]*tenant),
+		metricSamplesDropped: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "app_tenant_samples_dropped_total",
+				Help: "Number of samples dropped before reaching collector of the tenant.",
+			},
+			[]string{"tenant", "reason"},
+		),
+		metricMetadataDropped: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "app_tenant_metadata_dropped_total",
+				Help: "Number of metadata entries dropped before reaching collector of the tenant.",
+			},
+			[]string{"tenant", "reason"},
+		),
+	}
+}
+
+// add registers tenant with its own collector. Should be called before samples are handled.
+func (tr *tenantRouter) add(cfg *tenantConfig, c *collector) *tenant {
+	c.maxSeries = cfg.MaxSeries
+	t := &tenant{name: cfg.Name, collector: c, protected: cfg.Token != "" || cfg.UDPPort != 0}
+	if cfg.MaxSamplesPerSecond > 0 {
+		burst := cfg.MaxSamplesBurst
+		if burst == 0 {
+			burst = cfg.MaxSamplesPerSecond
+		}
+		t.limiter = newTokenBucket(cfg.MaxSamplesPerSecond, burst, time.Now())
+	}
+
+	tr.tenants = append(tr.tenants, t)
+	tr.byName[cfg.Name] = t
+	if cfg.Token != "" {
+		tr.byToken[cfg.Token] = t
+	}
+	return t
+}
+
+// collectors returns collectors of all tenants, the default one included.
+func (tr *tenantRouter) collectors() []*collector {
+	out := []*collector{tr.def.collector}
+	for _, t := range tr.tenants {
+		out = append(out, t.collector)
+	}
+	return out
+}
+
+// identify finds tenant by labels of the sample received on the shared listener.
+// Tenant with token or own listener can not be identified by its name alone.
+// Returns nil and the reason if sample can not be assigned to any tenant.
+func (tr *tenantRouter) identify(labels map[string]string) (*tenant, string) {
+	t := tr.def
+
+	if token, ok := labels[tr.tokenLabel]; ok && tr.tokenLabel != "" {
+		var found bool
+		if t, found = tr.byToken[token]; !found {
+			return nil, tenantDropUnknown
+		}
+	}
+	if name, ok := labels[tr.label]; ok && tr.label != "" {
+		switch {
+		// token takes precedence, tenant label has to point to the same tenant
+		case t != tr.def:
+			if t.name != name {
+				return nil, tenantDropUnknown
+			}
+		case tr.byName[name] == nil:
+			return nil, tenantDropUnknown
+		case tr.byName[name].protected:
+			return nil, tenantDropUnauthorized
+		default:
+			t = tr.byName[name]
+		}
+	}
+
+	return t, ""
+}
+
+// strip removes labels used for identification of the tenant. Sample is copied if changed.
+func (tr *tenantRouter) strip(s *sample) *sample {
+	out := s
+	for _, ln := range []string{tr.tokenLabel, tr.label} {
+		if _, ok := s.labels[ln]; !ok || ln == "" {
+			continue
+		}
+		if out == s {
+			cp := *s
+			cp.labels = make(map[string]string, len(s.labels))
+			for k, v := range s.labels {
+				cp.labels[k] = v
+			}
+			out = &cp
+		}
+		delete(out.labels, ln)
+	}
+	return out
+}
+
+// handler assigns samples to the tenant and passes them on.
+// Samples from the listener dedicated to the tenant (not nil t) are assigned to it, otherwise tenant is identified by labels.
+// Labels used for the identification are removed in both cases.
+func (tr *tenantRouter) handler(t *tenant, next sampleHandler) sampleHandler {
+	return func(s *sample) error {
+		owner := t
+		if owner == nil {
+			var reason string
+			if owner, reason = tr.identify(s.labels); owner == nil {
+				tr.metricSamplesDropped.WithLabelValues("", reason).Inc()
+				return nil
+			}
+		}
+		// labels are removed also on the dedicated listener, so series are the same however sample was assigned
+		s = tr.strip(s)
+
+		if !owner.allow() {
+			tr.metricSamplesDropped.WithLabelValues(owner.name, tenantDropRateLimit).Inc()
+			return nil
+		}
+
+		if owner != tr.def {
+			cp := *s
+			cp.tenant = owner.name
+			s = &cp
+		}
+		return next(s)
+	}
+}
+
+// write hands sample over to the collector of its tenant.
+func (tr *tenantRouter) write(s *sample) error {
+	if s.tenant == "" {
+		return tr.def.collector.Write(s)
+	}
+	return tr.byName[s.tenant].collector.Write(s)
+}
+
+// metadataHandler hands metadata over to the collector of the tenant only, so tenants can not describe metrics of others.
+// Metadata from the listener dedicated to the tenant (not nil t) is assigned to it,
+// otherwise tenant is identified by shared labels of the packet, like samples.
+func (tr *tenantRouter) metadataHandler(t *tenant) metadataHandler {
+	return func(m *metadata) error {
+		owner := t
+		if owner == nil {
+			var reason string
+			if owner, reason = tr.identify(m.labels); owner == nil {
+				tr.metricMetadataDropped.WithLabelValues("", reason).Inc()
+				return nil
+			}
+		}
+		return owner.collector.WriteMetadata(m)
+	}
+}
+
+// writeMetadata hands metadata over to collectors of all tenants.
+// It's used only for metadata defined by the config (e.g. help of the mappings). Returns the first error.
+func (tr *tenantRouter) writeMetadata(m *metadata) error {
+	var err error
+	for _, c := range tr.collectors() {
+		if cErr := c.WriteMetadata(m); cErr != nil && err == nil {
+			err = cErr
+		}
+	}
+	return err
+}
+
+// Describe implements prometheus.Collector.
+func (tr *tenantRouter) Describe(ch chan<- *prometheus.Desc) {
+	tr.metricSamplesDropped.Describe(ch)
+	tr.metricMetadataDropped.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (tr *tenantRouter) Collect(ch chan<- prometheus.Metric) {
+	tr.metricSamplesDropped.Collect(ch)
+	tr.metricMetadataDropped.Collect(ch)
+}
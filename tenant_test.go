@@ -0,0 +1,202 @@
+package main
+
+import (
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+
+	a "github.com/stretchr/testify/assert"
+)
+
+func thTenantRouter(cfg *tenancyConfig) *tenantRouter {
+	tr := newTenantRouter(cfg, newCollector())
+	for _, tc := range cfg.Tenants {
+		tr.add(tc, newCollector())
+	}
+	return tr
+}
+
+func Test_TenancyConfig_Validate(t *testing.T) {
+	valid := func() *tenancyConfig {
+		return &tenancyConfig{
+			Label:      "tenant",
+			TokenLabel: "token",
+			Tenants: []*tenantConfig{
+				{Name: "teamA", UDPPort: 8126, Token: "secretA"},
+				{Name: "teamB", MaxSeries: 100, MaxSamplesPerSecond: 1000},
+			},
+		}
+	}
+	a.NoError(t, valid().validate(8125))
+
+	cases := map[string]func(tc *tenancyConfig){
+		"invalid label":       func(tc *tenancyConfig) { tc.Label = "tenant-name" },
+		"invalid name":        func(tc *tenancyConfig) { tc.Tenants[0].Name = "team/A" },
+		"empty name":          func(tc *tenancyConfig) { tc.Tenants[0].Name = "" },
+		"default name":        func(tc *tenancyConfig) { tc.Tenants[0].Name = "default" },
+		"duplicated name":     func(tc *tenancyConfig) { tc.Tenants[1].Name = "teamA" },
+		"main port":           func(tc *tenancyConfig) { tc.Tenants[0].UDPPort = 8125 },
+		"duplicated port":     func(tc *tenancyConfig) { tc.Tenants[1].UDPPort = 8126 },
+		"duplicated token":    func(tc *tenancyConfig) { tc.Tenants[1].Token = "secretA" },
+		"token without label": func(tc *tenancyConfig) { tc.TokenLabel = "" },
+		"negative limit":      func(tc *tenancyConfig) { tc.Tenants[1].MaxSeries = -1 },
+	}
+	for k, modify := range cases {
+		tc := valid()
+		modify(tc)
+		a.Error(t, tc.validate(8125), k)
+	}
+}
+
+func Test_TenantRouter_Handler(t *testing.T) {
+	tr := thTenantRouter(&tenancyConfig{
+		Label:      "tenant",
+		TokenLabel: "token",
+		Tenants: []*tenantConfig{
+			{Name: "teamA", Token: "secretA"},
+			{Name: "teamB"},
+		},
+	})
+
+	cases := map[string]struct {
+		port      *tenant
+		labels    map[string]string
+		expTenant string
+		expLabels map[string]string
+	}{
+		"default":  {nil, map[string]string{"host": "hostA"}, "", map[string]string{"host": "hostA"}},
+		"by label": {nil, map[string]string{"host": "hostA", "tenant": "teamB"}, "teamB", map[string]string{"host": "hostA"}},
+		"by token": {nil, map[string]string{"host": "hostA", "token": "secretA"}, "teamA", map[string]string{"host": "hostA"}},
+		"by token and label": {
+			nil, map[string]string{"token": "secretA", "tenant": "teamA"}, "teamA", map[string]string{},
+		},
+		"by port": {tr.byName["teamB"], map[string]string{"host": "hostA", "tenant": "teamA", "token": "secretA"}, "teamB", map[string]string{"host": "hostA"}},
+	}
+
+	for k, tc := range cases {
+		var got *sample
+		h := tr.handler(tc.port, func(s *sample) error {
+			got = s
+			return nil
+		})
+		in := &sample{name: "name_of_1_metric_total", kind: sampleCounter, labels: tc.labels, value: 1}
+		a.NoError(t, h(in), k)
+		if !a.NotNil(t, got, k) {
+			continue
+		}
+		a.Equal(t, tc.expTenant, got.tenant, k)
+		a.Equal(t, tc.expLabels, got.labels, k)
+	}
+}
+
+func Test_TenantRouter_Handler_Dropped(t *testing.T) {
+	tr := thTenantRouter(&tenancyConfig{
+		Label:      "tenant",
+		TokenLabel: "token",
+		Tenants: []*tenantConfig{
+			{Name: "teamA", Token: "secretA", MaxSamplesPerSecond: 0.001, MaxSamplesBurst: 2},
+			{Name: "teamB"},
+			{Name: "teamC", UDPPort: 8126},
+		},
+	})
+
+	var got []*sample
+	h := tr.handler(nil, func(s *sample) error {
+		got = append(got, s)
+		return nil
+	})
+	tfSample := func(labels map[string]string) *sample {
+		return &sample{name: "name_of_1_metric_total", kind: sampleCounter, labels: labels, value: 1}
+	}
+
+	h(tfSample(map[string]string{"tenant": "teamD"}))
+	h(tfSample(map[string]string{"token": "secretD"}))
+	h(tfSample(map[string]string{"token": "secretA", "tenant": "teamB"}))
+	// tenants with token or own listener can not be reached by the name alone
+	h(tfSample(map[string]string{"tenant": "teamA"}))
+	h(tfSample(map[string]string{"tenant": "teamC"}))
+	for i := 0; i < 3; i++ {
+		h(tfSample(map[string]string{"token": "secretA"}))
+	}
+	// other tenants are not affected by the limit
+	h(tfSample(map[string]string{"tenant": "teamB"}))
+
+	a.Len(t, got, 3)
+
+	var mm dto.Metric
+	tr.metricSamplesDropped.WithLabelValues("", "unknown_tenant").Write(&mm)
+	a.Equal(t, float64(3), mm.Counter.GetValue())
+	tr.metricSamplesDropped.WithLabelValues("", "unauthorized").Write(&mm)
+	a.Equal(t, float64(2), mm.Counter.GetValue())
+	tr.metricSamplesDropped.WithLabelValues("teamA", "rate_limit").Write(&mm)
+	a.Equal(t, float64(1), mm.Counter.GetValue())
+}
+
+func Test_TenantRouter_Write(t *testing.T) {
+	tr := thTenantRouter(&tenancyConfig{
+		Label:   "tenant",
+		Tenants: []*tenantConfig{{Name: "teamA"}, {Name: "teamB"}},
+	})
+
+	a.NoError(t, tr.write(&sample{name: "name_of_1_metric_total", kind: sampleCounter, labels: map[string]string{}}))
+	a.NoError(t, tr.write(&sample{name: "name_of_1_metric_total", kind: sampleCounter, labels: map[string]string{}, tenant: "teamB"}))
+
+	a.Len(t, tr.def.collector.ingressCh, 1)
+	a.Len(t, tr.byName["teamA"].collector.ingressCh, 0)
+	a.Len(t, tr.byName["teamB"].collector.ingressCh, 1)
+
+	// metadata defined by the config is known to all tenants
+	a.NoError(t, tr.writeMetadata(&metadata{name: "name_of_1_metric_total", kind: metadataHelp, value: "Number of requests."}))
+	for _, c := range tr.collectors() {
+		a.Equal(t, "Number of requests.", c.metadata.help("name_of_1_metric_total"))
+	}
+}
+
+func Test_TenantRouter_MetadataHandler(t *testing.T) {
+	tr := thTenantRouter(&tenancyConfig{
+		Label:      "tenant",
+		TokenLabel: "token",
+		Tenants: []*tenantConfig{
+			{Name: "teamA", Token: "secretA"},
+			{Name: "teamB"},
+			{Name: "teamC", UDPPort: 8126},
+		},
+	})
+	tfHelp := func(help string, labels map[string]string) *metadata {
+		return &metadata{name: "name_of_1_metric_total", kind: metadataHelp, value: help, labels: labels}
+	}
+
+	h := tr.metadataHandler(nil)
+	a.NoError(t, h(tfHelp("Default.", map[string]string{})))
+	a.NoError(t, h(tfHelp("Team A.", map[string]string{"token": "secretA"})))
+	a.NoError(t, h(tfHelp("Team B.", map[string]string{"tenant": "teamB"})))
+	a.NoError(t, h(tfHelp("Not team A.", map[string]string{"tenant": "teamA"})))
+	a.NoError(t, h(tfHelp("Not team C.", map[string]string{"tenant": "teamC"})))
+	a.NoError(t, tr.metadataHandler(tr.byName["teamC"])(tfHelp("Team C.", map[string]string{"tenant": "teamB"})))
+
+	a.Equal(t, "Default.", tr.def.collector.metadata.help("name_of_1_metric_total"))
+	a.Equal(t, "Team A.", tr.byName["teamA"].collector.metadata.help("name_of_1_metric_total"))
+	a.Equal(t, "Team B.", tr.byName["teamB"].collector.metadata.help("name_of_1_metric_total"))
+	a.Equal(t, "Team C.", tr.byName["teamC"].collector.metadata.help("name_of_1_metric_total"))
+
+	var mm dto.Metric
+	tr.metricMetadataDropped.WithLabelValues("", "unauthorized").Write(&mm)
+	a.Equal(t, float64(2), mm.Counter.GetValue())
+}
+
+func Test_Collector_ProcessSample_MaxSeries(t *testing.T) {
+	c := newCollector()
+	c.hasher = hashMD5
+	c.maxSeries = 2
+
+	for _, lv := range []string{"a", "b", "c", "a"} {
+		c.processSample(&sample{name: "name_of_1_metric_total", kind: sampleCounter, labels: map[string]string{"labelA": lv}, value: 1})
+	}
+
+	a.Len(t, c.counters, 2)
+	var mm dto.Metric
+	c.metricSamplesRejected.WithLabelValues("series_limit").Write(&mm)
+	a.Equal(t, float64(1), mm.Counter.GetValue())
+	c.counters[string(c.hasher(&sample{name: "name_of_1_metric_total", kind: sampleCounter, labels: map[string]string{"labelA": "a"}}))].Write(&mm)
+	a.Equal(t, float64(2), mm.Counter.GetValue())
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/log"
+)
+
+const (
+	// walRecordHeaderSize is a size of the record header: length and CRC32 (IEEE) of the payload.
+	walRecordHeaderSize = 8
+
+	// walRecordMaxSize limits size of the record payload, larger one means the log is corrupted.
+	walRecordMaxSize = 1 << 20
+
+	// walBufferSize is a size of the buffer for records waiting for the sync.
+	walBufferSize = 64 * 1024
+)
+
+// walRecord is a persisted sample accepted by the collector.
+type walRecord struct {
+	Seq          uint64              `json:"seq"`
+	Kind         sampleKind          `json:"kind"`
+	Name         string              `json:"name"`
+	Labels       map[string]string   `json:"labels"`
+	Value        persistedFloat      `json:"value,omitempty"`
+	Member       string              `json:"member,omitempty"`
+	Aggregate    *walRecordAggregate `json:"aggregate,omitempty"`
+	Rate         float64             `json:"rate,omitempty"`
+	Timestamp    *time.Time          `json:"timestamp,omitempty"`
+	TTL          time.Duration       `json:"ttl,omitempty"`
+	HistogramDef []string            `json:"histogramDef,omitempty"`
+	SummaryDef   []string            `json:"summaryDef,omitempty"`
+}
+
+type walRecordAggregate struct {
+	Counts []uint64       `json:"counts"`
+	Sum    persistedFloat `json:"sum"`
+	Count  uint64         `json:"count"`
+}
+
+func newWALRecord(seq uint64, s *sample) *walRecord {
+	r := walRecord{
+		Seq:          seq,
+		Kind:         s.kind,
+		Name:         s.name,
+		Labels:       s.labels,
+		Value:        persistedFloat(s.value),
+		Member:       s.member,
+		Rate:         s.rate,
+		HistogramDef: s.histogramDef,
+		SummaryDef:   s.summaryDef,
+		TTL:          s.ttl,
+	}
+	if s.aggregate != nil {
+		r.Aggregate = &walRecordAggregate{Counts: s.aggregate.counts, Sum: persistedFloat(s.aggregate.sum), Count: s.aggregate.count}
+	}
+	if !s.timestamp.IsZero() {
+		r.Timestamp = &s.timestamp
+	}
+	return &r
+}
+
+func (r *walRecord) sample() *sample {
+	s := sample{
+		name:         r.Name,
+		kind:         r.Kind,
+		labels:       r.Labels,
+		value:        float64(r.Value),
+		member:       r.Member,
+		rate:         r.Rate,
+		histogramDef: r.HistogramDef,
+		summaryDef:   r.SummaryDef,
+		ttl:          r.TTL,
+	}
+	if s.labels == nil {
+		s.labels = make(map[string]string)
+	}
+	if r.Aggregate != nil {
+		s.aggregate = &histogramAggregate{counts: r.Aggregate.Counts, sum: float64(r.Aggregate.Sum), count: r.Aggregate.Count}
+	}
+	if r.Timestamp != nil {
+		s.timestamp = *r.Timestamp
+	}
+	return &s
+}
+
+// wal is an append-only log of the samples accepted since the last snapshot.
+// Records are buffered and made durable in batches by sync.
+type wal struct {
+	path string
+	f    *os.File
+	w    *bufio.Writer
+
+	// dirty is set if there are records appended since the last sync
+	dirty bool
+	// size is a size of the log with records waiting for the sync included
+	size int64
+	// truncations is increased every time all records are removed, so offsets taken before are known to be stale
+	truncations uint64
+}
+
+// openWAL opens log for appending. Content past size (e.g. partially written record) is discarded.
+func openWAL(path string, size int64) (*wal, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "wal: open")
+	}
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, "wal: truncate")
+	}
+	if _, err := f.Seek(size, io.SeekStart); err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, "wal: seek")
+	}
+
+	return &wal{path: path, f: f, w: bufio.NewWriterSize(f, walBufferSize), size: size}, nil
+}
+
+// append adds record of the sample to the log. Record is durable only after sync.
+func (l *wal) append(seq uint64, s *sample) error {
+	payload, err := json.Marshal(newWALRecord(seq, s))
+	if err != nil {
+		return errors.Wrap(err, "wal: encode")
+	}
+
+	var header [walRecordHeaderSize]byte
+	binary.LittleEndian.PutUint32(header[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(header[4:8], crc32.ChecksumIEEE(payload))
+
+	l.w.Write(header[:])
+	if _, err := l.w.Write(payload); err != nil {
+		return errors.Wrap(err, "wal: write")
+	}
+	l.dirty = true
+	l.size += walRecordHeaderSize + int64(len(payload))
+	return nil
+}
+
+// sync makes all appended records durable.
+func (l *wal) sync() error {
+	if !l.dirty {
+		return nil
+	}
+	if err := l.w.Flush(); err != nil {
+		return errors.Wrap(err, "wal: write")
+	}
+	if err := l.f.Sync(); err != nil {
+		return errors.Wrap(err, "wal: sync")
+	}
+	l.dirty = false
+	return nil
+}
+
+// truncate removes all records. Should be called only when state is persisted in the snapshot.
+func (l *wal) truncate() error {
+	l.w.Reset(l.f)
+	l.dirty = false
+	l.size = 0
+	l.truncations++
+	if err := l.f.Truncate(0); err != nil {
+		return errors.Wrap(err, "wal: truncate")
+	}
+	if _, err := l.f.Seek(0, io.SeekStart); err != nil {
+		return errors.Wrap(err, "wal: seek")
+	}
+	return errors.Wrap(l.f.Sync(), "wal: sync")
+}
+
+// offset makes all appended records durable and returns size of the log.
+func (l *wal) offset() (int64, error) {
+	if err := l.sync(); err != nil {
+		return 0, err
+	}
+	off, err := l.f.Seek(0, io.SeekCurrent)
+	return off, errors.Wrap(err, "wal: seek")
+}
+
+// discard removes records before offset, records appended later are kept.
+// Remaining records are written to a temporary file renamed over the log, so crash leaves either the old or the new one.
+// Should be called only when records before offset are persisted in the snapshot.
+func (l *wal) discard(offset int64) error {
+	end, err := l.offset()
+	if err != nil {
+		return err
+	}
+	if offset >= end {
+		return l.truncate()
+	}
+
+	tail := make([]byte, end-offset)
+	if _, err := l.f.ReadAt(tail, offset); err != nil {
+		return errors.Wrap(err, "wal: read")
+	}
+
+	tmp := l.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.Wrap(err, "wal: create")
+	}
+	if _, err := f.Write(tail); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return errors.Wrap(err, "wal: write")
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return errors.Wrap(err, "wal: sync")
+	}
+	if err := os.Rename(tmp, l.path); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return errors.Wrap(err, "wal: rename")
+	}
+	if d, err := os.Open(filepath.Dir(l.path)); err == nil {
+		d.Sync()
+		d.Close()
+	}
+
+	l.f.Close()
+	l.f = f
+	l.w.Reset(f)
+	l.size = int64(len(tail))
+	return nil
+}
+
+func (l *wal) close() error {
+	if err := l.sync(); err != nil {
+		l.f.Close()
+		return err
+	}
+	return l.f.Close()
+}
+
+// readWAL calls fn for every record in the log.
+// Reading stops on the first incomplete or corrupted record, as it's a result of interrupted write.
+// Returns size of the valid part of the log.
+func readWAL(path string, fn func(r *walRecord)) (int64, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, errors.Wrap(err, "wal: open")
+	}
+	defer f.Close()
+
+	var (
+		r      = bufio.NewReader(f)
+		size   int64
+		header [walRecordHeaderSize]byte
+	)
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return size, nil
+		}
+		n := binary.LittleEndian.Uint32(header[0:4])
+		if n > walRecordMaxSize {
+			return size, nil
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return size, nil
+		}
+		if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(header[4:8]) {
+			return size, nil
+		}
+		var rec walRecord
+		if err := json.Unmarshal(payload, &rec); err != nil {
+			return size, nil
+		}
+
+		fn(&rec)
+		size += walRecordHeaderSize + int64(n)
+	}
+}
+
+// openWAL replays samples from the log not covered by the restored snapshot and opens the log for appending.
+// Should be called after restore and before processing is started.
+// Returns number of replayed samples.
+func (c *collector) openWAL(path string) (int, error) {
+	// replayed samples were already validated on arrival, they are expected to be old
+	maxSkew := c.timestampMaxSkew
+	c.timestampMaxSkew = 0
+	defer func() { c.timestampMaxSkew = maxSkew }()
+
+	var replayed int
+	size, err := readWAL(path, func(r *walRecord) {
+		if r.Seq <= c.walSeq {
+			return
+		}
+		c.processSample(r.sample())
+		c.walSeq = r.Seq
+		replayed++
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	l, err := openWAL(path, size)
+	if err != nil {
+		return 0, err
+	}
+	c.wal = l
+	c.metricWALSize.Set(float64(l.size))
+
+	return replayed, nil
+}
+
+// walAppend adds sample to the log, if enabled.
+// Log reaching walMaxSize (e.g. when snapshots fail) is truncated, so samples in it are persisted only by the next snapshot.
+// Should be called only from process, before the sample is applied.
+func (c *collector) walAppend(s *sample) {
+	if c.wal == nil {
+		return
+	}
+	if c.walMaxSize > 0 && c.wal.size >= c.walMaxSize {
+		c.metricWALOverflows.Inc()
+		log.Errorf("WAL size limit reached (%d bytes), samples since the last snapshot are dropped from the log", c.wal.size)
+		if err := c.wal.truncate(); err != nil {
+			c.metricWALFailures.WithLabelValues("truncate").Inc()
+			log.Errorf("WAL truncate failed: %s", err)
+		}
+	}
+	c.walSeq++
+	if err := c.wal.append(c.walSeq, s); err != nil {
+		c.metricWALFailures.WithLabelValues("append").Inc()
+		log.Errorf("WAL append failed: %s", err)
+	}
+	c.metricWALSize.Set(float64(c.wal.size))
+}
+
+// walSync makes appended samples durable, if log is enabled.
+// Should be called only from process.
+func (c *collector) walSync() {
+	if c.wal == nil {
+		return
+	}
+	if err := c.wal.sync(); err != nil {
+		c.metricWALFailures.WithLabelValues("sync").Inc()
+		log.Errorf("WAL sync failed: %s", err)
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+
+	a "github.com/stretchr/testify/assert"
+)
+
+func Test_WAL_AppendRead(t *testing.T) {
+	dir, cleanup := thSnapshotDir(t)
+	defer cleanup()
+	path := filepath.Join(dir, "samples.wal")
+
+	samples := []*sample{
+		{name: "name_of_1_metric_total", kind: sampleCounter, labels: map[string]string{"labelA": "labelValueA"}, value: 3, rate: 0.5, timestamp: time.Unix(1500000000, 0).UTC()},
+		{name: "name_of_2_metric_seconds", kind: sampleHistogramLinear, labels: map[string]string{}, histogramDef: []string{"1", "1", "1"}, aggregate: &histogramAggregate{counts: []uint64{2}, sum: 3, count: 4}},
+		{name: "name_of_3_metric_users", kind: sampleSet, labels: map[string]string{}, member: "user1"},
+	}
+
+	l, err := openWAL(path, 0)
+	if !a.NoError(t, err) {
+		t.FailNow()
+	}
+	for i, s := range samples {
+		a.NoError(t, l.append(uint64(i+1), s))
+	}
+	a.NoError(t, l.close())
+
+	var got []*sample
+	size, err := readWAL(path, func(r *walRecord) {
+		a.Equal(t, uint64(len(got)+1), r.Seq)
+		got = append(got, r.sample())
+	})
+	a.NoError(t, err)
+	a.Equal(t, samples, got)
+
+	// partially written record is discarded
+	fi, _ := os.Stat(path)
+	a.Equal(t, fi.Size(), size)
+	os.Truncate(path, size-3)
+	got = got[:0]
+	size, _ = readWAL(path, func(r *walRecord) { got = append(got, r.sample()) })
+	a.Len(t, got, 2)
+
+	// appending continues after the last valid record
+	l, err = openWAL(path, size)
+	if !a.NoError(t, err) {
+		t.FailNow()
+	}
+	a.NoError(t, l.append(4, samples[2]))
+	a.NoError(t, l.close())
+	got = got[:0]
+	readWAL(path, func(r *walRecord) { got = append(got, r.sample()) })
+	a.Len(t, got, 3)
+}
+
+func Test_Collector_WAL_Replay(t *testing.T) {
+	dir, cleanup := thSnapshotDir(t)
+	defer cleanup()
+
+	s := &sample{name: "name_of_1_metric_total", kind: sampleCounter, labels: map[string]string{}, value: 1}
+
+	newC := func() *collector {
+		c := newCollector()
+		c.hasher = hashMD5
+		c.snapshotFile = filepath.Join(dir, "state.snapshot")
+		c.snapshotInterval = 0
+		c.walSyncInterval = 0
+		if snap, err := readSnapshot(c.snapshotFile); err == nil {
+			c.restore(snap)
+		}
+		if _, err := c.openWAL(filepath.Join(dir, "samples.wal")); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	value := func(c *collector) float64 {
+		var mm dto.Metric
+		if m, found := c.counters[string(c.hasher(s))]; found {
+			m.Write(&mm)
+		}
+		return mm.Counter.GetValue()
+	}
+	// apply emulates process, which is stopped on synchronisation and can not be reused
+	apply := func(c *collector, n int) {
+		for i := 0; i < n; i++ {
+			c.walAppend(s)
+			c.processSample(s)
+		}
+	}
+
+	// crash without snapshot, samples are in the log only
+	c := newC()
+	apply(c, 2)
+	c.walSync()
+	c.wal.close()
+
+	c = newC()
+	a.Equal(t, float64(2), value(c))
+
+	// log is truncated after the snapshot
+	apply(c, 1)
+	a.NoError(t, c.saveSnapshot())
+	fi, _ := os.Stat(filepath.Join(dir, "samples.wal"))
+	a.Equal(t, int64(0), fi.Size())
+
+	apply(c, 1)
+	c.walSync()
+	c.wal.close()
+
+	c = newC()
+	a.Equal(t, float64(4), value(c))
+	a.Equal(t, uint64(4), c.walSeq)
+	c.wal.close()
+}
+
+func Test_Collector_WAL_SnapshotInBackground(t *testing.T) {
+	dir, cleanup := thSnapshotDir(t)
+	defer cleanup()
+	walPath := filepath.Join(dir, "samples.wal")
+
+	s := &sample{name: "name_of_1_metric_total", kind: sampleCounter, labels: map[string]string{}, value: 1}
+
+	c := newCollector()
+	c.hasher = hashMD5
+	c.snapshotFile = filepath.Join(dir, "state.snapshot")
+	if _, err := c.openWAL(walPath); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		c.walAppend(s)
+		c.processSample(s)
+	}
+
+	c.startSnapshot()
+	// processing continues while snapshot is written
+	c.walAppend(s)
+	c.processSample(s)
+	// only one snapshot is written at a time
+	c.startSnapshot()
+	c.finishSnapshot(<-c.snapshotDoneCh)
+	a.Nil(t, c.snapshotDoneCh)
+	c.walSync()
+	c.wal.close()
+
+	// samples included in the snapshot are removed from the log, later ones are kept
+	var seqs []uint64
+	readWAL(walPath, func(r *walRecord) { seqs = append(seqs, r.Seq) })
+	a.Equal(t, []uint64{3}, seqs)
+
+	snap, err := readSnapshot(c.snapshotFile)
+	if !a.NoError(t, err) {
+		t.FailNow()
+	}
+	a.Equal(t, uint64(2), snap.WALSeq)
+
+	var mm dto.Metric
+	c.metricSnapshots.WithLabelValues("skipped").Write(&mm)
+	a.Equal(t, float64(1), mm.Counter.GetValue())
+}
+
+func Test_Collector_WAL_ReplaySkipsSnapshotted(t *testing.T) {
+	dir, cleanup := thSnapshotDir(t)
+	defer cleanup()
+	walPath := filepath.Join(dir, "samples.wal")
+
+	s := &sample{name: "name_of_1_metric_total", kind: sampleCounter, labels: map[string]string{}, value: 1}
+
+	// crash between snapshot and truncation of the log
+	l, _ := openWAL(walPath, 0)
+	l.append(1, s)
+	l.append(2, s)
+	l.close()
+
+	c := newCollector()
+	c.hasher = hashMD5
+	c.restore(&snapshot{WALSeq: 1, Series: []*snapshotSeries{{Kind: sampleCounter, Name: s.name, Value: 1, Help: "auto"}}})
+	n, err := c.openWAL(walPath)
+	a.NoError(t, err)
+	a.Equal(t, 1, n)
+
+	var mm dto.Metric
+	c.counters[string(c.hasher(s))].Write(&mm)
+	a.Equal(t, float64(2), mm.Counter.GetValue())
+	c.wal.close()
+}
+
+func Test_Collector_WAL_SizeLimit(t *testing.T) {
+	dir, cleanup := thSnapshotDir(t)
+	defer cleanup()
+	walPath := filepath.Join(dir, "samples.wal")
+
+	s := &sample{name: "name_of_1_metric_total", kind: sampleCounter, labels: map[string]string{}, value: 1}
+
+	c := newCollector()
+	c.hasher = hashMD5
+	c.snapshotFile = filepath.Join(dir, "state.snapshot")
+	if _, err := c.openWAL(walPath); err != nil {
+		t.Fatal(err)
+	}
+	c.walAppend(s)
+	recordSize := c.wal.size
+	c.walMaxSize = 3 * recordSize
+
+	// snapshot is started before the log reaches the limit
+	c.startSnapshot()
+	for i := 0; i < 4; i++ {
+		c.walAppend(s)
+		c.processSample(s)
+	}
+	a.Equal(t, 2*recordSize, c.wal.size, "log is truncated when the limit is reached")
+
+	// records appended after truncation are not removed by the snapshot started before
+	c.finishSnapshot(<-c.snapshotDoneCh)
+	c.walSync()
+	var seqs []uint64
+	readWAL(walPath, func(r *walRecord) { seqs = append(seqs, r.Seq) })
+	a.Equal(t, []uint64{4, 5}, seqs)
+
+	var mm dto.Metric
+	c.metricWALOverflows.Write(&mm)
+	a.Equal(t, float64(1), mm.Counter.GetValue())
+	c.metricWALSize.Write(&mm)
+	a.Equal(t, float64(2*recordSize), mm.Gauge.GetValue())
+
+	// size is known after restart
+	c.wal.close()
+	c = newCollector()
+	c.hasher = hashMD5
+	if _, err := c.openWAL(walPath); err != nil {
+		t.Fatal(err)
+	}
+	a.Equal(t, 2*recordSize, c.wal.size)
+	c.wal.close()
+}
+
+func thBenchmarkCollectorProcess(b *testing.B, withWAL bool) {
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := newCollector()
+	if withWAL {
+		if _, err := c.openWAL(filepath.Join(dir, "samples.wal")); err != nil {
+			b.Fatal(err)
+		}
+	}
+	s := &sample{
+		name: "name_of_1_metric_total", kind: sampleCounter,
+		labels: map[string]string{"service": "srvA1", "host": "hostA", "phpVersion": "5.6"},
+		value:  1,
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.walAppend(s)
+		c.processSample(s)
+		// sync interval is emulated as batch of 10k samples
+		if i%10000 == 0 {
+			c.walSync()
+		}
+	}
+	b.StopTimer()
+	if c.wal != nil {
+		c.wal.close()
+	}
+}
+
+func Benchmark_Collector_Process_NoWAL(b *testing.B) {
+	thBenchmarkCollectorProcess(b, false)
+}
+
+func Benchmark_Collector_Process_WAL(b *testing.B) {
+	thBenchmarkCollectorProcess(b, true)
+}